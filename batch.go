@@ -0,0 +1,136 @@
+package fsdb
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Entry is a key and data pair used in WriteMany function.
+type Entry struct {
+	Key  Key
+	Data io.Reader
+}
+
+// RunBatch runs f for every key, using up to workers goroutines concurrently.
+//
+// f is called with the index of the key.
+// If the context is canceled, the keys not started yet will fail with the
+// context error.
+//
+// If any of the calls failed, it returns a *BatchError.
+// Otherwise it returns nil.
+//
+// It can be used by FSDB implementations to implement batch operations.
+func RunBatch(
+	ctx context.Context,
+	keys []Key,
+	workers int,
+	f func(i int) error,
+) error {
+	if workers < 1 {
+		workers = 1
+	}
+	errs := make([]error, len(keys))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				select {
+				default:
+					errs[i] = f(i)
+				case <-ctx.Done():
+					errs[i] = ctx.Err()
+				}
+			}
+		}()
+	}
+	for i := range keys {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{
+				Keys:   keys,
+				Errors: errs,
+			}
+		}
+	}
+	return nil
+}
+
+// ReadMany runs read for every key, using up to workers goroutines
+// concurrently, and returns the readers in the same order as keys.
+//
+// It can be used by FSDB implementations to implement ReadMany.
+// Errors are returned the same way as RunBatch.
+func ReadMany(
+	ctx context.Context,
+	keys []Key,
+	workers int,
+	read func(ctx context.Context, key Key) (io.ReadCloser, error),
+) ([]io.ReadCloser, error) {
+	readers := make([]io.ReadCloser, len(keys))
+	err := RunBatch(
+		ctx,
+		keys,
+		workers,
+		func(i int) (err error) {
+			readers[i], err = read(ctx, keys[i])
+			return
+		},
+	)
+	return readers, err
+}
+
+// WriteMany runs write for every entry, using up to workers goroutines
+// concurrently.
+//
+// It can be used by FSDB implementations to implement WriteMany.
+// Errors are returned the same way as RunBatch.
+func WriteMany(
+	ctx context.Context,
+	entries []Entry,
+	workers int,
+	write func(ctx context.Context, key Key, data io.Reader) error,
+) error {
+	keys := make([]Key, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	return RunBatch(
+		ctx,
+		keys,
+		workers,
+		func(i int) error {
+			return write(ctx, entries[i].Key, entries[i].Data)
+		},
+	)
+}
+
+// DeleteMany runs del for every key, using up to workers goroutines
+// concurrently.
+//
+// It can be used by FSDB implementations to implement DeleteMany.
+// Errors are returned the same way as RunBatch.
+func DeleteMany(
+	ctx context.Context,
+	keys []Key,
+	workers int,
+	del func(ctx context.Context, key Key) error,
+) error {
+	return RunBatch(
+		ctx,
+		keys,
+		workers,
+		func(i int) error {
+			return del(ctx, keys[i])
+		},
+	)
+}
@@ -0,0 +1,164 @@
+package fsdb_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fishy/fsdb"
+)
+
+func TestRunBatch(t *testing.T) {
+	ctx := context.Background()
+	keys := []fsdb.Key{
+		fsdb.Key("foo"),
+		fsdb.Key("bar"),
+		fsdb.Key("foobar"),
+		fsdb.Key("barfoo"),
+	}
+	workers := 2
+
+	running := new(int64)
+	maxRunning := new(int64)
+	called := make([]bool, len(keys))
+	if err := fsdb.RunBatch(ctx, keys, workers, func(i int) error {
+		n := atomic.AddInt64(running, 1)
+		defer atomic.AddInt64(running, -1)
+		for {
+			max := atomic.LoadInt64(maxRunning)
+			if n <= max || atomic.CompareAndSwapInt64(maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 10)
+		called[i] = true
+		return nil
+	}); err != nil {
+		t.Fatalf("RunBatch failed: %v", err)
+	}
+	for i, c := range called {
+		if !c {
+			t.Errorf("f not called for %v", keys[i])
+		}
+	}
+	if *maxRunning > int64(workers) {
+		t.Errorf("Expected at most %d concurrent calls, got %d", workers, *maxRunning)
+	}
+
+	fail := errors.New("fail")
+	err := fsdb.RunBatch(ctx, keys, workers, func(i int) error {
+		if i%2 == 1 {
+			return fail
+		}
+		return nil
+	})
+	if !fsdb.IsBatchError(err) {
+		t.Fatalf("Expected BatchError, got %v", err)
+	}
+	batchErr := err.(*fsdb.BatchError)
+	for i, e := range batchErr.Errors {
+		if i%2 == 1 && e != fail {
+			t.Errorf("Expected error %v for %v, got %v", fail, keys[i], e)
+		}
+		if i%2 == 0 && e != nil {
+			t.Errorf("Expected nil error for %v, got %v", keys[i], e)
+		}
+	}
+	expect := "fsdb: 2 of 4 keys failed in batch: errbatch: total 2 error(s) in this batch: \"bar\": fail; \"barfoo\": fail"
+	if actual := err.Error(); actual != expect {
+		t.Errorf("Error() expected %q, got %q", expect, actual)
+	}
+}
+
+func TestBatchHelpers(t *testing.T) {
+	ctx := context.Background()
+	keys := []fsdb.Key{
+		fsdb.Key("foo"),
+		fsdb.Key("bar"),
+		fsdb.Key("foobar"),
+	}
+	workers := 2
+
+	var lock sync.Mutex
+	written := make(map[string]string)
+	entries := make([]fsdb.Entry, len(keys))
+	for i, key := range keys {
+		entries[i] = fsdb.Entry{
+			Key:  key,
+			Data: strings.NewReader("data-" + string(key)),
+		}
+	}
+	if err := fsdb.WriteMany(
+		ctx,
+		entries,
+		workers,
+		func(_ context.Context, key fsdb.Key, data io.Reader) error {
+			content, err := ioutil.ReadAll(data)
+			if err != nil {
+				return err
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			written[string(key)] = string(content)
+			return nil
+		},
+	); err != nil {
+		t.Fatalf("WriteMany failed: %v", err)
+	}
+
+	readers, err := fsdb.ReadMany(
+		ctx,
+		keys,
+		workers,
+		func(_ context.Context, key fsdb.Key) (io.ReadCloser, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			return ioutil.NopCloser(strings.NewReader(written[string(key)])), nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("ReadMany failed: %v", err)
+	}
+	for i, reader := range readers {
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("Read %v failed: %v", keys[i], err)
+		}
+		expect := "data-" + string(keys[i])
+		if string(content) != expect {
+			t.Errorf("Read %v expected %q, got %q", keys[i], expect, content)
+		}
+	}
+
+	fail := errors.New("fail")
+	err = fsdb.DeleteMany(
+		ctx,
+		keys,
+		workers,
+		func(_ context.Context, key fsdb.Key) error {
+			if string(key) == "bar" {
+				return fail
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			delete(written, string(key))
+			return nil
+		},
+	)
+	if !fsdb.IsBatchError(err) {
+		t.Fatalf("Expected BatchError, got %v", err)
+	}
+	if e := err.(*fsdb.BatchError).Errors[1]; e != fail {
+		t.Errorf("Expected error %v for %v, got %v", fail, keys[1], e)
+	}
+	if len(written) != 1 {
+		t.Errorf("Expected only %v left, got %v", keys[1], written)
+	}
+}
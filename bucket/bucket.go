@@ -3,6 +3,7 @@ package bucket
 import (
 	"context"
 	"io"
+	"time"
 )
 
 // Bucket defines the interface for a remote storage bucket (e.g. s3 or gcs).
@@ -22,3 +23,74 @@ type Bucket interface {
 	// entry does not exist on the bucket.
 	IsNotExist(err error) bool
 }
+
+// ObjectInfo defines the metadata of an entry on the bucket.
+type ObjectInfo struct {
+	// Size is the size of the entry in bytes.
+	Size int64
+
+	// ModTime is the last modification time of the entry.
+	ModTime time.Time
+
+	// Metadata is the user-defined metadata of the entry.
+	//
+	// It's nil if the entry has no metadata,
+	// or the bucket does not implement MetadataBucket.
+	Metadata map[string]string
+}
+
+// StatBucket defines an optional extension to Bucket,
+// for buckets that can get the metadata of an entry without downloading it
+// (e.g. HEAD requests).
+type StatBucket interface {
+	Bucket
+
+	// Stat returns the metadata of an entry.
+	//
+	// If the entry does not exist, the error returned should satisfy IsNotExist.
+	Stat(ctx context.Context, name string) (*ObjectInfo, error)
+}
+
+// RangeBucket defines an optional extension to Bucket,
+// for buckets that can download part of an entry (e.g. Range requests).
+type RangeBucket interface {
+	Bucket
+
+	// ReadRange downloads length bytes of an entry starting at offset.
+	//
+	// If length is negative, it reads till the end of the entry.
+	// If the entry is shorter than offset+length,
+	// the ReadCloser returned will reach EOF earlier.
+	//
+	// It's the caller's responsibility to close the ReadCloser returned.
+	ReadRange(
+		ctx context.Context,
+		name string,
+		offset int64,
+		length int64,
+	) (io.ReadCloser, error)
+}
+
+// MetadataBucket defines an optional extension to Bucket,
+// for buckets that can store user-defined metadata alongside an entry
+// (e.g. custom headers).
+type MetadataBucket interface {
+	Bucket
+
+	// ReadWithMetadata works like Read,
+	// but also returns the user-defined metadata of the entry.
+	ReadWithMetadata(ctx context.Context, name string) (
+		io.ReadCloser,
+		map[string]string,
+		error,
+	)
+
+	// WriteWithMetadata works like Write,
+	// but also stores the user-defined metadata with the entry.
+	WriteWithMetadata(
+		ctx context.Context,
+		name string,
+		data io.Reader,
+		metadata map[string]string,
+	) error
+}
@@ -10,8 +10,13 @@ import (
 	"github.com/fishy/fsdb/local"
 )
 
-// Make sure *Mock satisfies Bucket interface.
-var _ Bucket = (*Mock)(nil)
+// Make sure *Mock satisfies Bucket and its optional extension interfaces.
+var (
+	_ Bucket         = (*Mock)(nil)
+	_ StatBucket     = (*Mock)(nil)
+	_ MetadataBucket = (*Mock)(nil)
+	_ RangeBucket    = (*Mock)(nil)
+)
 
 // MockOperationDelay defines the delays of an operation (function call).
 // It's useful to mimic network latency in local tests.
@@ -36,6 +41,23 @@ type MockOperationDelay struct {
 	Total time.Duration
 }
 
+// start sleeps for Before,
+// and returns the function to be deferred after the actual operation.
+func (d MockOperationDelay) start() (done func()) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(d.Total)
+	}()
+
+	time.Sleep(d.Before)
+	return func() {
+		time.Sleep(d.After)
+		wg.Wait()
+	}
+}
+
 // Mock is a mock implementation of Bucket, backed by local FSDB.
 type Mock struct {
 	db fsdb.Local
@@ -43,6 +65,7 @@ type Mock struct {
 	ReadDelay   MockOperationDelay
 	WriteDelay  MockOperationDelay
 	DeleteDelay MockOperationDelay
+	StatDelay   MockOperationDelay
 }
 
 // MockBucket creates a new mock Bucket using fsdb.
@@ -54,49 +77,73 @@ func MockBucket(root string) *Mock {
 
 // Read reads the file from fsdb.
 func (m *Mock) Read(ctx context.Context, name string) (io.ReadCloser, error) {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	defer wg.Wait()
-	go func() {
-		defer wg.Done()
-		time.Sleep(m.ReadDelay.Total)
-	}()
-
-	time.Sleep(m.ReadDelay.Before)
-	defer time.Sleep(m.ReadDelay.After)
+	defer m.ReadDelay.start()()
 	return m.db.Read(ctx, fsdb.Key(name))
 }
 
+// ReadRange reads part of the file from fsdb.
+func (m *Mock) ReadRange(
+	ctx context.Context,
+	name string,
+	offset int64,
+	length int64,
+) (io.ReadCloser, error) {
+	defer m.ReadDelay.start()()
+	return m.db.ReadRange(ctx, fsdb.Key(name), offset, length)
+}
+
 // Write writes the file to fsdb.
 func (m *Mock) Write(ctx context.Context, name string, data io.Reader) error {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	defer wg.Wait()
-	go func() {
-		defer wg.Done()
-		time.Sleep(m.WriteDelay.Total)
-	}()
-
-	time.Sleep(m.WriteDelay.Before)
-	defer time.Sleep(m.WriteDelay.After)
+	defer m.WriteDelay.start()()
 	return m.db.Write(ctx, fsdb.Key(name), data)
 }
 
+// ReadWithMetadata reads the file and its metadata from fsdb.
+func (m *Mock) ReadWithMetadata(ctx context.Context, name string) (
+	io.ReadCloser,
+	map[string]string,
+	error,
+) {
+	defer m.ReadDelay.start()()
+	return m.db.ReadWithMetadata(ctx, fsdb.Key(name))
+}
+
+// WriteWithMetadata writes the file with its metadata to fsdb.
+func (m *Mock) WriteWithMetadata(
+	ctx context.Context,
+	name string,
+	data io.Reader,
+	metadata map[string]string,
+) error {
+	defer m.WriteDelay.start()()
+	return m.db.WriteWithOptions(
+		ctx,
+		fsdb.Key(name),
+		data,
+		fsdb.WriteOptions{Metadata: metadata},
+	)
+}
+
 // Delete deletes the file from fsdb.
 func (m *Mock) Delete(ctx context.Context, name string) error {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	defer wg.Wait()
-	go func() {
-		defer wg.Done()
-		time.Sleep(m.DeleteDelay.Total)
-	}()
-
-	time.Sleep(m.DeleteDelay.Before)
-	defer time.Sleep(m.DeleteDelay.After)
+	defer m.DeleteDelay.start()()
 	return m.db.Delete(ctx, fsdb.Key(name))
 }
 
+// Stat gets the metadata of the file from fsdb.
+func (m *Mock) Stat(ctx context.Context, name string) (*ObjectInfo, error) {
+	defer m.StatDelay.start()()
+	info, err := m.db.Stat(ctx, fsdb.Key(name))
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Size:     info.Size,
+		ModTime:  info.ModTime,
+		Metadata: info.Metadata,
+	}, nil
+}
+
 // IsNotExist calls fsdb.IsNoSuchKeyError.
 func (m *Mock) IsNotExist(err error) bool {
 	return fsdb.IsNoSuchKeyError(err)
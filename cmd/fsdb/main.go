@@ -0,0 +1,198 @@
+// Command fsdb provides tools to maintain local FSDB.
+//
+// Usage:
+//
+//     fsdb fsck [flags] <root>
+//
+// fsck checks the local FSDB under root for problems,
+// and optionally repairs them.
+// Run "fsdb fsck -h" for the flags.
+// The options used by the FSDB (data dir, temp dir, directory level, etc.)
+// must be passed via flags if they are not the defaults.
+// For encrypted FSDBs, the keys must be passed via -key-dir,
+// one file per key named by its ID containing the raw key.
+// fsck stops with an error on entries it can't check with the flags,
+// instead of reporting them as problems.
+// FSDBs using custom hash functions or codecs not supported by the flags
+// need to call local.Check with their own options instead.
+//
+// It exits with status 1 when there are problems not repaired,
+// and 2 on usage or I/O errors.
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"flag"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fishy/fsdb/crypt"
+	"github.com/fishy/fsdb/local"
+)
+
+// hashFuncs are the hash functions supported by -hash flag.
+var hashFuncs = map[string]func() hash.Hash{
+	"sha512/224": sha512.New512_224,
+	"sha512/256": sha512.New512_256,
+	"sha512":     sha512.New,
+	"sha256":     sha256.New,
+	"sha1":       sha1.New,
+	"md5":        md5.New,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	default:
+		usage()
+	case "fsck":
+		os.Exit(fsck(os.Args[2:]))
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s fsck [flags] <root>\n", os.Args[0])
+	os.Exit(2)
+}
+
+func fsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair the problems found")
+	quick := flags.Bool("quick", false, "skip reading data files")
+	verbose := flags.Bool("v", false, "also print the problems repaired")
+	dataDir := flags.String("data-dir", local.DefaultDataDir, "relative data directory")
+	tempDir := flags.String("temp-dir", local.DefaultTempDir, "relative temporary directory")
+	indexDir := flags.String("index-dir", local.DefaultIndexDir, "relative key index directory")
+	useIndex := flags.Bool("index", local.DefaultUseKeyIndex, "whether key index is used")
+	dirLevel := flags.Int("dir-level", local.DefaultDirLevel, "directory level")
+	slots := flags.Bool(
+		"slots",
+		local.DefaultUseCollisionSlots,
+		"whether collision slots are used",
+	)
+	hashName := flags.String(
+		"hash",
+		"sha512/224",
+		"hash function, one of "+strings.Join(hashNames(), ", "),
+	)
+	keyDir := flags.String(
+		"key-dir",
+		"",
+		"directory of the encryption keys, one file per key named by its id",
+	)
+	staleAge := flags.Duration(
+		"stale-age",
+		local.DefaultStaleTempDirAge,
+		"age after which unmodified temp directories are considered leaked",
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s fsck [flags] <root>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	hashFunc := hashFuncs[*hashName]
+	if hashFunc == nil {
+		fmt.Fprintf(os.Stderr, "unknown hash function %q\n", *hashName)
+		return 2
+	}
+	opts := local.NewDefaultOptions(flags.Arg(0)).
+		SetDataDir(*dataDir).
+		SetTempDir(*tempDir).
+		SetIndexDir(*indexDir).
+		SetUseKeyIndex(*useIndex).
+		SetDirLevel(*dirLevel).
+		SetUseCollisionSlots(*slots).
+		SetHashFunc(hashFunc).
+		SetStaleTempDirAge(*staleAge)
+	if *keyDir != "" {
+		keys, err := loadKeys(*keyDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load keys: %v\n", err)
+			return 2
+		}
+		opts.SetEncryptor(crypt.NewEncryptor(crypt.StaticKeyProvider{Keys: keys}))
+	}
+	result, err := local.Check(
+		context.Background(),
+		opts,
+		local.CheckOptions{
+			Repair: *repair,
+			Quick:  *quick,
+		},
+	)
+
+	unrepaired := 0
+	for _, p := range result.Problems {
+		if !p.Repaired {
+			unrepaired++
+		}
+		if *verbose || !p.Repaired {
+			fmt.Println(p)
+		}
+	}
+	fmt.Printf("checked %d entries\n", result.Entries)
+	for _, t := range local.ProblemTypes {
+		found, repaired := result.Count(t)
+		if *repair {
+			fmt.Printf("%s: found %d, repaired %d\n", t, found, repaired)
+		} else {
+			fmt.Printf("%s: found %d\n", t, found)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck failed: %v\n", err)
+		return 2
+	}
+	if unrepaired > 0 {
+		return 1
+	}
+	return 0
+}
+
+// hashNames returns the names of the hash functions supported, sorted.
+func hashNames() []string {
+	names := make([]string, 0, len(hashFuncs))
+	for name := range hashFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadKeys loads the encryption keys from the files under dir,
+// by their filenames as the key IDs.
+func loadKeys(dir string) (map[string][]byte, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		key, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		keys[info.Name()] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,237 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec defines a compression codec.
+type Codec interface {
+	// Name returns the name of the codec, e.g. "gzip".
+	Name() string
+
+	// Suffix returns the filename suffix of the data compressed by this codec,
+	// including the leading dot (e.g. ".gz").
+	//
+	// Suffix is used to tell codecs apart on disk,
+	// so it must be unique among the codecs used together.
+	// Only the uncompressed codec (None) returns an empty suffix.
+	Suffix() string
+
+	// NewWriter returns a writer compressing data into w.
+	//
+	// Closing the returned writer flushes the compressed data,
+	// but does not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a reader decompressing data from r.
+	//
+	// Closing the returned reader does not close r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Magic is an optional interface a Codec could implement.
+//
+// Codecs implementing it can be auto-detected by Detect.
+type Magic interface {
+	// Magic returns the magic bytes at the beginning of the compressed data.
+	Magic() []byte
+}
+
+// Make sure the built-in codecs satisfy Codec and Magic interfaces.
+var (
+	_ Codec = None
+	_ Codec = gzipCodec(0)
+	_ Magic = gzipCodec(0)
+	_ Codec = zstdCodec(0)
+	_ Magic = zstdCodec(0)
+	_ Codec = Snappy
+	_ Magic = snappyCodec{}
+)
+
+// Magic bytes of the built-in codecs.
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+)
+
+// None is the codec storing data uncompressed.
+var None Codec = noneCodec{}
+
+// Snappy is the codec using snappy framing format.
+var Snappy Codec = snappyCodec{}
+
+// Gzip returns a codec using gzip with the given compression level.
+//
+// See compress/gzip for the valid levels.
+func Gzip(level int) Codec {
+	return gzipCodec(level)
+}
+
+// Zstd returns a codec using zstd with the given compression level.
+//
+// The level is the same as the zstd command line tool (1-22),
+// and is mapped to the closest level supported by the implementation.
+// 0 means the default level (3).
+func Zstd(level int) Codec {
+	return zstdCodec(level)
+}
+
+// Builtins returns all the built-in codecs with their default levels.
+func Builtins() []Codec {
+	return []Codec{
+		None,
+		Gzip(gzip.DefaultCompression),
+		Zstd(0),
+		Snappy,
+	}
+}
+
+// Detect detects the codec used by the data from r by its magic bytes,
+// among the codecs implementing Magic interface.
+//
+// It returns the codec detected (or fallback if none matches),
+// and a reader to be used in place of r.
+// Empty data is always detected as None.
+func Detect(r io.Reader, codecs []Codec, fallback Codec) (Codec, io.Reader, error) {
+	maxLen := 0
+	for _, c := range codecs {
+		if m, ok := c.(Magic); ok && len(m.Magic()) > maxLen {
+			maxLen = len(m.Magic())
+		}
+	}
+	if maxLen == 0 {
+		return fallback, r, nil
+	}
+	buf := bufio.NewReaderSize(r, maxLen)
+	head, err := buf.Peek(maxLen)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	if len(head) == 0 {
+		return None, buf, nil
+	}
+	for _, c := range codecs {
+		if m, ok := c.(Magic); ok && len(m.Magic()) > 0 && bytes.HasPrefix(head, m.Magic()) {
+			return c, buf, nil
+		}
+	}
+	return fallback, buf, nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string {
+	return "none"
+}
+
+func (noneCodec) Suffix() string {
+	return ""
+}
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type gzipCodec int
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) Suffix() string {
+	return ".gz"
+}
+
+func (gzipCodec) Magic() []byte {
+	return gzipMagic
+}
+
+func (level gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, int(level))
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCodec int
+
+func (zstdCodec) Name() string {
+	return "zstd"
+}
+
+func (zstdCodec) Suffix() string {
+	return ".zst"
+}
+
+func (zstdCodec) Magic() []byte {
+	return zstdMagic
+}
+
+func (level zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	l := zstd.SpeedDefault
+	if level != 0 {
+		l = zstd.EncoderLevelFromZstd(int(level))
+	}
+	return zstd.NewWriter(
+		w,
+		zstd.WithEncoderLevel(l),
+		// Each writer only writes a single entry,
+		// extra goroutines won't help.
+		zstd.WithEncoderConcurrency(1),
+	)
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (snappyCodec) Suffix() string {
+	return ".sz"
+}
+
+func (snappyCodec) Magic() []byte {
+	return snappyMagic
+}
+
+func (snappyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return s2.NewWriter(
+		w,
+		s2.WriterSnappyCompat(),
+		s2.WriterConcurrency(1),
+	), nil
+}
+
+func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(s2.NewReader(r)), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,159 @@
+package codec_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/fishy/fsdb/codec"
+)
+
+func compress(t *testing.T, c codec.Codec, data []byte) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	w, err := c.NewWriter(buf)
+	if err != nil {
+		t.Fatalf("%s NewWriter failed: %v", c.Name(), err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("%s Write failed: %v", c.Name(), err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("%s Close failed: %v", c.Name(), err)
+	}
+	return buf.Bytes()
+}
+
+func TestCodecs(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello, world!\n"), 1000)
+	codecs := append(codec.Builtins(), codec.Gzip(gzip.BestSpeed), codec.Zstd(19))
+	suffixes := make(map[string]string)
+	for _, c := range codecs {
+		t.Run(
+			c.Name(),
+			func(t *testing.T) {
+				if name, ok := suffixes[c.Suffix()]; ok && name != c.Name() {
+					t.Errorf("suffix %q used by both %s and %s", c.Suffix(), name, c.Name())
+				}
+				suffixes[c.Suffix()] = c.Name()
+
+				compressed := compress(t, c, data)
+				if c.Suffix() != "" && len(compressed) >= len(data) {
+					t.Errorf(
+						"compressed size %d >= uncompressed size %d",
+						len(compressed),
+						len(data),
+					)
+				}
+
+				reader, err := c.NewReader(bytes.NewReader(compressed))
+				if err != nil {
+					t.Fatalf("NewReader failed: %v", err)
+				}
+				defer reader.Close()
+				actual, err := ioutil.ReadAll(reader)
+				if err != nil {
+					t.Fatalf("read failed: %v", err)
+				}
+				if !bytes.Equal(actual, data) {
+					t.Errorf("round trip data mismatch")
+				}
+			},
+		)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	data := []byte("Hello, world!")
+	codecs := codec.Builtins()
+	fallback := codec.Zstd(0)
+
+	for _, c := range codecs {
+		t.Run(
+			c.Name(),
+			func(t *testing.T) {
+				compressed := compress(t, c, data)
+				detected, reader, err := codec.Detect(
+					bytes.NewReader(compressed),
+					codecs,
+					fallback,
+				)
+				if err != nil {
+					t.Fatalf("Detect failed: %v", err)
+				}
+				expected := c
+				if c == codec.None {
+					// None has no magic bytes.
+					expected = fallback
+				}
+				if detected.Name() != expected.Name() {
+					t.Errorf("expected %s, got %s", expected.Name(), detected.Name())
+				}
+				actual, err := ioutil.ReadAll(reader)
+				if err != nil {
+					t.Fatalf("read failed: %v", err)
+				}
+				if !bytes.Equal(actual, compressed) {
+					t.Errorf("Detect consumed data from reader")
+				}
+			},
+		)
+	}
+
+	t.Run(
+		"empty",
+		func(t *testing.T) {
+			detected, _, err := codec.Detect(bytes.NewReader(nil), codecs, fallback)
+			if err != nil {
+				t.Fatalf("Detect failed: %v", err)
+			}
+			if detected != codec.None {
+				t.Errorf("expected none, got %s", detected.Name())
+			}
+		},
+	)
+}
+
+func TestPolicy(t *testing.T) {
+	compressible := bytes.Repeat([]byte("Hello, world!\n"), 1000)
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	policy := codec.Policy{
+		SampleSize: 1024,
+		MinSavings: 0.1,
+	}
+	for _, c := range []codec.Codec{
+		codec.Gzip(gzip.DefaultCompression),
+		codec.Zstd(0),
+		codec.Snappy,
+	} {
+		t.Run(
+			c.Name(),
+			func(t *testing.T) {
+				for _, tc := range []struct {
+					label  string
+					policy codec.Policy
+					data   []byte
+					expect bool
+				}{
+					{"compressible", policy, compressible, true},
+					{"random", policy, random, false},
+					{"empty", policy, nil, false},
+					{"short", policy, compressible[:500], true},
+					{"disabled", codec.AlwaysCompress, random, true},
+				} {
+					worth, err := tc.policy.Worth(c, tc.data)
+					if err != nil {
+						t.Fatalf("%s: Worth failed: %v", tc.label, err)
+					}
+					if worth != tc.expect {
+						t.Errorf("%s: expected %v, got %v", tc.label, tc.expect, worth)
+					}
+				}
+			},
+		)
+	}
+}
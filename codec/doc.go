@@ -0,0 +1,10 @@
+// Package codec defines the compression codecs used by local and hybrid FSDB.
+//
+// Built-in codecs are None (uncompressed), Gzip, Zstd and Snappy.
+// Zstd is usually much faster than gzip at comparable compression ratios.
+//
+// Custom codecs can be added by implementing the Codec interface,
+// and registering them in the options of local or hybrid FSDB.
+// Implementing the optional Magic interface allows hybrid FSDB to auto-detect
+// them on data downloaded from the remote bucket.
+package codec
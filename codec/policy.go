@@ -0,0 +1,83 @@
+package codec
+
+import (
+	"io"
+)
+
+// DefaultSampleSize is the sample size used by DefaultAdaptivePolicy.
+const DefaultSampleSize = 64 * 1024
+
+// Policy decides whether data is worth compressing,
+// by compressing a sample at the beginning of the data.
+type Policy struct {
+	// SampleSize is the number of bytes sampled at the beginning of the data.
+	//
+	// Non-positive values disable the sampling,
+	// so that data is always compressed.
+	SampleSize int
+
+	// MinSavings is the minimal fraction of bytes compressing the sample needs
+	// to save (e.g. 0.1 means 10%),
+	// otherwise the data is stored uncompressed.
+	MinSavings float64
+}
+
+// AlwaysCompress is the policy always compressing data.
+var AlwaysCompress = Policy{}
+
+// DefaultAdaptivePolicy is the policy sampling the first 64KiB of the data,
+// and only compressing it when it saves at least 10%.
+var DefaultAdaptivePolicy = Policy{
+	SampleSize: DefaultSampleSize,
+	MinSavings: 0.1,
+}
+
+// Enabled returns true if the policy samples the data.
+func (p Policy) Enabled() bool {
+	return p.SampleSize > 0
+}
+
+// Worth compresses the sample with the codec,
+// and returns true if it saves at least MinSavings.
+//
+// Only the first SampleSize bytes of sample are used.
+// Empty sample is never worth compressing.
+// If the policy is not enabled, it always returns true.
+func (p Policy) Worth(c Codec, sample []byte) (bool, error) {
+	if !p.Enabled() {
+		return true, nil
+	}
+	if len(sample) > p.SampleSize {
+		sample = sample[:p.SampleSize]
+	}
+	if len(sample) == 0 {
+		return false, nil
+	}
+	counter := new(countingWriter)
+	w, err := c.NewWriter(counter)
+	if err != nil {
+		return false, err
+	}
+	if _, err := w.Write(sample); err != nil {
+		w.Close()
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+	savings := 1 - float64(counter.n)/float64(len(sample))
+	return savings >= p.MinSavings, nil
+}
+
+// countingWriter discards the data written and counts the bytes.
+type countingWriter struct {
+	n int64
+}
+
+// Make sure *countingWriter satisfies io.Writer interface.
+var _ io.Writer = (*countingWriter)(nil)
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,430 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ChunkSize is the size of plaintext in each chunk.
+const ChunkSize = 64 * 1024
+
+// KeySize is the size of the keys, as AES-256 is used.
+const KeySize = 32
+
+const (
+	saltSize   = 32
+	prefixSize = 7
+	nonceSize  = prefixSize + 4 + 1
+	maxIDLen   = 255
+)
+
+// Magic is the magic bytes at the beginning of encrypted data.
+var Magic = []byte("FSDBENC\x02")
+
+// ErrDecrypt is the error returned when the encrypted data is corrupted,
+// tampered, or encrypted by a different key.
+var ErrDecrypt = errors.New("fsdb/crypt: failed to decrypt")
+
+// KeyProvider provides the keys used by Encryptor.
+type KeyProvider interface {
+	// CurrentKeyID returns the ID of the key used to encrypt new data.
+	CurrentKeyID() (string, error)
+
+	// Key returns the key of the ID, which must be KeySize bytes.
+	Key(id string) ([]byte, error)
+}
+
+// UnknownKeyError is an error returned by StaticKeyProvider when the key ID is
+// unknown.
+type UnknownKeyError struct {
+	ID string
+}
+
+func (err *UnknownKeyError) Error() string {
+	return fmt.Sprintf("fsdb/crypt: unknown key id %q", err.ID)
+}
+
+// Make sure StaticKeyProvider satisfies KeyProvider interface.
+var _ KeyProvider = StaticKeyProvider{}
+
+// StaticKeyProvider is a KeyProvider with a fixed set of keys.
+type StaticKeyProvider struct {
+	// Current is the ID of the key used to encrypt new data.
+	Current string
+
+	// Keys are the keys by their IDs.
+	Keys map[string][]byte
+}
+
+// CurrentKeyID returns p.Current.
+func (p StaticKeyProvider) CurrentKeyID() (string, error) {
+	return p.Current, nil
+}
+
+// Key returns the key of the ID from p.Keys.
+func (p StaticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.Keys[id]
+	if !ok {
+		return nil, &UnknownKeyError{ID: id}
+	}
+	return key, nil
+}
+
+// Encryptor encrypts and decrypts data with the keys from a KeyProvider.
+type Encryptor struct {
+	keys KeyProvider
+}
+
+// NewEncryptor creates an Encryptor.
+func NewEncryptor(keys KeyProvider) *Encryptor {
+	return &Encryptor{
+		keys: keys,
+	}
+}
+
+// CurrentKeyID returns the ID of the key used to encrypt new data.
+func (e *Encryptor) CurrentKeyID() (string, error) {
+	return e.keys.CurrentKeyID()
+}
+
+// CheckKey returns the error if the key of the ID can't be used,
+// e.g. it's unknown to the KeyProvider or of the wrong size.
+func (e *Encryptor) CheckKey(id string) error {
+	_, err := e.key(id)
+	return err
+}
+
+// key returns the key of the ID from the KeyProvider.
+func (e *Encryptor) key(id string) ([]byte, error) {
+	key, err := e.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf(
+			"fsdb/crypt: key %q should be %d bytes, got %d",
+			id,
+			KeySize,
+			len(key),
+		)
+	}
+	return key, nil
+}
+
+// newAEAD creates the AES-256-GCM AEAD of the stream,
+// with the subkey derived from the key of the ID and the salt.
+//
+// The subkey is derived by HKDF-SHA256,
+// with the header before the salt (magic and key ID) as the info.
+func (e *Encryptor) newAEAD(id string, salt, info []byte) (cipher.AEAD, error) {
+	key, err := e.key(id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(deriveKey(key, salt, info))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey derives a KeySize subkey from key by HKDF-SHA256.
+func deriveKey(key, salt, info []byte) []byte {
+	// Extract.
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(key)
+	prk := mac.Sum(nil)
+	// Expand, KeySize is the same as the size of SHA-256,
+	// so only the first block is needed.
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)
+}
+
+// Writer is an io.WriteCloser encrypting data.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	id     string
+	header []byte
+	prefix []byte
+
+	buf     []byte
+	counter uint32
+	err     error
+	closed  bool
+}
+
+// NewWriter returns a writer encrypting data into w with the current key.
+//
+// The header is written into w immediately.
+// Closing the returned writer writes the last chunk,
+// but does not close w.
+func (e *Encryptor) NewWriter(w io.Writer) (*Writer, error) {
+	id, err := e.keys.CurrentKeyID()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > maxIDLen {
+		return nil, fmt.Errorf("fsdb/crypt: key id %q too long", id)
+	}
+	random := make([]byte, saltSize+prefixSize)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, len(Magic)+1+len(id)+len(random))
+	header = append(header, Magic...)
+	header = append(header, byte(len(id)))
+	header = append(header, id...)
+	info := header
+	header = append(header, random...)
+	aead, err := e.newAEAD(id, random[:saltSize], info)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:      w,
+		aead:   aead,
+		id:     id,
+		header: header,
+		prefix: random[saltSize:],
+		buf:    make([]byte, 0, ChunkSize),
+	}, nil
+}
+
+// KeyID returns the ID of the key used by the writer.
+func (w *Writer) KeyID() string {
+	return w.id
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, errors.New("fsdb/crypt: writer already closed")
+	}
+	written := 0
+	for len(p) > 0 {
+		// Only flush a full chunk when there's more data,
+		// so that the last chunk is never empty unless the data is.
+		if len(w.buf) == ChunkSize {
+			if w.err = w.flush(false); w.err != nil {
+				return written, w.err
+			}
+		}
+		n := copy(w.buf[len(w.buf):ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the last chunk.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.err = w.flush(true)
+	return w.err
+}
+
+// flush seals and writes the buffered chunk.
+func (w *Writer) flush(last bool) error {
+	if w.counter == ^uint32(0) {
+		return errors.New("fsdb/crypt: data too large")
+	}
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.counter, last), w.buf, w.header)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// chunkNonce returns the nonce of the chunk.
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], counter)
+	if last {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+type reader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+
+	sealed  []byte
+	buf     []byte
+	counter uint32
+	done    bool
+	err     error
+}
+
+// NewReader returns a reader decrypting data from r.
+//
+// The header is read from r immediately,
+// and the key is chosen by the key ID in it.
+// Closing the returned reader does not close r.
+func (e *Encryptor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	buf := bufio.NewReader(r)
+	header := make([]byte, len(Magic)+1)
+	if _, err := io.ReadFull(buf, header); err != nil {
+		return nil, ErrDecrypt
+	}
+	if !IsEncrypted(header) {
+		return nil, ErrDecrypt
+	}
+	idLen := int(header[len(Magic)])
+	rest := make([]byte, idLen+saltSize+prefixSize)
+	if _, err := io.ReadFull(buf, rest); err != nil {
+		return nil, ErrDecrypt
+	}
+	info := append(header, rest[:idLen]...)
+	header = append(info[:len(info):len(info)], rest[idLen:]...)
+	aead, err := e.newAEAD(
+		string(rest[:idLen]),
+		rest[idLen:idLen+saltSize],
+		info,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{
+		r:      buf,
+		aead:   aead,
+		header: header,
+		prefix: rest[len(rest)-prefixSize:],
+		sealed: make([]byte, ChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk.
+func (r *reader) next() error {
+	n, err := io.ReadFull(r.r, r.sealed)
+	last := false
+	switch err {
+	default:
+		return err
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	case nil:
+		if _, err := r.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+	buf, err := r.aead.Open(
+		r.sealed[:0],
+		chunkNonce(r.prefix, r.counter, last),
+		r.sealed[:n],
+		r.header,
+	)
+	if err != nil {
+		return ErrDecrypt
+	}
+	r.counter++
+	r.buf = buf
+	r.done = last
+	return nil
+}
+
+func (r *reader) Close() error {
+	return nil
+}
+
+// IsEncrypted returns true if data starts with Magic.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, Magic)
+}
+
+// KeyID returns the key ID in the header of the encrypted data.
+//
+// data only needs to contain the header.
+// ok is false if data is not encrypted or the header is incomplete.
+func KeyID(data []byte) (id string, ok bool) {
+	if !IsEncrypted(data) || len(data) <= len(Magic) {
+		return "", false
+	}
+	end := len(Magic) + 1 + int(data[len(Magic)])
+	if len(data) < end {
+		return "", false
+	}
+	return string(data[len(Magic)+1 : end]), true
+}
+
+// PlaintextSize returns the size of the plaintext,
+// from the size of the data encrypted by the key ID.
+func PlaintextSize(size int64, id string) int64 {
+	size -= int64(len(Magic) + 1 + len(id) + saltSize + prefixSize)
+	// AES-GCM tag size.
+	const overhead = 16
+	chunks := (size + ChunkSize + overhead - 1) / (ChunkSize + overhead)
+	if chunks < 1 {
+		chunks = 1
+	}
+	return size - chunks*overhead
+}
+
+// Encrypt encrypts plaintext with the current key.
+func (e *Encryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := e.NewWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decrypt decrypts data encrypted by Encrypt or a Writer.
+func (e *Encryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	r, err := e.NewReader(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,212 @@
+package crypt_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/fishy/fsdb/crypt"
+)
+
+func newKeys() crypt.StaticKeyProvider {
+	return crypt.StaticKeyProvider{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, crypt.KeySize),
+			"k2": bytes.Repeat([]byte{2}, crypt.KeySize),
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	e := crypt.NewEncryptor(newKeys())
+	r := rand.New(rand.NewSource(1))
+	for _, size := range []int{
+		0,
+		1,
+		crypt.ChunkSize - 1,
+		crypt.ChunkSize,
+		crypt.ChunkSize + 1,
+		crypt.ChunkSize * 3,
+	} {
+		data := make([]byte, size)
+		r.Read(data)
+		encrypted, err := e.Encrypt(data)
+		if err != nil {
+			t.Fatalf("%d: Encrypt failed: %v", size, err)
+		}
+		if !crypt.IsEncrypted(encrypted) {
+			t.Errorf("%d: IsEncrypted should be true", size)
+		}
+		// A single byte could appear in any ciphertext by chance.
+		if size > 1 && bytes.Contains(encrypted, data) {
+			t.Errorf("%d: encrypted data contains plaintext", size)
+		}
+		decrypted, err := e.Decrypt(encrypted)
+		if err != nil {
+			t.Fatalf("%d: Decrypt failed: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Errorf("%d: round trip data mismatch", size)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	keys := newKeys()
+	data := []byte("Hello, world!")
+	encrypted, err := crypt.NewEncryptor(keys).Encrypt(data)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	keys.Current = "k2"
+	e := crypt.NewEncryptor(keys)
+	decrypted, err := e.Decrypt(encrypted)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, data) {
+		t.Errorf("expected %q, got %q", data, decrypted)
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := e.NewWriter(buf)
+	if err != nil {
+		t.Fatalf("NewWriter failed: %v", err)
+	}
+	if id := w.KeyID(); id != "k2" {
+		t.Errorf("KeyID expected %q, got %q", "k2", id)
+	}
+	w.Close()
+
+	delete(keys.Keys, "k1")
+	_, err = crypt.NewEncryptor(keys).Decrypt(encrypted)
+	if _, ok := err.(*crypt.UnknownKeyError); !ok {
+		t.Errorf("expected UnknownKeyError, got %v", err)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	e := crypt.NewEncryptor(newKeys())
+	data := make([]byte, crypt.ChunkSize*2+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	encrypted, err := e.Encrypt(data)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	// Magic, key ID, salt and nonce prefix.
+	headerSize := len(crypt.Magic) + 1 + len("k1") + 32 + 7
+	chunk := crypt.ChunkSize + 16
+
+	for _, c := range []struct {
+		label  string
+		tamper func([]byte) []byte
+	}{
+		{
+			label: "flip-data",
+			tamper: func(b []byte) []byte {
+				b[headerSize+10] ^= 1
+				return b
+			},
+		},
+		{
+			label: "flip-header",
+			tamper: func(b []byte) []byte {
+				b[headerSize-1] ^= 1
+				return b
+			},
+		},
+		{
+			label: "flip-salt",
+			tamper: func(b []byte) []byte {
+				b[len(crypt.Magic)+1+len("k1")] ^= 1
+				return b
+			},
+		},
+		{
+			label: "truncate-chunk",
+			tamper: func(b []byte) []byte {
+				return b[:len(b)-1]
+			},
+		},
+		{
+			label: "truncate-at-boundary",
+			tamper: func(b []byte) []byte {
+				return b[:headerSize+chunk]
+			},
+		},
+		{
+			label: "swap-chunks",
+			tamper: func(b []byte) []byte {
+				swapped := append([]byte(nil), b[:headerSize]...)
+				swapped = append(swapped, b[headerSize+chunk:headerSize+chunk*2]...)
+				swapped = append(swapped, b[headerSize:headerSize+chunk]...)
+				return append(swapped, b[headerSize+chunk*2:]...)
+			},
+		},
+		{
+			label: "extend",
+			tamper: func(b []byte) []byte {
+				return append(b, 0)
+			},
+		},
+	} {
+		t.Run(
+			c.label,
+			func(t *testing.T) {
+				tampered := c.tamper(append([]byte(nil), encrypted...))
+				r, err := e.NewReader(bytes.NewReader(tampered))
+				if err != nil {
+					if err != crypt.ErrDecrypt {
+						t.Errorf("expected ErrDecrypt, got %v", err)
+					}
+					return
+				}
+				if _, err := ioutil.ReadAll(r); err != crypt.ErrDecrypt {
+					t.Errorf("expected ErrDecrypt, got %v", err)
+				}
+			},
+		)
+	}
+
+	t.Run(
+		"wrong-key",
+		func(t *testing.T) {
+			keys := newKeys()
+			keys.Keys["k1"] = keys.Keys["k2"]
+			if _, err := crypt.NewEncryptor(keys).Decrypt(encrypted); err != crypt.ErrDecrypt {
+				t.Errorf("expected ErrDecrypt, got %v", err)
+			}
+		},
+	)
+}
+
+func TestSize(t *testing.T) {
+	e := crypt.NewEncryptor(newKeys())
+	for _, size := range []int{
+		0,
+		1,
+		crypt.ChunkSize - 1,
+		crypt.ChunkSize,
+		crypt.ChunkSize + 1,
+		crypt.ChunkSize * 3,
+	} {
+		encrypted, err := e.Encrypt(make([]byte, size))
+		if err != nil {
+			t.Fatalf("%d: Encrypt failed: %v", size, err)
+		}
+		id, ok := crypt.KeyID(encrypted)
+		if !ok || id != "k1" {
+			t.Errorf("%d: KeyID expected %q, got %q, %v", size, "k1", id, ok)
+		}
+		if actual := crypt.PlaintextSize(int64(len(encrypted)), id); actual != int64(size) {
+			t.Errorf("%d: PlaintextSize got %d", size, actual)
+		}
+	}
+
+	if _, ok := crypt.KeyID([]byte("foo")); ok {
+		t.Error("KeyID on plaintext should not be ok")
+	}
+}
@@ -0,0 +1,35 @@
+// Package crypt provides encryption at rest used by local and hybrid FSDB.
+//
+// Data is encrypted with AES-256-GCM in streaming chunks,
+// so that entries of any size can be encrypted and decrypted without being
+// buffered in memory.
+//
+// Format
+//
+// The encrypted data starts with a header:
+//     magic    // 8 bytes, "FSDBENC" followed by the format version (2)
+//     idLen    // 1 byte, length of the key ID
+//     keyID    // idLen bytes, ID of the key used
+//     salt     // 32 bytes, random salt of the subkey
+//     prefix   // 7 bytes, random nonce prefix
+// followed by the chunks.
+// Every encrypted data uses its own subkey,
+// derived from the key of the key ID and the salt by HKDF-SHA256,
+// with the magic and key ID part of the header as the info,
+// so the nonces only need to be unique within the same data.
+// Each chunk is up to 64KiB of plaintext sealed by AES-256-GCM,
+// with the nonce made of the nonce prefix, the 4-byte big-endian chunk counter,
+// and 1 byte flagging the last chunk,
+// and the header as additional data.
+// So reordered, truncated or extended chunks,
+// as well as a tampered header,
+// all fail the decryption.
+//
+// Key Rotation
+//
+// The key ID stored in the header is used to get the key from the KeyProvider
+// on decryption,
+// so the provider must keep old keys as long as there's data encrypted by
+// them.
+// New data is always encrypted by the current key of the provider.
+package crypt
@@ -1,7 +1,7 @@
 // Package fsdb defines the interfaces of a key-value store on top of file
 // systems.
 //
-// The interface FSDB defines basic Read, Write and Delete functions.
+// The interface FSDB defines basic Read, Write, Delete and Stat functions.
 //
 // The interface Local defines extra functions for local implementations.
 package fsdb
@@ -2,15 +2,29 @@ package fsdb
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/fishy/errbatch"
 )
 
-// Make sure *NoSuchKeyError satisfies error interface.
-var _ error = (*NoSuchKeyError)(nil)
+// Make sure error types satisfy error interface.
+var (
+	_ error = (*NoSuchKeyError)(nil)
+	_ error = (*PreconditionFailedError)(nil)
+	_ error = (*BatchError)(nil)
+	_ error = (*ChecksumMismatchError)(nil)
+)
 
 // NoSuchKeyError is an error returned by Read and Delete functions when the key
 // requested does not exists.
 type NoSuchKeyError struct {
 	Key Key
+
+	// Expired is the time the entry expired,
+	// if the key still exists but already expired.
+	//
+	// It's zero if the key does not exist at all.
+	Expired time.Time
 }
 
 func (err *NoSuchKeyError) Error() string {
@@ -22,3 +36,86 @@ func IsNoSuchKeyError(err error) bool {
 	_, ok := err.(*NoSuchKeyError)
 	return ok
 }
+
+// PreconditionFailedError is an error returned by WriteIf function when the
+// precondition is not met.
+type PreconditionFailedError struct {
+	Key          Key
+	Precondition Precondition
+}
+
+func (err *PreconditionFailedError) Error() string {
+	return fmt.Sprintf(
+		"fsdb: precondition %v failed for key %q",
+		err.Precondition,
+		err.Key,
+	)
+}
+
+// IsPreconditionFailedError checks whether a given error is
+// PreconditionFailedError.
+func IsPreconditionFailedError(err error) bool {
+	_, ok := err.(*PreconditionFailedError)
+	return ok
+}
+
+// BatchError is an error returned by batch operations (ReadMany, WriteMany and
+// DeleteMany) when some of the keys failed.
+//
+// Errors has the same length and order as Keys,
+// with nil errors for the keys succeeded.
+type BatchError struct {
+	Keys   []Key
+	Errors []error
+}
+
+func (err *BatchError) Error() string {
+	var batch errbatch.ErrBatch
+	for i, e := range err.Errors {
+		if e != nil {
+			batch.Add(fmt.Errorf("%q: %v", err.Keys[i], e))
+		}
+	}
+	return fmt.Sprintf(
+		"fsdb: %d of %d keys failed in batch: %v",
+		len(batch.GetErrors()),
+		len(err.Keys),
+		batch.Compile(),
+	)
+}
+
+// IsBatchError checks whether a given error is BatchError.
+func IsBatchError(err error) bool {
+	_, ok := err.(*BatchError)
+	return ok
+}
+
+// ChecksumMismatchError is an error returned by the reader returned by Read
+// functions when the data read does not match the checksum stored at write
+// time.
+//
+// It's returned by the final Read call instead of io.EOF,
+// and also by Close after that.
+type ChecksumMismatchError struct {
+	Key Key
+
+	// Expected and Actual are the checksums in "<algorithm>:<hex>" format.
+	Expected string
+	Actual   string
+}
+
+func (err *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf(
+		"fsdb: checksum mismatch for key %q: expected %s, got %s",
+		err.Key,
+		err.Expected,
+		err.Actual,
+	)
+}
+
+// IsChecksumMismatchError checks whether a given error is
+// ChecksumMismatchError.
+func IsChecksumMismatchError(err error) bool {
+	_, ok := err.(*ChecksumMismatchError)
+	return ok
+}
@@ -18,6 +18,43 @@ func TestError(t *testing.T) {
 	}
 }
 
+func TestPreconditionFailedError(t *testing.T) {
+	err := &fsdb.PreconditionFailedError{
+		Key:          fsdb.Key("foobar"),
+		Precondition: fsdb.IfMatch("etag"),
+	}
+	expect := "fsdb: precondition if-match(\"etag\") failed for key \"foobar\""
+	actual := err.Error()
+	if expect != actual {
+		t.Errorf("(%q).Error() expected %q, got %q", err, expect, actual)
+	}
+	if !fsdb.IsPreconditionFailedError(err) {
+		t.Errorf("%q should be an instance of PreconditionFailedError", err)
+	}
+	if fsdb.IsPreconditionFailedError(errors.New("foobar")) {
+		t.Errorf("errors.New should not be an instance of PreconditionFailedError")
+	}
+}
+
+func TestChecksumMismatchError(t *testing.T) {
+	err := &fsdb.ChecksumMismatchError{
+		Key:      fsdb.Key("foobar"),
+		Expected: "crc32c:01234567",
+		Actual:   "crc32c:89abcdef",
+	}
+	expect := "fsdb: checksum mismatch for key \"foobar\": expected crc32c:01234567, got crc32c:89abcdef"
+	actual := err.Error()
+	if expect != actual {
+		t.Errorf("(%q).Error() expected %q, got %q", err, expect, actual)
+	}
+	if !fsdb.IsChecksumMismatchError(err) {
+		t.Errorf("%q should be an instance of ChecksumMismatchError", err)
+	}
+	if fsdb.IsChecksumMismatchError(errors.New("foobar")) {
+		t.Errorf("errors.New should not be an instance of ChecksumMismatchError")
+	}
+}
+
 func TestTypeCheck(t *testing.T) {
 	var err error
 
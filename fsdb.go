@@ -3,6 +3,7 @@ package fsdb
 import (
 	"context"
 	"io"
+	"time"
 )
 
 // FSDB defines the interface for an FSDB implementation.
@@ -16,6 +17,33 @@ type FSDB interface {
 	// It's the caller's responsibility to close the ReadCloser returned.
 	Read(ctx context.Context, key Key) (reader io.ReadCloser, err error)
 
+	// ReadWithMetadata works like Read,
+	// but also returns the user-defined metadata of the entry.
+	//
+	// metadata is nil if the entry has no metadata.
+	ReadWithMetadata(ctx context.Context, key Key) (
+		reader io.ReadCloser,
+		metadata map[string]string,
+		err error,
+	)
+
+	// ReadRange opens an entry and returns a ReadCloser that reads length bytes
+	// starting at offset.
+	//
+	// If length is negative, it reads till the end of the entry.
+	// If the entry is shorter than offset+length,
+	// the ReadCloser returned will reach EOF earlier.
+	//
+	// If the key does not exist, it should return a NoSuchKeyError.
+	//
+	// It's the caller's responsibility to close the ReadCloser returned.
+	ReadRange(
+		ctx context.Context,
+		key Key,
+		offset int64,
+		length int64,
+	) (reader io.ReadCloser, err error)
+
 	// Write opens an entry.
 	//
 	// If the key already exists, it will be overwritten.
@@ -24,16 +52,98 @@ type FSDB interface {
 	// it's the caller's responsibility to close it after Write function returns.
 	Write(ctx context.Context, key Key, data io.Reader) error
 
+	// WriteWithOptions works like Write, with extra options.
+	//
+	// See WriteOptions for more details.
+	WriteWithOptions(
+		ctx context.Context,
+		key Key,
+		data io.Reader,
+		opts WriteOptions,
+	) error
+
+	// WriteIf works like Write,
+	// but only commits the write if the precondition is met.
+	//
+	// If the precondition is not met, it should return a PreconditionFailedError.
+	//
+	// The check and the commit are atomic against other write and delete
+	// operations on the same FSDB.
+	WriteIf(
+		ctx context.Context,
+		key Key,
+		data io.Reader,
+		precondition Precondition,
+	) error
+
+	// Create opens an entry for writing in a streaming way.
+	//
+	// The data written into the WriteCloser returned is only committed into the
+	// entry when its Close function returns nil error.
+	// If the key already exists, it will be overwritten at that time.
+	//
+	// It's the caller's responsibility to call either Close or Abort on the
+	// WriteCloser returned.
+	Create(ctx context.Context, key Key) (WriteCloser, error)
+
 	// Delete deletes an entry.
 	//
 	// If the key does not exist, it should return a NoSuchKeyError.
 	Delete(ctx context.Context, key Key) error
+
+	// ReadMany reads multiple entries concurrently.
+	//
+	// readers has the same length and order as keys,
+	// with nil readers for the keys failed.
+	// If any of the keys failed, err is a *BatchError.
+	//
+	// It's the caller's responsibility to close all the non-nil readers
+	// returned, even if err is non-nil.
+	ReadMany(ctx context.Context, keys []Key) (readers []io.ReadCloser, err error)
+
+	// WriteMany writes multiple entries concurrently.
+	//
+	// If any of the entries failed, it returns a *BatchError.
+	WriteMany(ctx context.Context, entries []Entry) error
+
+	// DeleteMany deletes multiple entries concurrently.
+	//
+	// If any of the keys failed, it returns a *BatchError.
+	// Keys not exist are also considered failed, with NoSuchKeyError.
+	DeleteMany(ctx context.Context, keys []Key) error
+
+	// Stat returns the metadata of an entry without reading its data.
+	//
+	// If the key does not exist, it should return a NoSuchKeyError.
+	Stat(ctx context.Context, key Key) (*EntryInfo, error)
+}
+
+// WriteCloser is the writer returned by Create function in FSDB interface.
+type WriteCloser interface {
+	io.WriteCloser
+
+	// Abort discards the data written and leaves the entry untouched.
+	//
+	// It's a no-op if Close or Abort was already called.
+	Abort() error
 }
 
 // Local defines extra interface for a local FSDB implementation.
 type Local interface {
 	FSDB
 
+	// CreateWithOptions works like Create,
+	// with the extra options of WriteWithOptions.
+	//
+	// If precondition is non-nil,
+	// the data is only committed when the precondition is met, like WriteIf.
+	CreateWithOptions(
+		ctx context.Context,
+		key Key,
+		opts WriteOptions,
+		precondition *Precondition,
+	) (WriteCloser, error)
+
 	// ScanKeys scans all the keys locally.
 	//
 	// This function would be heavy on IO and takes a long time. Use with caution.
@@ -41,6 +151,104 @@ type Local interface {
 	// The behavior is undefined for keys changed after the scan started,
 	// but it should never visit the same key twice in a single scan.
 	ScanKeys(ctx context.Context, keyFunc KeyFunc, errFunc ErrFunc) error
+
+	// ResumeScanKeys works like ScanKeys,
+	// but it only scans the keys after the given cursor,
+	// and reports the cursor of every key scanned to keyFunc.
+	//
+	// Empty cursor means scanning from the beginning.
+	//
+	// Cursors are opaque strings that are only valid for the same
+	// implementation with the same options.
+	// A scan interrupted by canceled context or process restart can be resumed
+	// by calling ResumeScanKeys with the last cursor reported.
+	ResumeScanKeys(
+		ctx context.Context,
+		cursor string,
+		keyFunc CursorKeyFunc,
+		errFunc ErrFunc,
+	) error
+
+	// ScanKeysParallel works like ScanKeys,
+	// but splits the scan and uses the given number of workers to scan them
+	// concurrently.
+	//
+	// keyFunc and errFunc could be called concurrently from different
+	// goroutines.
+	//
+	// It should never visit the same key twice in a single scan.
+	ScanKeysParallel(
+		ctx context.Context,
+		workers int,
+		keyFunc KeyFunc,
+		errFunc ErrFunc,
+	) error
+
+	// ListKeys lists the keys locally in lexicographic order.
+	//
+	// It returns at most opts.Limit keys.
+	// If there are more keys,
+	// next is the value to be used as opts.StartAfter to get the next page.
+	// Otherwise next is nil.
+	ListKeys(ctx context.Context, opts ListOptions) (keys []Key, next Key, err error)
+
+	// DeleteExpired deletes all the expired entries locally.
+	//
+	// If beforeDelete is non-nil,
+	// it's called for every expired key right before deleting it.
+	// If it returns an error, the key will not be deleted.
+	// All the errors are combined and returned after the scan.
+	//
+	// Like ScanKeys,
+	// this function would be heavy on IO and takes a long time.
+	DeleteExpired(ctx context.Context, beforeDelete func(key Key) error) error
+}
+
+// WriteOptions defines the options used in WriteWithOptions function in FSDB
+// interface.
+type WriteOptions struct {
+	// TTL is the time to live of the entry.
+	//
+	// After the entry expired,
+	// Read, ReadRange and Stat return NoSuchKeyError on it,
+	// until it's actually deleted by Delete, DeleteExpired or overwritten.
+	//
+	// Non-positive values mean the entry never expires.
+	TTL time.Duration
+
+	// Metadata is the user-defined metadata stored alongside the entry
+	// (e.g. content type, schema version, etc.).
+	//
+	// It's returned by Stat and ReadWithMetadata.
+	Metadata map[string]string
+}
+
+// Expires returns the expiration time of an entry written now using the
+// options.
+//
+// It returns zero time if the entry never expires.
+func (opts WriteOptions) Expires() time.Time {
+	if opts.TTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(opts.TTL)
+}
+
+// ListOptions defines the options used in ListKeys function in Local
+// interface.
+type ListOptions struct {
+	// Prefix limits the keys listed to the ones starting with it.
+	Prefix Key
+
+	// StartAfter limits the keys listed to the ones after it (exclusive).
+	//
+	// Nil means from the beginning.
+	StartAfter Key
+
+	// Limit is the maximal number of keys to return.
+	//
+	// Non-positive values mean no limit.
+	Limit int
 }
 
 // KeyFunc is used in ScanKeys function in Local interface.
@@ -52,6 +260,13 @@ type Local interface {
 // It's OK for KeyFunc to block.
 type KeyFunc func(key Key) bool
 
+// CursorKeyFunc is used in ResumeScanKeys function in Local interface.
+//
+// It's the same as KeyFunc,
+// with an extra cursor that can be passed into ResumeScanKeys to resume the
+// scan after this key.
+type CursorKeyFunc func(key Key, cursor string) bool
+
 // ErrFunc is used in ScanKeys function in Local interface.
 //
 // It's the callback function called when the scan encounters an I/O error that
@@ -1,7 +1,10 @@
 module github.com/fishy/fsdb
 
+go 1.22
+
 require (
 	github.com/fishy/errbatch v0.1.0
 	github.com/fishy/rowlock v0.2.0
 	github.com/fishy/wrapreader v0.1.0
+	github.com/klauspost/compress v1.18.0
 )
@@ -0,0 +1,384 @@
+package hybrid
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/fishy/fsdb"
+)
+
+// localCache tracks the local entries in cache mode.
+//
+// Clean entries are the ones uploaded to or downloaded from remote bucket,
+// which can be evicted.
+// Dirty entries are the ones written but not uploaded yet,
+// which are only counted towards the budget.
+// Every time an entry becomes dirty its generation is increased,
+// so an entry changed after it's picked for eviction,
+// including changes only to its metadata or expiration time,
+// is never mistaken as clean.
+//
+// The entries left from before Open are loaded in the background by the evict
+// loop,
+// as clean if the remote entries have the same ETags uploaded with them.
+// Accesses are only tracked since Open.
+type localCache struct {
+	policy     CachePolicy
+	maxBytes   int64
+	maxEntries int
+
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+	clean   cacheHeap
+	bytes   int64
+
+	// wake is signaled when the cache might be over budget.
+	wake chan struct{}
+}
+
+type cacheEntry struct {
+	key   fsdb.Key
+	size  int64
+	clean bool
+	// gen is increased every time the entry becomes dirty.
+	gen    uint64
+	access time.Time
+	hits   int64
+	// index is the index of the entry in the heap of clean entries,
+	// -1 for dirty entries.
+	index int
+}
+
+func newLocalCache(opts Options) *localCache {
+	c := &localCache{
+		policy:     opts.GetCachePolicy(),
+		maxBytes:   opts.GetCacheMaxBytes(),
+		maxEntries: opts.GetCacheMaxEntries(),
+		entries:    make(map[string]*cacheEntry),
+		wake:       make(chan struct{}, 1),
+	}
+	c.clean.policy = c.policy
+	return c
+}
+
+// enabled returns true if cache mode is on.
+func (c *localCache) enabled() bool {
+	return c.policy != CacheOff
+}
+
+// set tracks the entry of the key with the size, as clean or dirty.
+func (c *localCache) set(key fsdb.Key, size int64, clean bool) {
+	if size < 0 {
+		size = 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[string(key)]
+	if !ok {
+		entry = &cacheEntry{
+			key:    key,
+			access: time.Now(),
+			index:  -1,
+		}
+		c.entries[string(key)] = entry
+	}
+	c.bytes += size - entry.size
+	entry.size = size
+	entry.clean = clean
+	if !clean {
+		entry.gen++
+	}
+	switch {
+	case !clean && entry.index >= 0:
+		heap.Remove(&c.clean, entry.index)
+	case clean && entry.index < 0:
+		heap.Push(&c.clean, entry)
+	}
+
+	select {
+	default:
+	case c.wake <- struct{}{}:
+	}
+}
+
+// tracked returns true if the entry of the key is tracked.
+func (c *localCache) tracked(key fsdb.Key) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.entries[string(key)]
+	return ok
+}
+
+// touch records an access to the entry of the key.
+func (c *localCache) touch(key fsdb.Key) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[string(key)]
+	if !ok {
+		return
+	}
+	entry.access = time.Now()
+	entry.hits++
+	if entry.index >= 0 {
+		heap.Fix(&c.clean, entry.index)
+	}
+}
+
+// remove stops tracking the entry of the key.
+func (c *localCache) remove(key fsdb.Key) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[string(key)]
+	if !ok {
+		return
+	}
+	if entry.index >= 0 {
+		heap.Remove(&c.clean, entry.index)
+	}
+	c.bytes -= entry.size
+	delete(c.entries, string(key))
+}
+
+// isClean returns true if the entry of the key is clean.
+func (c *localCache) isClean(key fsdb.Key) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[string(key)]
+	return ok && entry.clean
+}
+
+// victim returns the clean entry to evict next and its generation,
+// if it's over budget.
+func (c *localCache) victim() (key fsdb.Key, gen uint64, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	over := (c.maxBytes > 0 && c.bytes > c.maxBytes) ||
+		(c.maxEntries > 0 && len(c.entries) > c.maxEntries)
+	if !over || len(c.clean.entries) == 0 {
+		return nil, 0, false
+	}
+	entry := c.clean.entries[0]
+	return entry.key, entry.gen, true
+}
+
+// evict stops tracking the entry of the key and returns true,
+// if it's still clean and never became dirty since the generation.
+func (c *localCache) evict(key fsdb.Key, gen uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[string(key)]
+	if !ok || !entry.clean || entry.gen != gen {
+		return false
+	}
+	heap.Remove(&c.clean, entry.index)
+	c.bytes -= entry.size
+	delete(c.entries, string(key))
+	return true
+}
+
+// cacheHeap is the heap of clean entries,
+// with the next one to evict per policy at the top.
+type cacheHeap struct {
+	policy  CachePolicy
+	entries []*cacheEntry
+}
+
+// Make sure *cacheHeap satisfies heap.Interface interface.
+var _ heap.Interface = (*cacheHeap)(nil)
+
+func (h *cacheHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h *cacheHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	if h.policy == CacheLFU && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.access.Before(b.access)
+}
+
+func (h *cacheHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *cacheHeap) Push(x interface{}) {
+	entry := x.(*cacheEntry)
+	entry.index = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+
+func (h *cacheHeap) Pop() interface{} {
+	n := len(h.entries) - 1
+	entry := h.entries[n]
+	h.entries[n] = nil
+	h.entries = h.entries[:n]
+	entry.index = -1
+	return entry
+}
+
+// markDirty tracks the local entry of the key as dirty in cache mode.
+func (db *impl) markDirty(ctx context.Context, key fsdb.Key) {
+	db.markCache(ctx, key, false)
+}
+
+// markClean tracks the local entry of the key as clean in cache mode.
+//
+// The caller must make sure that the local entry is the same as the remote
+// one, e.g. by holding the row lock.
+func (db *impl) markClean(ctx context.Context, key fsdb.Key) {
+	db.markCache(ctx, key, true)
+}
+
+func (db *impl) markCache(ctx context.Context, key fsdb.Key, clean bool) {
+	if !db.cache.enabled() {
+		return
+	}
+	info, err := db.local.Stat(ctx, key)
+	if err != nil {
+		if fsdb.IsNoSuchKeyError(err) {
+			db.cache.remove(key)
+		}
+		return
+	}
+	// Entries kept until they expire are never evicted.
+	db.cache.set(key, info.Size, clean && !db.keepUntilExpired(info.Expires))
+}
+
+// downloaded handles the local entry of the key saved from remote bucket.
+//
+// In cache mode it's tracked as clean.
+// Otherwise it's queued to be uploaded again,
+// so that the local copy is deleted after that.
+func (db *impl) downloaded(ctx context.Context, key fsdb.Key) {
+	if db.cache.enabled() {
+		db.markClean(ctx, key)
+		return
+	}
+	db.enqueue(key)
+}
+
+// isCached returns true if the local entry of the key is clean in cache mode,
+// so it doesn't need to be uploaded again.
+func (db *impl) isCached(key fsdb.Key) bool {
+	return db.cache.enabled() && db.cache.isClean(key)
+}
+
+// loadCache tracks the local entries left from before Open in cache mode,
+// unless they are already tracked since.
+func (db *impl) loadCache(ctx context.Context) {
+	logger := db.opts.GetLogger()
+	started := time.Now()
+	loaded := 0
+	err := db.local.ScanKeys(
+		ctx,
+		func(key fsdb.Key) bool {
+			select {
+			default:
+			case <-ctx.Done():
+				return false
+			case <-db.stop:
+				return false
+			}
+			if !db.cache.tracked(key) {
+				db.checkUploaded(ctx, key)
+				loaded++
+			}
+			return true
+		},
+		fsdb.IgnoreAll,
+	)
+	if logger != nil {
+		if err != nil {
+			logger.Printf("failed to load cached entries: %v", err)
+		}
+		logger.Printf(
+			"loaded %d cached entries, took %v",
+			loaded,
+			time.Now().Sub(started),
+		)
+	}
+}
+
+// startEvictLoop loads the local entries left from before Open,
+// then evicts clean entries whenever the local FSDB is over the cache budget,
+// until ctx is canceled or db is closed.
+func (db *impl) startEvictLoop(ctx context.Context) {
+	logger := db.opts.GetLogger()
+	db.loadCache(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-db.stop:
+			return
+		case <-db.cache.wake:
+		}
+
+		evicted := 0
+		for {
+			select {
+			default:
+			case <-ctx.Done():
+				return
+			case <-db.stop:
+				return
+			}
+
+			key, gen, ok := db.cache.victim()
+			if !ok {
+				break
+			}
+			deleted, err := db.evictKey(ctx, key, gen)
+			if err != nil {
+				// The entry is no longer tracked,
+				// it will be tracked again by the next scan loop.
+				if logger != nil {
+					logger.Printf("failed to evict %v: %v", key, err)
+				}
+			}
+			if deleted {
+				evicted++
+			}
+		}
+		if logger != nil && evicted > 0 {
+			logger.Printf("evicted %d cached entries", evicted)
+		}
+	}
+}
+
+// evictKey deletes the local entry of the key if it never became dirty since
+// the generation, and returns true if it's deleted.
+//
+// The entry is no longer tracked if it's deleted or failed to be deleted.
+func (db *impl) evictKey(
+	ctx context.Context,
+	key fsdb.Key,
+	gen uint64,
+) (bool, error) {
+	if db.opts.GetUseLock() {
+		db.locks.Lock(string(key))
+		defer db.locks.Unlock(string(key))
+	}
+	if !db.cache.evict(key, gen) {
+		// Changed since it's picked.
+		return false, nil
+	}
+	err := db.local.Delete(ctx, key)
+	if fsdb.IsNoSuchKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -6,10 +6,49 @@
 // Read operations will check local FSDB first,
 // and fetch from bucket if it does not present locally.
 // When remote read happens,
-// the data will be saved locally until the next upload loop.
+// the data will be saved locally until it's uploaded again.
 //
-// Data stored on the remote bucket will be gzipped using best compression
-// level.
+// Written keys are put into an upload queue,
+// and uploaded once they stay in the queue for the minimum upload age set in
+// options,
+// so keys written repeatedly during that time are only uploaded once.
+// The queue can be persisted into a directory to survive restarts.
+// There is also a periodic scan loop walking all the local keys,
+// as a safety net for the keys missed by the queue,
+// which can use a much longer delay to save the disk I/O on large local
+// FSDBs.
+//
+// With a cache policy set in options,
+// uploaded and downloaded entries are kept locally as clean entries,
+// and evicted by LRU or LFU when the local FSDB is over the byte or entry
+// budget.
+// Entries not uploaded yet are dirty and never evicted.
+// Accesses are only tracked in memory.
+// After a restart the existing local entries are loaded in the background,
+// as clean if the bucket implements bucket.MetadataBucket and the remote
+// entries have the same ETags uploaded with them,
+// otherwise they are uploaded again by the scan loop before they can be
+// evicted.
+//
+// Data stored on the remote bucket will be compressed using the codec set in
+// options, which defaults to gzip with best compression level.
+// When reading from the remote bucket,
+// the codec is detected from the data,
+// so changing the codec on an existing hybrid FSDB is safe.
+// Data uploaded uncompressed starts with a short header instead,
+// so it's never mistaken as compressed data.
+// With an adaptive compression policy,
+// data not worth compressing is uploaded uncompressed instead.
+// Unencrypted remote data uploaded uncompressed is read in ranges directly from
+// buckets implementing bucket.RangeBucket by ReadRange.
+//
+// With an encryptor set in options,
+// the compressed data is also encrypted before uploading.
+// Encrypted remote data is detected and decrypted on reads,
+// so remote data uploaded before the encryptor was set is still readable,
+// unless encryption is required by SetRequireEncryption.
+// The local FSDB has its own encryption options,
+// and its RotateKeys does not re-encrypt the remote data.
 //
 // Concurrency
 //
@@ -19,26 +58,44 @@
 //
 // The first case is remote read. The read process is:
 //     1. Check local FSDB.
-//     2. Read fully from remote bucket.
-//     3. Check local FSDB again to prevent using stale remote data to overwrite local data.
-//     4. If there's still no local data in Step 3, write remote data locally.
-//     5. Return local data.
-// If another write happens between Step 3 and 4,
-// then it might be overwritten by stale remote data.
+//     2. Download from remote bucket, streaming the decompressed data into a new local entry.
+//     3. Commit the new local entry only if there's still no local data, to prevent using stale remote data to overwrite local data.
+//     4. Return local data.
+// If another delete happens during Step 2,
+// then the deleted data might be brought back by stale remote data.
+// As the remote data is never fully read into memory,
+// large entries can be read without the memory cost of their sizes.
 //
 // The other case is during upload. The upload process for each key is:
-//     1. Read local data, calculate crc32c.
-//     2. Gzip local data, upload to remote bucket.
-//     3. Calculate local data crc32c again.
-//     4. If the crc32c from Step 1 and Step 3 matches, delete local data.
-// If another write happens between Step 3 and 4,
-// then it might be deleted on Step 4 so we only have stale data in the system.
+//     1. Stream local data through crc32c calculation and compression into remote bucket.
+//     2. Calculate local data crc32c again, also streaming.
+//     3. If the crc32c from Step 1 and Step 2 matches, delete local data.
+// If another write happens between Step 2 and 3,
+// then it might be deleted on Step 3 so we only have stale data in the system.
+// In cache mode, Step 3 marks the local data clean instead of deleting it,
+// so the same race could let the newer write be evicted later.
+// As the data is streamed,
+// the memory used by each upload thread is bounded regardless of entry sizes.
 //
 // Turning on the optional row lock will make sure the discussed data loss
 // scenarios won't happen, but it also degrade the performance slightly.
 // The lock is only used partially inside the operations
-// (whole local write operation, remote read from Step 3, upload from Step 3).
+// (local write operation when committing the data,
+// remote read from Step 3 till the local data is opened, upload from Step 2,
+// and eviction in cache mode).
 //
 // There are no other locks used in the code,
-// except a few atomic numbers in upload loop for logging purpose.
+// except a few atomic numbers in upload loop for logging purpose,
+// a mutex collecting the upload errors for Flush,
+// and the mutexes guarding the upload queue and the cache tracking.
+//
+// Shutdown
+//
+// Close stops the upload loop after the upload threads finish the keys they
+// are currently uploading,
+// while canceling the context passed into Open abandons them halfway.
+// To drain all the local data to the remote bucket before decommissioning a
+// node, call Flush then Close.
+// A *NotUploadedError from Flush lists the keys still only stored locally,
+// other than the ones skipped by the skip function.
 package hybrid
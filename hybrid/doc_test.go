@@ -26,7 +26,8 @@ func Example() {
 		bucket,
 		hybrid.NewDefaultOptions(),
 	)
-	defer cancel() // Stop the upload loop, not really necessary
+	defer cancel()
+	defer db.Close(ctx) // Stop the upload loop gracefully
 
 	key := fsdb.Key("key")
 
@@ -1,52 +1,229 @@
 package hybrid
 
 import (
+	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/fishy/errbatch"
 	"github.com/fishy/rowlock"
+	"github.com/fishy/wrapreader"
 
 	"github.com/fishy/fsdb"
 	"github.com/fishy/fsdb/bucket"
+	"github.com/fishy/fsdb/codec"
+	"github.com/fishy/fsdb/crypt"
 )
 
-const tempFilename = "data"
+var errNoEncryptor = errors.New("fsdb/hybrid: encrypted remote data but no encryptor set")
+
+var errNotEncrypted = errors.New("fsdb/hybrid: unencrypted remote data but encryption is required")
+
+var errClosed = errors.New("fsdb/hybrid: closed")
+
+// ErrNoMetadataBucket is the error returned by WriteWithOptions on entries with
+// TTL or metadata, when the bucket does not implement bucket.MetadataBucket.
+var ErrNoMetadataBucket = errors.New(
+	"fsdb/hybrid: bucket does not implement bucket.MetadataBucket",
+)
+
+// ErrNoReaper is the error returned by WriteWithOptions on entries with TTL,
+// when the reaper is disabled in options.
+var ErrNoReaper = errors.New("fsdb/hybrid: reaper disabled")
+
+// Make sure *NotUploadedError satisfies error interface.
+var _ error = (*NotUploadedError)(nil)
+
+// NotUploadedError is the error returned by Flush when some of the local
+// entries were not uploaded,
+// either because the uploads failed or because they cannot be uploaded.
+//
+// Errors has the same length and order as Keys.
+// Entries skipped by the skip function are not included.
+type NotUploadedError struct {
+	Keys   []fsdb.Key
+	Errors []error
+}
+
+func (err *NotUploadedError) Error() string {
+	var batch errbatch.ErrBatch
+	for i, e := range err.Errors {
+		batch.Add(fmt.Errorf("%q: %v", err.Keys[i], e))
+	}
+	return fmt.Sprintf(
+		"fsdb/hybrid: %d keys not uploaded: %v",
+		len(err.Keys),
+		batch.Compile(),
+	)
+}
+
+// IsNotUploadedError checks whether a given error is NotUploadedError.
+func IsNotUploadedError(err error) bool {
+	_, ok := err.(*NotUploadedError)
+	return ok
+}
+
+// ReservedMetadataPrefix is the prefix of the metadata keys reserved by the
+// hybrid FSDB on remote entries.
+//
+// WriteWithOptions rejects user-defined metadata with keys starting with it.
+const ReservedMetadataPrefix = "fsdb-"
+
+// Reserved metadata keys.
+const (
+	// metadataETag is the ETag of the local entry uploaded.
+	metadataETag = ReservedMetadataPrefix + "etag"
+	// metadataExpires is the expiration time of the entry in RFC 3339 format.
+	metadataExpires = ReservedMetadataPrefix + "expires"
+)
 
 var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 
+// rawMagic is the header of the remote data uploaded uncompressed,
+// so that it's never mistaken as compressed data by the magic bytes of the
+// codecs.
+//
+// Unencrypted remote data with it can be read in ranges directly from a
+// bucket.RangeBucket.
+var rawMagic = []byte("FSDBRAW\x01")
+
+// DB is the hybrid FSDB,
+// with features only available to the hybrid implementation.
+type DB interface {
+	fsdb.FSDB
+
+	// Flush runs an upload pass over all the local entries now,
+	// and waits for all the uploads of the pass to finish.
+	//
+	// It returns the combined errors of the scan and a *NotUploadedError
+	// listing the keys not uploaded by the pass,
+	// which are the failed uploads and the entries that cannot be uploaded
+	// (entries with metadata when the bucket does not implement
+	// bucket.MetadataBucket).
+	// Entries skipped by the skip function,
+	// and expired entries waiting for the reaper, are not errors.
+	// If ctx is canceled before the pass finishes,
+	// it returns ctx.Err() while the pass keeps running in the background.
+	//
+	// It returns an error if the DB is already closed.
+	Flush(ctx context.Context) error
+
+	// Close stops the background upload and reaper loops.
+	//
+	// The ongoing upload scan stops sending new keys,
+	// and the upload workers finish the keys they are currently uploading.
+	// Close waits for all of them to exit.
+	// If ctx is canceled before that,
+	// it returns ctx.Err() while they keep finishing in the background.
+	//
+	// Reads and writes are still available after Close,
+	// but local entries will no longer be uploaded.
+	// It's safe to call Close multiple times.
+	Close(ctx context.Context) error
+
+	// QueueDepth returns the number of written keys waiting in the upload
+	// queue.
+	QueueDepth() int
+}
+
+// Make sure *impl satisfies DB interface.
+var _ DB = (*impl)(nil)
+
 type impl struct {
 	local  fsdb.Local
 	bucket bucket.Bucket
 	opts   Options
 	locks  *rowlock.RowLock
+	queue  *uploadQueue
+	cache  *localCache
+	// warned records the keys already warned by keepLocal.
+	warned sync.Map
+
+	// passes receives the upload passes requested by Flush.
+	passes chan *uploadPass
+	// stop is closed by Close to stop the background loops.
+	stop     chan struct{}
+	stopOnce sync.Once
+	// done is closed after all the background loops and upload workers exit.
+	done chan struct{}
 }
 
 // Open creates a hybrid FSDB,
 // which is backed by a local FSDB and a remote bucket.
 //
-// There's no need to close,
-// but you could cancel the context to stop the upload loop.
+// Call Close to stop the background loops gracefully,
+// which lets the upload workers finish the keys they are currently uploading.
+// Canceling ctx also stops them,
+// but abandons the ongoing uploads.
+// Before decommissioning the local storage,
+// call Flush to upload all the local entries first.
 //
 // Read reads from local first,
 // then read from remote bucket if it does not exist locally.
 // In that case,
-// the data will be saved locally for cache until the next upload loop.
+// the data will be saved locally for cache until it's uploaded again by the
+// upload queue,
+// or until it's evicted in cache mode.
+//
+// ReadRange reads from local first,
+// then streams from remote bucket if it does not exist locally.
+// Unlike Read, data read from remote bucket by ReadRange is not saved locally.
 //
-// Write writes locally.
-// There is a background scan loop to upload everything from local to remote,
-// then deletes the local copy after the upload succeed.
+// Write and Create write locally.
+// WriteIf also saves remote only entries locally before checking the
+// precondition.
+// Remote entries have the ETags of the local entries they were uploaded from in
+// Stat results if the bucket implements bucket.MetadataBucket.
+// Otherwise you need to Read them before using them with IfMatch.
+// Written keys are queued into an upload queue,
+// and uploaded after the minimum upload age set in options,
+// then the local copies are deleted after the uploads succeed,
+// unless cache mode is enabled in options.
+// There is also a background scan loop to upload everything from local to
+// remote, as a safety net for the keys missed by the upload queue.
+//
+// WriteWithOptions writes locally.
+// Entries with TTL require the bucket to implement bucket.MetadataBucket,
+// otherwise WriteWithOptions returns ErrNoMetadataBucket.
+// They also require the reaper enabled via options (on by default),
+// otherwise WriteWithOptions returns ErrNoReaper.
+// They are uploaded with their expiration time,
+// and kept locally until they expire.
+// When they expire, Read, ReadRange and Stat return NoSuchKeyError without
+// checking the remote bucket,
+// and the same goes for remote copies read after they expire.
+// The background reaper loop deletes expired entries locally,
+// and deletes the remote copies of the same keys before that.
+// Remote entries with TTL read after the reaper is disabled are deleted
+// locally after uploaded again like other entries,
+// and their remote copies are never deleted after they expire,
+// but they are still not visible.
+// The local FSDB should not be reaped by others,
+// otherwise the expired remote copies are no longer deleted.
+// Entries with user-defined metadata also require the bucket to implement
+// bucket.MetadataBucket,
+// and the metadata are uploaded with the entries.
+// Entries with metadata left locally from before that are never uploaded,
+// with a warning logged once per key.
 //
 // Delete deletes from both local and remote,
 // and returns combined errors, if any.
 //
+// Stat checks both local and remote.
+// If the bucket implements bucket.StatBucket,
+// it will be used to avoid downloading the remote data.
+//
 // github.com/fishy/gcsbucket and github.com/fishy/s3bucket provide
 // bucket.Bucket implementations for Google Cloud Storage and AWS S3,
 // respectively.
@@ -57,61 +234,265 @@ func Open(
 	local fsdb.Local,
 	bucket bucket.Bucket,
 	opts Options,
-) fsdb.FSDB {
+) DB {
 	db := &impl{
 		local:  local,
 		bucket: bucket,
 		opts:   opts,
 		locks:  rowlock.NewRowLock(rowlock.RWMutexNewLocker),
+		passes: make(chan *uploadPass),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		cache:  newLocalCache(opts),
+	}
+	var err error
+	db.queue, err = newUploadQueue(opts.GetUploadQueueDir(), opts.GetEncryptor())
+	if err != nil {
+		if logger := opts.GetLogger(); logger != nil {
+			logger.Printf("failed to load upload queue, not persisting it: %v", err)
+		}
+	}
+	var loops sync.WaitGroup
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		db.startScanLoop(ctx)
+	}()
+	if db.opts.GetReapInterval() > 0 {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			db.startReaperLoop(ctx)
+		}()
+	}
+	if db.cache.enabled() {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			db.startEvictLoop(ctx)
+		}()
 	}
-	go db.startScanLoop(ctx)
+	go func() {
+		loops.Wait()
+		close(db.done)
+	}()
 	return db
 }
 
 func (db *impl) Read(ctx context.Context, key fsdb.Key) (io.ReadCloser, error) {
+	reader, _, err := db.ReadWithMetadata(ctx, key)
+	return reader, err
+}
+
+func (db *impl) ReadWithMetadata(
+	ctx context.Context,
+	key fsdb.Key,
+) (io.ReadCloser, map[string]string, error) {
+	select {
+	default:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	data, metadata, err := db.local.ReadWithMetadata(ctx, key)
+	if err == nil {
+		db.cache.touch(key)
+		return data, metadata, nil
+	}
+	if !fsdb.IsNoSuchKeyError(err) || isExpired(err) {
+		return nil, nil, err
+	}
+	w, err := db.fetchKey(ctx, key)
+	if isExpired(err) {
+		return nil, nil, err
+	}
+	if err != nil && !db.bucket.IsNotExist(err) {
+		return nil, nil, err
+	}
+	// The lock only covers committing and opening the downloaded entry,
+	// so that an upload never deletes it before it's opened,
+	// while the download itself doesn't block writes to the same key.
+	if db.opts.GetUseLock() {
+		db.locks.RLock(string(key))
+		defer db.locks.RUnlock(string(key))
+	}
+	if w != nil {
+		if err := db.commitDownload(ctx, key, w); err != nil {
+			return nil, nil, err
+		}
+	}
+	data, metadata, err = db.local.ReadWithMetadata(ctx, key)
+	if err == nil {
+		db.cache.touch(key)
+	}
+	return data, metadata, err
+}
+
+func (db *impl) ReadRange(
+	ctx context.Context,
+	key fsdb.Key,
+	offset int64,
+	length int64,
+) (io.ReadCloser, error) {
 	select {
 	default:
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 
-	data, err := db.local.Read(ctx, key)
+	reader, err := db.local.ReadRange(ctx, key, offset, length)
 	if err == nil {
-		return data, nil
+		db.cache.touch(key)
+		return reader, nil
 	}
-	if !fsdb.IsNoSuchKeyError(err) {
+	if !fsdb.IsNoSuchKeyError(err) || isExpired(err) {
 		return nil, err
 	}
-	remoteData, err := db.readBucket(ctx, key)
-	if !db.bucket.IsNotExist(err) {
-		if err != nil {
-			return nil, err
-		}
 
-		select {
-		default:
-		case <-ctx.Done():
-			return nil, ctx.Err()
+	reader, ok, err := db.readRangeBucket(ctx, key, offset, length)
+	if !ok && err == nil {
+		reader, err = db.readRangeFull(ctx, key, offset, length)
+	}
+	if err != nil {
+		if db.bucket.IsNotExist(err) && !isExpired(err) {
+			return nil, &fsdb.NoSuchKeyError{Key: key}
 		}
+		return nil, err
+	}
+	return reader, nil
+}
 
-		if db.opts.GetUseLock() {
-			db.locks.RLock(string(key))
-			defer db.locks.RUnlock(string(key))
+// readRangeBucket reads the range of the key from remote bucket directly,
+// if the bucket implements bucket.RangeBucket and the remote data is stored
+// uncompressed and unencrypted.
+//
+// It returns false without error if the remote data needs to be downloaded
+// from the beginning instead.
+func (db *impl) readRangeBucket(
+	ctx context.Context,
+	key fsdb.Key,
+	offset int64,
+	length int64,
+) (io.ReadCloser, bool, error) {
+	rangeBucket, ok := db.bucket.(bucket.RangeBucket)
+	if !ok || offset < 0 || db.requireEncryption() {
+		return nil, false, nil
+	}
+	name := db.opts.GetRemoteName(key)
+	if _, ok := db.bucket.(bucket.MetadataBucket); ok {
+		// The expiration time is in the metadata,
+		// which we can only check without downloading through Stat.
+		statBucket, ok := db.bucket.(bucket.StatBucket)
+		if !ok {
+			return nil, false, nil
 		}
-		// Read from local again, so that in case a new write happened during
-		// downloading, we don't overwrite it with stale remote data.
-		data, err = db.local.Read(ctx, key)
-		if err == nil {
-			return data, nil
+		objInfo, err := statBucket.Stat(ctx, name)
+		if err != nil {
+			return nil, true, err
 		}
-		if err := db.local.Write(ctx, key, remoteData); err != nil {
-			return nil, err
+		if err := parseRemoteMeta(objInfo.Metadata).check(key); err != nil {
+			return nil, true, err
 		}
 	}
-	return db.local.Read(ctx, key)
+
+	reader, err := rangeBucket.ReadRange(ctx, name, 0, int64(len(rawMagic)))
+	if err != nil {
+		return nil, true, err
+	}
+	header := make([]byte, len(rawMagic))
+	_, err = io.ReadFull(reader, header)
+	reader.Close()
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, true, err
+	}
+	if !bytes.Equal(header, rawMagic) {
+		return nil, false, nil
+	}
+	reader, err = rangeBucket.ReadRange(
+		ctx,
+		name,
+		int64(len(rawMagic))+offset,
+		length,
+	)
+	return reader, true, err
+}
+
+// readRangeFull downloads the key from remote bucket from the beginning,
+// and returns the range after decompression.
+//
+// The remote data is read only till the end of the range.
+func (db *impl) readRangeFull(
+	ctx context.Context,
+	key fsdb.Key,
+	offset int64,
+	length int64,
+) (io.ReadCloser, error) {
+	data, _, err := db.openBucket(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := db.decompress(data)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	return fsdb.ReadRange(wrapreader.Wrap(reader, data), offset, length)
 }
 
 func (db *impl) Write(ctx context.Context, key fsdb.Key, data io.Reader) error {
+	w, err := db.Create(ctx, key)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+func (db *impl) WriteWithOptions(
+	ctx context.Context,
+	key fsdb.Key,
+	data io.Reader,
+	opts fsdb.WriteOptions,
+) error {
+	w, err := db.create(ctx, key, opts)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// checkWriteOptions checks whether the write options can be uploaded to the
+// bucket.
+func (db *impl) checkWriteOptions(opts fsdb.WriteOptions) error {
+	if _, ok := db.bucket.(bucket.MetadataBucket); !ok {
+		if opts.TTL > 0 || len(opts.Metadata) > 0 {
+			return ErrNoMetadataBucket
+		}
+	}
+	if opts.TTL > 0 && db.opts.GetReapInterval() <= 0 {
+		return ErrNoReaper
+	}
+	for k := range opts.Metadata {
+		if strings.HasPrefix(strings.ToLower(k), ReservedMetadataPrefix) {
+			return fmt.Errorf("fsdb/hybrid: reserved metadata key %q", k)
+		}
+	}
+	return nil
+}
+
+func (db *impl) WriteIf(
+	ctx context.Context,
+	key fsdb.Key,
+	data io.Reader,
+	precondition fsdb.Precondition,
+) error {
 	select {
 	default:
 	case <-ctx.Done():
@@ -122,7 +503,61 @@ func (db *impl) Write(ctx context.Context, key fsdb.Key, data io.Reader) error {
 		db.locks.Lock(string(key))
 		defer db.locks.Unlock(string(key))
 	}
-	return db.local.Write(ctx, key, data)
+
+	// Make sure remote only entries are saved locally first,
+	// so that local FSDB has the full picture to check the precondition.
+	_, err := db.local.Stat(ctx, key)
+	if isExpired(err) {
+		err = nil
+	} else if fsdb.IsNoSuchKeyError(err) {
+		err = db.downloadKey(ctx, key)
+		if db.bucket.IsNotExist(err) || isExpired(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := db.local.WriteIf(ctx, key, data, precondition); err != nil {
+		return err
+	}
+	db.markDirty(ctx, key)
+	db.enqueue(key)
+	return nil
+}
+
+func (db *impl) Create(
+	ctx context.Context,
+	key fsdb.Key,
+) (fsdb.WriteCloser, error) {
+	return db.create(ctx, key, fsdb.WriteOptions{})
+}
+
+// create creates a writer writing locally with the write options.
+func (db *impl) create(
+	ctx context.Context,
+	key fsdb.Key,
+	opts fsdb.WriteOptions,
+) (fsdb.WriteCloser, error) {
+	select {
+	default:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if err := db.checkWriteOptions(opts); err != nil {
+		return nil, err
+	}
+	w, err := db.local.CreateWithOptions(ctx, key, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &queuedWriter{
+		WriteCloser: w,
+		ctx:         ctx,
+		db:          db,
+		key:         key,
+	}, nil
 }
 
 func (db *impl) Delete(ctx context.Context, key fsdb.Key) error {
@@ -136,6 +571,7 @@ func (db *impl) Delete(ctx context.Context, key fsdb.Key) error {
 
 	var ret errbatch.ErrBatch
 	err := db.local.Delete(ctx, key)
+	db.cache.remove(key)
 	if !fsdb.IsNoSuchKeyError(err) {
 		existNeither = false
 		ret.Add(err)
@@ -152,11 +588,222 @@ func (db *impl) Delete(ctx context.Context, key fsdb.Key) error {
 	return ret.Compile()
 }
 
-// readBucket reads the key from remote bucket fully.
-func (db *impl) readBucket(
+func (db *impl) ReadMany(
+	ctx context.Context,
+	keys []fsdb.Key,
+) ([]io.ReadCloser, error) {
+	return fsdb.ReadMany(ctx, keys, db.opts.GetBatchThreadNum(), db.Read)
+}
+
+func (db *impl) WriteMany(ctx context.Context, entries []fsdb.Entry) error {
+	return fsdb.WriteMany(ctx, entries, db.opts.GetBatchThreadNum(), db.Write)
+}
+
+func (db *impl) DeleteMany(ctx context.Context, keys []fsdb.Key) error {
+	return fsdb.DeleteMany(ctx, keys, db.opts.GetBatchThreadNum(), db.Delete)
+}
+
+func (db *impl) Stat(ctx context.Context, key fsdb.Key) (*fsdb.EntryInfo, error) {
+	select {
+	default:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	info, err := db.local.Stat(ctx, key)
+	if err != nil && (!fsdb.IsNoSuchKeyError(err) || isExpired(err)) {
+		return nil, err
+	}
+	remoteInfo, err := db.statBucket(ctx, key)
+	if err != nil && !db.bucket.IsNotExist(err) && !isExpired(err) {
+		return nil, err
+	}
+
+	if info == nil {
+		if remoteInfo == nil {
+			if isExpired(err) {
+				return nil, err
+			}
+			return nil, &fsdb.NoSuchKeyError{Key: key}
+		}
+		return remoteInfo, nil
+	}
+	if remoteInfo != nil {
+		info.Location |= fsdb.LocationRemote
+	}
+	return info, nil
+}
+
+// statBucket gets the metadata of the key from remote bucket.
+//
+// If the bucket does not implement bucket.StatBucket,
+// it opens the remote entry for read instead and the size will be unknown.
+// Compressed is always false,
+// as the codec of the remote entry is unknown without reading it.
+//
+// If the remote entry already expired, it returns a NoSuchKeyError.
+func (db *impl) statBucket(
+	ctx context.Context,
+	key fsdb.Key,
+) (*fsdb.EntryInfo, error) {
+	info := &fsdb.EntryInfo{
+		Size:        -1,
+		LogicalSize: -1,
+		Location:    fsdb.LocationRemote,
+	}
+	var meta remoteMeta
+	if statBucket, ok := db.bucket.(bucket.StatBucket); ok {
+		objInfo, err := statBucket.Stat(ctx, db.opts.GetRemoteName(key))
+		if err != nil {
+			return nil, err
+		}
+		info.Size = objInfo.Size
+		info.ModTime = objInfo.ModTime
+		meta = parseRemoteMeta(objInfo.Metadata)
+		if err := meta.check(key); err != nil {
+			return nil, err
+		}
+	} else {
+		reader, m, err := db.openBucket(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		reader.Close()
+		meta = m
+	}
+	info.ETag = meta.etag
+	info.Expires = meta.expires
+	info.Metadata = meta.metadata
+	return info, nil
+}
+
+// openBucket opens the key from remote bucket for read,
+// along with its parsed metadata.
+//
+// If the bucket does not implement bucket.MetadataBucket,
+// the metadata is always empty.
+//
+// If the remote entry already expired, it returns a NoSuchKeyError.
+func (db *impl) openBucket(
 	ctx context.Context,
 	key fsdb.Key,
-) (io.Reader, error) {
+) (io.ReadCloser, remoteMeta, error) {
+	name := db.opts.GetRemoteName(key)
+	var data io.ReadCloser
+	var metadata map[string]string
+	var err error
+	if metadataBucket, ok := db.bucket.(bucket.MetadataBucket); ok {
+		data, metadata, err = metadataBucket.ReadWithMetadata(ctx, name)
+	} else {
+		data, err = db.bucket.Read(ctx, name)
+	}
+	if err != nil {
+		return nil, remoteMeta{}, err
+	}
+	meta := parseRemoteMeta(metadata)
+	if err := meta.check(key); err != nil {
+		data.Close()
+		return nil, remoteMeta{}, err
+	}
+	return data, meta, nil
+}
+
+// remoteMeta is the metadata of a remote entry.
+type remoteMeta struct {
+	// metadata is the user-defined metadata.
+	metadata map[string]string
+	// etag is the ETag of the local entry uploaded, empty if unknown.
+	etag string
+	// expires is the expiration time, zero if it never expires.
+	expires time.Time
+}
+
+// parseRemoteMeta splits the reserved keys out of the metadata of a remote
+// entry.
+func parseRemoteMeta(metadata map[string]string) remoteMeta {
+	var meta remoteMeta
+	for k, v := range metadata {
+		switch strings.ToLower(k) {
+		default:
+			if meta.metadata == nil {
+				meta.metadata = make(map[string]string)
+			}
+			meta.metadata[k] = v
+		case metadataETag:
+			meta.etag = v
+		case metadataExpires:
+			// Unparsable ones are left as never expire.
+			meta.expires, _ = time.Parse(time.RFC3339Nano, v)
+		}
+	}
+	return meta
+}
+
+// formatRemoteMeta returns the metadata to upload the local entry with.
+func formatRemoteMeta(
+	info *fsdb.EntryInfo,
+	metadata map[string]string,
+) map[string]string {
+	ret := make(map[string]string, len(metadata)+2)
+	for k, v := range metadata {
+		ret[k] = v
+	}
+	if info.ETag != "" {
+		ret[metadataETag] = info.ETag
+	}
+	if !info.Expires.IsZero() {
+		ret[metadataExpires] = info.Expires.UTC().Format(time.RFC3339Nano)
+	}
+	return ret
+}
+
+// check returns a NoSuchKeyError if the remote entry of the key already
+// expired.
+func (meta remoteMeta) check(key fsdb.Key) error {
+	if !meta.expires.IsZero() && !meta.expires.After(time.Now()) {
+		return &fsdb.NoSuchKeyError{
+			Key:     key,
+			Expired: meta.expires,
+		}
+	}
+	return nil
+}
+
+// writeOptions returns the options to save the remote entry locally.
+func (meta remoteMeta) writeOptions() fsdb.WriteOptions {
+	opts := fsdb.WriteOptions{Metadata: meta.metadata}
+	if !meta.expires.IsZero() {
+		opts.TTL = meta.expires.Sub(time.Now())
+		if opts.TTL <= 0 {
+			// Expired since it's checked, keep it expired instead of never.
+			opts.TTL = time.Nanosecond
+		}
+	}
+	return opts
+}
+
+// downloadKey downloads the key from remote bucket and saves it locally.
+//
+// The decompressed data is streamed into the local FSDB instead of memory.
+// The local entry is only created if it still doesn't exist when the download
+// finishes,
+// so that in case a new write happened during downloading,
+// we don't overwrite it with stale remote data.
+//
+// If the remote entry already expired, it returns a NoSuchKeyError.
+func (db *impl) downloadKey(ctx context.Context, key fsdb.Key) error {
+	w, err := db.fetchKey(ctx, key)
+	if err != nil || w == nil {
+		return err
+	}
+	return db.commitDownload(ctx, key, w)
+}
+
+// fetchKey downloads the key from remote bucket into a new local entry,
+// without committing it.
+//
+// It returns nil writer if the key already exists locally.
+func (db *impl) fetchKey(ctx context.Context, key fsdb.Key) (fsdb.WriteCloser, error) {
 	select {
 	default:
 	case <-ctx.Done():
@@ -164,7 +811,7 @@ func (db *impl) readBucket(
 	}
 
 	started := time.Now()
-	data, err := db.bucket.Read(ctx, db.opts.GetRemoteName(key))
+	data, meta, err := db.openBucket(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -183,11 +830,11 @@ func (db *impl) readBucket(
 		return nil, ctx.Err()
 	}
 
-	gzipReader, err := gzip.NewReader(data)
+	reader, err := db.decompress(data)
 	if err != nil {
 		return nil, err
 	}
-	defer gzipReader.Close()
+	defer reader.Close()
 
 	select {
 	default:
@@ -195,31 +842,59 @@ func (db *impl) readBucket(
 		return nil, ctx.Err()
 	}
 
-	buf, err := ioutil.ReadAll(gzipReader)
+	w, err := db.local.CreateWithOptions(
+		ctx,
+		key,
+		meta.writeOptions(),
+		&fsdb.IfNotExist,
+	)
+	if fsdb.IsPreconditionFailedError(err) {
+		// Already written locally, which is newer.
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	return bytes.NewReader(buf), nil
+	if _, err := io.Copy(w, reader); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// commitDownload commits the local entry downloaded by fetchKey.
+func (db *impl) commitDownload(ctx context.Context, key fsdb.Key, w fsdb.WriteCloser) error {
+	err := w.Close()
+	if fsdb.IsPreconditionFailedError(err) {
+		// Written locally during downloading, which is newer.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	db.downloaded(ctx, key)
+	return nil
 }
 
-// readAndCRC reads the key from local fully, and calculates crc32c.
-func (db *impl) readAndCRC(
+// localCRC reads the key and its metadata from local,
+// and calculates crc32c of the data along the read.
+func (db *impl) localCRC(
 	ctx context.Context,
 	key fsdb.Key,
-) (uint32, []byte, error) {
+) (uint32, map[string]string, error) {
 	select {
 	default:
 	case <-ctx.Done():
 		return 0, nil, ctx.Err()
 	}
 
-	reader, err := db.local.Read(ctx, key)
+	reader, metadata, err := db.local.ReadWithMetadata(ctx, key)
 	if err != nil {
 		return 0, nil, err
 	}
 	defer reader.Close()
-	buf, err := ioutil.ReadAll(reader)
-	if err != nil {
+	crc := crc32.New(crc32cTable)
+	if _, err := io.Copy(crc, reader); err != nil {
 		return 0, nil, err
 	}
 
@@ -229,30 +904,57 @@ func (db *impl) readAndCRC(
 		return 0, nil, ctx.Err()
 	}
 
-	return crc32.Checksum(buf, crc32cTable), buf, nil
+	return crc.Sum32(), metadata, nil
 }
 
 // uploadKey uploads a key to remote bucket, and deletes the local copy.
+//
+// Local entries with TTL are kept until they expire,
+// unless the reaper is disabled.
+//
+// The local data is streamed through crc32c and compression into the bucket,
+// so it's never fully buffered in memory.
 func (db *impl) uploadKey(ctx context.Context, key fsdb.Key) error {
-	oldCrc, content, err := db.readAndCRC(ctx, key)
+	select {
+	default:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	info, err := db.local.Stat(ctx, key)
 	if err != nil {
 		return err
 	}
-	reader, err := gzipData(bytes.NewReader(content))
+	localData, oldMetadata, err := db.local.ReadWithMetadata(ctx, key)
 	if err != nil {
 		return err
 	}
+	defer localData.Close()
+	crc := crc32.New(crc32cTable)
+	reader := db.compress(io.TeeReader(localData, crc))
 
-	select {
-	default:
-	case <-ctx.Done():
-		return ctx.Err()
+	name := db.opts.GetRemoteName(key)
+	if metadataBucket, ok := db.bucket.(bucket.MetadataBucket); ok {
+		err = metadataBucket.WriteWithMetadata(
+			ctx,
+			name,
+			reader,
+			formatRemoteMeta(info, oldMetadata),
+		)
+	} else {
+		// keepLocal guarantees that entries with metadata never reach here,
+		// and WriteWithOptions guarantees the same for entries with TTL.
+		err = db.bucket.Write(ctx, name, reader)
+	}
+	// Close waits for the compression to finish,
+	// so it's safe to read crc after that.
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
 	}
-
-	err = db.bucket.Write(ctx, db.opts.GetRemoteName(key), reader)
 	if err != nil {
 		return err
 	}
+	oldCrc := crc.Sum32()
 
 	select {
 	default:
@@ -261,11 +963,20 @@ func (db *impl) uploadKey(ctx context.Context, key fsdb.Key) error {
 	}
 
 	if db.opts.GetUseLock() {
-		db.locks.RLock(string(key))
-		defer db.locks.RUnlock(string(key))
+		// Exclusive, so that it never deletes the local entry just downloaded by
+		// a remote read before the remote read opens it.
+		db.locks.Lock(string(key))
+		defer db.locks.Unlock(string(key))
+	}
+	// check ETag, crc and metadata again before deleting
+	newInfo, err := db.local.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if newInfo.ETag != info.ETag {
+		return nil
 	}
-	// check crc again before deleting
-	newCrc, _, err := db.readAndCRC(ctx, key)
+	newCrc, newMetadata, err := db.localCRC(ctx, key)
 	if err != nil {
 		return err
 	}
@@ -276,61 +987,282 @@ func (db *impl) uploadKey(ctx context.Context, key fsdb.Key) error {
 		return ctx.Err()
 	}
 
-	if newCrc == oldCrc {
+	if newCrc == oldCrc && reflect.DeepEqual(newMetadata, oldMetadata) {
+		if db.cache.enabled() {
+			db.markClean(ctx, key)
+			return nil
+		}
+		if db.keepUntilExpired(info.Expires) {
+			return nil
+		}
 		return db.local.Delete(ctx, key)
 	}
 	return nil
 }
 
+// checkUploaded returns true if the local entry of the key is already
+// uploaded, by comparing its ETag with the one uploaded with the remote entry,
+// so it doesn't need to be uploaded again while it's kept locally.
+//
+// It's only checked for entries kept until they expire and in cache mode,
+// when the bucket implements bucket.MetadataBucket.
+// In cache mode the local entry is also tracked,
+// as clean if it's already uploaded and not kept until it expires,
+// or dirty otherwise.
+func (db *impl) checkUploaded(ctx context.Context, key fsdb.Key) bool {
+	info, err := db.local.Stat(ctx, key)
+	if err != nil {
+		return false
+	}
+	keep := db.keepUntilExpired(info.Expires)
+	uploaded := false
+	if _, ok := db.bucket.(bucket.MetadataBucket); ok && info.ETag != "" &&
+		(db.cache.enabled() || keep) {
+		remoteInfo, err := db.statBucket(ctx, key)
+		uploaded = err == nil && remoteInfo.ETag == info.ETag
+	}
+	if db.cache.enabled() {
+		db.cache.set(key, info.Size, uploaded && !keep)
+	}
+	return uploaded
+}
+
+// keepUntilExpired returns true if the uploaded local entry with the
+// expiration time is kept until it expires,
+// so that the reaper deletes the remote copy along with it.
+//
+// Without the reaper they are deleted or evicted like other entries.
+func (db *impl) keepUntilExpired(expires time.Time) bool {
+	return !expires.IsZero() && db.opts.GetReapInterval() > 0
+}
+
+// uploadJob is a key sent to the upload workers.
+type uploadJob struct {
+	key fsdb.Key
+	// queued is true if the key is from the upload queue,
+	// so it's queued again if the upload failed.
+	queued bool
+	// gen is the generation of the key in the upload queue the upload covers.
+	//
+	// For keys from the scans it's taken when the upload starts.
+	gen uint64
+	// pass is the upload pass requested by Flush the key belongs to,
+	// nil for the periodic scans.
+	pass *uploadPass
+}
+
+// uploadPass tracks the uploads of a pass requested by Flush.
+//
+// All of its methods are safe to call on nil pointer.
+type uploadPass struct {
+	wg          sync.WaitGroup
+	lock        sync.Mutex
+	scanErr     error
+	notUploaded NotUploadedError
+}
+
+// add adds a pending upload to the pass.
+func (p *uploadPass) add() {
+	if p != nil {
+		p.wg.Add(1)
+	}
+}
+
+// done marks a pending upload of the pass as done,
+// with the error of the key not uploaded,
+// or the error of the scan itself if key is nil.
+func (p *uploadPass) done(key fsdb.Key, err error) {
+	if p == nil {
+		return
+	}
+	if err != nil {
+		p.lock.Lock()
+		if key == nil {
+			p.scanErr = err
+		} else {
+			p.notUploaded.Keys = append(p.notUploaded.Keys, key)
+			p.notUploaded.Errors = append(p.notUploaded.Errors, err)
+		}
+		p.lock.Unlock()
+	}
+	p.wg.Done()
+}
+
+// wait waits for all the pending uploads of the pass to be done,
+// and returns their combined errors.
+func (p *uploadPass) wait(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-finished:
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		var errs errbatch.ErrBatch
+		errs.Add(p.scanErr)
+		if len(p.notUploaded.Keys) > 0 {
+			errs.Add(&p.notUploaded)
+		}
+		return errs.Compile()
+	}
+}
+
+func (db *impl) Flush(ctx context.Context) error {
+	// The scan itself is also a pending upload of the pass,
+	// so that it's not considered done before all the keys are sent.
+	pass := new(uploadPass)
+	pass.add()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-db.stop:
+		return errClosed
+	case <-db.done:
+		return errClosed
+	case db.passes <- pass:
+	}
+	return pass.wait(ctx)
+}
+
+func (db *impl) Close(ctx context.Context) error {
+	db.stopOnce.Do(func() {
+		close(db.stop)
+	})
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-db.done:
+		return nil
+	}
+}
+
 func (db *impl) startScanLoop(ctx context.Context) {
 	select {
 	default:
 	case <-ctx.Done():
 		return
+	case <-db.stop:
+		return
 	}
 
 	n := db.opts.GetUploadThreadNum()
 	logger := db.opts.GetLogger()
-	keys := make(chan fsdb.Key, 0)
+	jobs := make(chan uploadJob, 0)
 
+	// The numbers also include the keys from the upload queue.
 	scanned := new(int64)
 	skipped := new(int64)
 	uploaded := new(int64)
 	failed := new(int64)
 
 	// Workers
+	//
+	// They are not stopped by Close,
+	// but by closing jobs after the scan loop stops,
+	// so that they finish the keys they are currently uploading.
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	defer close(jobs)
 	for i := 0; i < n; i++ {
+		workers.Add(1)
 		go func() {
+			defer workers.Done()
 			for {
 				select {
 				case <-ctx.Done():
 					return
-				case key := <-keys:
+				case job, ok := <-jobs:
+					if !ok {
+						return
+					}
 					atomic.AddInt64(scanned, 1)
-					if db.opts.SkipKey(key) {
+					if !job.queued {
+						job.gen = db.queue.current(job.key)
+					}
+					if db.isCached(job.key) {
+						// Already uploaded and kept locally as cache.
 						atomic.AddInt64(skipped, 1)
+						db.dequeue(job.key, job.gen)
+						job.pass.done(job.key, nil)
 						continue
 					}
-					if err := db.uploadKey(ctx, key); err != nil {
-						// All errors will be retried on next scan loop,
-						// safe to just log and ignore.
+					if !job.queued && db.checkUploaded(ctx, job.key) {
+						// Already uploaded and kept locally,
+						// e.g. until it expires or left from before Open in cache mode.
+						atomic.AddInt64(skipped, 1)
+						job.pass.done(job.key, nil)
+						continue
+					}
+					keep := db.opts.SkipKey(job.key)
+					var err error
+					if !keep {
+						keep, err = db.keepLocal(ctx, job.key)
+					}
+					if keep {
+						atomic.AddInt64(skipped, 1)
+						db.markDirty(ctx, job.key)
+						db.dequeue(job.key, job.gen)
+						job.pass.done(job.key, err)
+						continue
+					}
+					err = db.uploadKey(ctx, job.key)
+					if fsdb.IsNoSuchKeyError(err) {
+						// Already uploaded or deleted since it's queued or scanned.
+						atomic.AddInt64(skipped, 1)
+						db.dequeue(job.key, job.gen)
+						job.pass.done(job.key, nil)
+						continue
+					}
+					if err != nil {
+						// All errors will be retried by the upload queue or the next scan
+						// loop, safe to just log and ignore.
 						if logger != nil {
-							logger.Printf("failed to upload %v to bucket: %v", key, err)
+							logger.Printf("failed to upload %v to bucket: %v", job.key, err)
 						}
 						atomic.AddInt64(failed, 1)
+						if job.queued {
+							db.enqueue(job.key)
+						}
 					} else {
 						atomic.AddInt64(uploaded, 1)
+						db.dequeue(job.key, job.gen)
 					}
+					job.pass.done(job.key, err)
 				}
 			}
 		}()
 	}
+	// Upload queue loop
+	//
+	// It's stopped before closing jobs, as it also sends keys to the workers.
+	var queueLoop sync.WaitGroup
+	defer queueLoop.Wait()
+	queueLoop.Add(1)
+	go func() {
+		defer queueLoop.Done()
+		db.startQueueLoop(ctx, jobs)
+	}()
+
+	// cursor is the scan cursor of the last key sent to the workers.
+	// If a scan returned error, the next one will resume from it.
+	var cursor string
 	ticker := time.NewTicker(db.opts.GetUploadDelay())
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-db.stop:
+			return
+		case pass := <-db.passes:
+			// Passes requested by Flush always scan everything,
+			// and don't affect the cursor of the periodic scans.
+			_, err := db.scan(ctx, jobs, "", pass)
+			pass.done(nil, err)
 		case <-ticker.C:
 			atomic.StoreInt64(scanned, 0)
 			atomic.StoreInt64(skipped, 0)
@@ -339,26 +1271,11 @@ func (db *impl) startScanLoop(ctx context.Context) {
 
 			started := time.Now()
 
-			if err := db.local.ScanKeys(
-				ctx,
-				func(key fsdb.Key) bool {
-					select {
-					case <-ctx.Done():
-						return false
-					default:
-						keys <- key
-						return true
-					}
-				},
-				func(path string, err error) bool {
-					// Most I/O errors here are just not exist errors caused by race
-					// conditions, log if it's not not exist error and ignore.
-					if logger != nil && !os.IsNotExist(err) {
-						logger.Printf("ScanKeys reported error on %s: %v", path, err)
-					}
-					return true
-				},
-			); err != nil {
+			if logger != nil && cursor != "" {
+				logger.Printf("resuming ScanKeys from %q", cursor)
+			}
+			var err error
+			if cursor, err = db.scan(ctx, jobs, cursor, nil); err != nil {
 				if logger != nil {
 					logger.Printf("ScanKeys returned error: %v", err)
 				}
@@ -370,27 +1287,308 @@ func (db *impl) startScanLoop(ctx context.Context) {
 				// finished with the keys yet, and when we start the next loop the
 				// workers might be still working on keys from the previous loop.
 				logger.Printf(
-					"took %v, scanned %d, skipped %d, uploaded %d, failed %d",
+					"took %v, scanned %d, skipped %d, uploaded %d, failed %d, queued %d",
 					time.Now().Sub(started),
 					atomic.LoadInt64(scanned),
 					atomic.LoadInt64(skipped),
 					atomic.LoadInt64(uploaded),
 					atomic.LoadInt64(failed),
+					db.queue.len(),
 				)
 			}
 		}
 	}
 }
 
-func gzipData(data io.Reader) (io.Reader, error) {
-	buf := new(bytes.Buffer)
-	writer, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+// scan scans the local keys after cursor and sends them to the upload workers.
+//
+// It returns the cursor to resume the scan from,
+// which is empty if the scan finished.
+// The scan stops early with an error when ctx is canceled or db is closed.
+func (db *impl) scan(
+	ctx context.Context,
+	jobs chan<- uploadJob,
+	cursor string,
+	pass *uploadPass,
+) (string, error) {
+	logger := db.opts.GetLogger()
+	var stopped error
+	err := db.local.ResumeScanKeys(
+		ctx,
+		cursor,
+		func(key fsdb.Key, keyCursor string) bool {
+			pass.add()
+			select {
+			case <-ctx.Done():
+				stopped = ctx.Err()
+			case <-db.stop:
+				stopped = errClosed
+			case jobs <- uploadJob{key: key, pass: pass}:
+				cursor = keyCursor
+				return true
+			}
+			pass.done(key, nil)
+			return false
+		},
+		func(path string, err error) bool {
+			// Most I/O errors here are just not exist errors caused by race
+			// conditions, log if it's not not exist error and ignore.
+			if logger != nil && !os.IsNotExist(err) {
+				logger.Printf("ScanKeys reported error on %s: %v", path, err)
+			}
+			return true
+		},
+	)
+	if err == nil {
+		err = stopped
+	}
 	if err != nil {
-		return nil, err
+		return cursor, err
+	}
+	return "", nil
+}
+
+// keepLocal returns true if the local entry of the key should not be uploaded
+// to remote bucket regardless of the skip function.
+//
+// They are expired entries,
+// and entries with metadata when the bucket does not implement
+// bucket.MetadataBucket,
+// which are rejected by WriteWithOptions but could be left from before.
+// For the latter ErrNoMetadataBucket is also returned to be reported by Flush,
+// and a warning is logged once per key.
+func (db *impl) keepLocal(ctx context.Context, key fsdb.Key) (bool, error) {
+	info, err := db.local.Stat(ctx, key)
+	if err != nil {
+		return isExpired(err), nil
+	}
+	if len(info.Metadata) == 0 {
+		return false, nil
+	}
+	if _, ok := db.bucket.(bucket.MetadataBucket); ok {
+		return false, nil
+	}
+	if _, warned := db.warned.LoadOrStore(string(key), true); !warned {
+		if logger := db.opts.GetLogger(); logger != nil {
+			logger.Printf(
+				"%v has metadata but the bucket does not support metadata, keeping it locally",
+				key,
+			)
+		}
+	}
+	return true, ErrNoMetadataBucket
+}
+
+func (db *impl) startReaperLoop(ctx context.Context) {
+	logger := db.opts.GetLogger()
+	ticker := time.NewTicker(db.opts.GetReapInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			started := time.Now()
+			deleted := 0
+			err := db.local.DeleteExpired(
+				ctx,
+				func(key fsdb.Key) error {
+					// Delete the remote copy first,
+					// so that it's never left behind after the local entry is deleted.
+					err := db.bucket.Delete(ctx, db.opts.GetRemoteName(key))
+					if err != nil && !db.bucket.IsNotExist(err) {
+						return err
+					}
+					db.cache.remove(key)
+					deleted++
+					return nil
+				},
+			)
+			if logger != nil {
+				// All errors will be retried on next reaper loop,
+				// safe to just log and ignore.
+				if err != nil {
+					logger.Printf("DeleteExpired returned error: %v", err)
+				}
+				logger.Printf(
+					"reaper took %v, deleted %d",
+					time.Now().Sub(started),
+					deleted,
+				)
+			}
+		}
+	}
+}
+
+// isExpired returns true if err is a NoSuchKeyError of an expired entry.
+func isExpired(err error) bool {
+	if e, ok := err.(*fsdb.NoSuchKeyError); ok {
+		return !e.Expired.IsZero()
+	}
+	return false
+}
+
+// queuedWriter queues the key into the upload queue after committing the
+// local write.
+//
+// It also holds the row lock while committing if it's enabled in options.
+type queuedWriter struct {
+	fsdb.WriteCloser
+
+	ctx context.Context
+	db  *impl
+	key fsdb.Key
+}
+
+func (w *queuedWriter) Close() error {
+	if w.db.opts.GetUseLock() {
+		w.db.locks.Lock(string(w.key))
+		defer w.db.locks.Unlock(string(w.key))
+	}
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	w.db.markDirty(w.ctx, w.key)
+	w.db.enqueue(w.key)
+	return nil
+}
+
+// compress returns a reader of data compressed using the codec in options,
+// or uncompressed if it's not worth compressing per compression policy,
+// then encrypted if an encryptor is set in options.
+//
+// The compression runs in a goroutine writing into a pipe as the returned
+// reader is read,
+// so only the sample used by the compression policy is buffered in memory.
+// The returned reader must be closed,
+// which stops and waits for the goroutine,
+// and returns the error from it if any.
+func (db *impl) compress(data io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	r := &compressReader{
+		PipeReader: pr,
+		done:       make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		r.err = db.compressTo(pw, data)
+		pw.CloseWithError(r.err)
+	}()
+	return r
+}
+
+// compressReader is the reader returned by compress.
+type compressReader struct {
+	*io.PipeReader
+
+	done chan struct{}
+	err  error
+}
+
+func (r *compressReader) Close() error {
+	r.PipeReader.Close()
+	<-r.done
+	return r.err
+}
+
+// compressTo compresses (and encrypts) data into w.
+func (db *impl) compressTo(w io.Writer, data io.Reader) error {
+	c := db.opts.GetCodec()
+	if policy := db.opts.GetCompressionPolicy(); c.Suffix() != "" && policy.Enabled() {
+		buf := bufio.NewReaderSize(data, policy.SampleSize)
+		sample, err := buf.Peek(policy.SampleSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		worth, err := policy.Worth(c, sample)
+		if err != nil {
+			return err
+		}
+		if !worth {
+			c = codec.None
+		}
+		data = buf
+	}
+	var base io.WriteCloser = nopWriteCloser{w}
+	if e := db.opts.GetEncryptor(); e != nil {
+		var err error
+		if base, err = e.NewWriter(w); err != nil {
+			return err
+		}
+	}
+	if c.Suffix() == "" {
+		if _, err := base.Write(rawMagic); err != nil {
+			base.Close()
+			return err
+		}
+	}
+	writer, err := c.NewWriter(base)
+	if err != nil {
+		return err
 	}
-	defer writer.Close()
 	if _, err = io.Copy(writer, data); err != nil {
+		writer.Close()
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return base.Close()
+}
+
+// requireEncryption returns true if unencrypted remote data should be
+// rejected.
+func (db *impl) requireEncryption() bool {
+	return db.opts.GetRequireEncryption() && db.opts.GetEncryptor() != nil
+}
+
+// nopWriteCloser is an io.WriteCloser with a no-op Close.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// decompress decrypts the remote data if it's encrypted,
+// then detects its codec and decompresses it.
+//
+// Data uploaded uncompressed starts with rawMagic and is never decompressed.
+// Data without rawMagic is detected by the magic bytes of the codecs,
+// which includes the data uploaded uncompressed by older versions.
+//
+// Closing the returned reader does not close data.
+func (db *impl) decompress(data io.Reader) (io.ReadCloser, error) {
+	buf := bufio.NewReader(data)
+	if header, _ := buf.Peek(len(crypt.Magic)); crypt.IsEncrypted(header) {
+		e := db.opts.GetEncryptor()
+		if e == nil {
+			return nil, errNoEncryptor
+		}
+		decrypted, err := e.NewReader(buf)
+		if err != nil {
+			return nil, err
+		}
+		data = decrypted
+	} else {
+		if db.requireEncryption() {
+			return nil, errNotEncrypted
+		}
+		data = buf
+	}
+	buf = bufio.NewReader(data)
+	if header, _ := buf.Peek(len(rawMagic)); bytes.Equal(header, rawMagic) {
+		if _, err := buf.Discard(len(rawMagic)); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(buf), nil
+	}
+	c, reader, err := codec.Detect(buf, db.opts.GetCodecs(), db.opts.GetCodec())
+	if err != nil {
 		return nil, err
 	}
-	return buf, nil
+	return c.NewReader(reader)
 }
@@ -1,22 +1,32 @@
 package hybrid_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/fishy/fsdb"
 	"github.com/fishy/fsdb/bucket"
+	"github.com/fishy/fsdb/codec"
+	"github.com/fishy/fsdb/crypt"
 	"github.com/fishy/fsdb/hybrid"
 	"github.com/fishy/fsdb/local"
 )
 
 type dbCollection struct {
-	DB     fsdb.FSDB
+	DB     hybrid.DB
 	Local  fsdb.Local
 	Remote *bucket.Mock
 	Opts   hybrid.OptionsBuilder
@@ -128,6 +138,864 @@ func TestHybrid(t *testing.T) {
 	}
 }
 
+func TestCodec(t *testing.T) {
+	content := "foobar"
+
+	for _, c := range codec.Builtins() {
+		t.Run(
+			"read-"+c.Name(),
+			func(t *testing.T) {
+				root, db := createHybridDB(t, "codec: ")
+				defer os.RemoveAll(root)
+				if c == codec.None {
+					// Uncompressed data can't be detected.
+					db.Opts.SetCodec(codec.None)
+				}
+				ctx := context.Background()
+				db.Open(ctx)
+
+				key := fsdb.Key("foo")
+				var buf bytes.Buffer
+				w, err := c.NewWriter(&buf)
+				if err != nil {
+					t.Fatalf("NewWriter failed: %v", err)
+				}
+				io.WriteString(w, content)
+				w.Close()
+				if err := db.Remote.Write(ctx, db.Opts.GetRemoteName(key), &buf); err != nil {
+					t.Fatalf("Write to remote failed: %v", err)
+				}
+
+				reader, err := db.DB.ReadRange(ctx, key, 2, 3)
+				if err != nil {
+					t.Fatalf("ReadRange failed: %v", err)
+				}
+				actual, err := ioutil.ReadAll(reader)
+				reader.Close()
+				if err != nil {
+					t.Fatalf("read content failed: %v", err)
+				}
+				if expect := content[2:5]; string(actual) != expect {
+					t.Errorf("ReadRange expected %q, got %q", expect, actual)
+				}
+				compareContent(t, db.DB, key, content)
+			},
+		)
+	}
+
+	t.Run(
+		"upload-none",
+		func(t *testing.T) {
+			root, db := createHybridDB(t, "codec: ")
+			defer os.RemoveAll(root)
+			db.Opts.SetUploadDelay(time.Hour).
+				SetSkipFunc(hybrid.UploadAll)
+			db.Opts.SetCodec(codec.None)
+			ctx := context.Background()
+			db.Open(ctx)
+			defer db.DB.Close(ctx)
+
+			// Raw data that looks like gzip.
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			io.WriteString(w, content)
+			w.Close()
+			payload := buf.String()
+
+			key := fsdb.Key("foo")
+			if err := db.DB.Write(ctx, key, strings.NewReader(payload)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := db.DB.Flush(ctx); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			if keys := scanKeys(t, db.Local); len(keys) != 0 {
+				t.Errorf("Expected no local keys after upload, got %v", keys)
+			}
+			reader, err := db.DB.ReadRange(ctx, key, 0, -1)
+			if err != nil {
+				t.Fatalf("ReadRange failed: %v", err)
+			}
+			actual, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatalf("read content failed: %v", err)
+			}
+			if string(actual) != payload {
+				t.Errorf("ReadRange expected %x, got %x", payload, actual)
+			}
+			compareContent(t, db.DB, key, payload)
+		},
+	)
+
+	t.Run(
+		"upload-zstd",
+		func(t *testing.T) {
+			if testing.Short() {
+				t.Skip("skipping test in short mode")
+			}
+
+			delay := time.Millisecond * 100
+			longer := time.Millisecond * 150
+
+			root, db := createHybridDB(t, "codec: ")
+			defer os.RemoveAll(root)
+			db.Opts.SetUploadDelay(delay).
+				SetSkipFunc(hybrid.UploadAll)
+			db.Opts.SetCodec(codec.Zstd(0))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			db.Open(ctx)
+
+			key := fsdb.Key("foo")
+			if err := db.DB.Write(ctx, key, strings.NewReader(content)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			time.Sleep(longer)
+
+			reader, err := db.Remote.Read(ctx, db.Opts.GetRemoteName(key))
+			if err != nil {
+				t.Fatalf("Read from remote failed: %v", err)
+			}
+			data, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatalf("read remote content failed: %v", err)
+			}
+			magic := codec.Zstd(0).(codec.Magic).Magic()
+			if !bytes.HasPrefix(data, magic) {
+				t.Errorf("remote data should be compressed by zstd, got %x", data)
+			}
+			compareContent(t, db.DB, key, content)
+		},
+	)
+
+	t.Run(
+		"upload-adaptive",
+		func(t *testing.T) {
+			if testing.Short() {
+				t.Skip("skipping test in short mode")
+			}
+
+			delay := time.Millisecond * 100
+			longer := time.Millisecond * 150
+
+			root, db := createHybridDB(t, "codec: ")
+			defer os.RemoveAll(root)
+			db.Opts.SetUploadDelay(delay).
+				SetSkipFunc(hybrid.UploadAll)
+			db.Opts.SetCodec(codec.Zstd(0)).
+				SetCompressionPolicy(codec.DefaultAdaptivePolicy)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			db.Open(ctx)
+
+			buf := make([]byte, 4096)
+			rand.New(rand.NewSource(1)).Read(buf)
+			random := string(buf)
+			compressible := strings.Repeat(content, 1000)
+			randomKey := fsdb.Key("random")
+			compressibleKey := fsdb.Key("compressible")
+			if err := db.DB.Write(ctx, randomKey, strings.NewReader(random)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := db.DB.Write(
+				ctx,
+				compressibleKey,
+				strings.NewReader(compressible),
+			); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			time.Sleep(longer)
+
+			for _, c := range []struct {
+				key     fsdb.Key
+				content string
+				label   string
+				magic   []byte
+			}{
+				// Data not worth compressing is uploaded uncompressed.
+				{randomKey, random, "none", []byte("FSDBRAW\x01")},
+				{
+					compressibleKey,
+					compressible,
+					codec.Zstd(0).Name(),
+					codec.Zstd(0).(codec.Magic).Magic(),
+				},
+			} {
+				reader, err := db.Remote.Read(ctx, db.Opts.GetRemoteName(c.key))
+				if err != nil {
+					t.Fatalf("Read from remote failed: %v", err)
+				}
+				data, err := ioutil.ReadAll(reader)
+				reader.Close()
+				if err != nil {
+					t.Fatalf("read remote content failed: %v", err)
+				}
+				if !bytes.HasPrefix(data, c.magic) {
+					t.Errorf(
+						"%q: remote data should be compressed by %s, got %x",
+						c.key,
+						c.label,
+						data[:len(c.magic)],
+					)
+				}
+				compareContent(t, db.DB, c.key, c.content)
+			}
+		},
+	)
+
+	t.Run(
+		"upload-encrypted",
+		func(t *testing.T) {
+			if testing.Short() {
+				t.Skip("skipping test in short mode")
+			}
+
+			delay := time.Millisecond * 100
+			longer := time.Millisecond * 150
+
+			root, db := createHybridDB(t, "codec: ")
+			defer os.RemoveAll(root)
+			keys := crypt.StaticKeyProvider{
+				Current: "k1",
+				Keys: map[string][]byte{
+					"k1": bytes.Repeat([]byte{1}, crypt.KeySize),
+				},
+			}
+			db.Opts.SetUploadDelay(delay).
+				SetSkipFunc(hybrid.UploadAll)
+			db.Opts.SetEncryptor(crypt.NewEncryptor(keys))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			db.Open(ctx)
+
+			key := fsdb.Key("foo")
+			if err := db.DB.Write(ctx, key, strings.NewReader(content)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			time.Sleep(longer)
+
+			reader, err := db.Remote.Read(ctx, db.Opts.GetRemoteName(key))
+			if err != nil {
+				t.Fatalf("Read from remote failed: %v", err)
+			}
+			data, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatalf("read remote content failed: %v", err)
+			}
+			if id, _ := crypt.KeyID(data); id != "k1" {
+				t.Errorf("remote data should be encrypted by k1, got %x", data)
+			}
+
+			reader, err = db.DB.ReadRange(ctx, key, 2, 3)
+			if err != nil {
+				t.Fatalf("ReadRange failed: %v", err)
+			}
+			actual, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatalf("read content failed: %v", err)
+			}
+			if expect := content[2:5]; string(actual) != expect {
+				t.Errorf("ReadRange expected %q, got %q", expect, actual)
+			}
+			compareContent(t, db.DB, key, content)
+
+			// Without the encryptor the remote data can't be read.
+			if err := db.Local.Delete(ctx, key); err != nil {
+				t.Fatalf("Delete local failed: %v", err)
+			}
+			plain := hybrid.Open(ctx, db.Local, db.Remote, hybrid.NewDefaultOptions())
+			if _, err := plain.Read(ctx, key); err == nil {
+				t.Error("Read without encryptor should fail")
+			}
+		},
+	)
+
+	t.Run(
+		"require-encryption",
+		func(t *testing.T) {
+			root, db := createHybridDB(t, "codec: ")
+			defer os.RemoveAll(root)
+			keys := crypt.StaticKeyProvider{
+				Current: "k1",
+				Keys: map[string][]byte{
+					"k1": bytes.Repeat([]byte{1}, crypt.KeySize),
+				},
+			}
+			db.Opts.SetEncryptor(crypt.NewEncryptor(keys)).
+				SetRequireEncryption(true)
+			ctx := context.Background()
+			db.Open(ctx)
+
+			key := fsdb.Key("foo")
+			raw := fsdb.Key("raw")
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			io.WriteString(w, content)
+			w.Close()
+			if err := db.Remote.Write(ctx, db.Opts.GetRemoteName(key), &buf); err != nil {
+				t.Fatalf("Write to remote failed: %v", err)
+			}
+			if err := db.Remote.Write(
+				ctx,
+				db.Opts.GetRemoteName(raw),
+				strings.NewReader("FSDBRAW\x01"+content),
+			); err != nil {
+				t.Fatalf("Write to remote failed: %v", err)
+			}
+
+			for _, key := range []fsdb.Key{key, raw} {
+				if _, err := db.DB.Read(ctx, key); err == nil {
+					t.Errorf("%q: Read of unencrypted remote data should fail", key)
+				}
+				if _, err := db.DB.ReadRange(ctx, key, 2, 3); err == nil {
+					t.Errorf("%q: ReadRange of unencrypted remote data should fail", key)
+				}
+			}
+
+			db.Opts.SetRequireEncryption(false)
+			compareContent(t, db.DB, key, content)
+			compareContent(t, db.DB, raw, content)
+		},
+	)
+}
+
+func TestCreate(t *testing.T) {
+	root, db := createHybridDB(t, "create: ")
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+	db.Open(ctx)
+
+	key := fsdb.Key("foo")
+	content := "bar"
+
+	w, err := db.DB.Create(ctx, key)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatalf("Write to writer failed: %v", err)
+	}
+	if _, err := db.DB.Read(ctx, key); !fsdb.IsNoSuchKeyError(err) {
+		t.Errorf("read before Close should return NoSuchKeyError, got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	compareContent(t, db.DB, key, content)
+	compareContent(t, db.Local, key, content)
+}
+
+func TestStat(t *testing.T) {
+	root, db := createHybridDB(t, "stat: ")
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+	db.Open(ctx)
+
+	key := fsdb.Key("foo")
+	content := "bar"
+
+	if _, err := db.DB.Stat(ctx, key); !fsdb.IsNoSuchKeyError(err) {
+		t.Errorf("Stat on empty hybrid db should return NoSuchKeyError, got %v", err)
+	}
+
+	if err := db.Remote.Write(
+		ctx,
+		db.Opts.GetRemoteName(key),
+		strings.NewReader(content),
+	); err != nil {
+		t.Fatalf("Write to remote failed: %v", err)
+	}
+	info, err := db.DB.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Location != fsdb.LocationRemote {
+		t.Errorf("Location expected %v, got %v", fsdb.LocationRemote, info.Location)
+	}
+	if info.Size != int64(len(content)) {
+		t.Errorf("Size expected %d, got %d", len(content), info.Size)
+	}
+	if info.Compressed {
+		t.Errorf("Compressed expected false for remote only entry, got %+v", info)
+	}
+
+	if err := db.DB.Write(ctx, key, strings.NewReader(content)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	info, err = db.DB.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Location != fsdb.LocationBoth {
+		t.Errorf("Location expected %v, got %v", fsdb.LocationBoth, info.Location)
+	}
+
+	if err := db.Remote.Delete(ctx, db.Opts.GetRemoteName(key)); err != nil {
+		t.Fatalf("Delete from remote failed: %v", err)
+	}
+	info, err = db.DB.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Location != fsdb.LocationLocal {
+		t.Errorf("Location expected %v, got %v", fsdb.LocationLocal, info.Location)
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	root, db := createHybridDB(t, "read-range: ")
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+	db.Open(ctx)
+
+	key := fsdb.Key("foo")
+	content := "foobar"
+
+	if _, err := db.DB.ReadRange(ctx, key, 0, 1); !fsdb.IsNoSuchKeyError(err) {
+		t.Errorf("ReadRange on empty db should return NoSuchKeyError, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	io.WriteString(w, content)
+	w.Close()
+	if err := db.Remote.Write(ctx, db.Opts.GetRemoteName(key), &buf); err != nil {
+		t.Fatalf("Write to remote failed: %v", err)
+	}
+
+	reader, err := db.DB.ReadRange(ctx, key, 2, 3)
+	if err != nil {
+		t.Fatalf("ReadRange failed: %v", err)
+	}
+	actual, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("read content failed: %v", err)
+	}
+	if expect := content[2:5]; string(actual) != expect {
+		t.Errorf("ReadRange expected %q, got %q", expect, actual)
+	}
+	// Ranged reads from remote should not be saved locally
+	if _, err := db.Local.Read(ctx, key); !fsdb.IsNoSuchKeyError(err) {
+		t.Errorf("ReadRange should not save data locally, got %v", err)
+	}
+}
+
+// rangeOnlyBucket is a bucket.RangeBucket failing all the full downloads.
+type rangeOnlyBucket struct {
+	*bucket.Mock
+}
+
+var errFullDownload = errors.New("full download")
+
+func (b rangeOnlyBucket) Read(ctx context.Context, name string) (io.ReadCloser, error) {
+	return nil, errFullDownload
+}
+
+func (b rangeOnlyBucket) ReadWithMetadata(ctx context.Context, name string) (
+	io.ReadCloser,
+	map[string]string,
+	error,
+) {
+	return nil, nil, errFullDownload
+}
+
+func TestReadRangeRaw(t *testing.T) {
+	root, db := createHybridDB(t, "read-range-raw: ")
+	defer os.RemoveAll(root)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db.DB = hybrid.Open(ctx, db.Local, rangeOnlyBucket{db.Remote}, db.Opts)
+
+	key := fsdb.Key("foo")
+	content := "foobar"
+
+	// Uncompressed remote data with the header.
+	if err := db.Remote.Write(
+		ctx,
+		db.Opts.GetRemoteName(key),
+		strings.NewReader("FSDBRAW\x01"+content),
+	); err != nil {
+		t.Fatalf("Write to remote failed: %v", err)
+	}
+
+	for _, c := range []struct {
+		offset, length int64
+		expect         string
+	}{
+		{2, 3, content[2:5]},
+		{2, -1, content[2:]},
+		{4, 10, content[4:]},
+	} {
+		reader, err := db.DB.ReadRange(ctx, key, c.offset, c.length)
+		if err != nil {
+			t.Fatalf("ReadRange(%d, %d) failed: %v", c.offset, c.length, err)
+		}
+		actual, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("read content failed: %v", err)
+		}
+		if string(actual) != c.expect {
+			t.Errorf(
+				"ReadRange(%d, %d) expected %q, got %q",
+				c.offset,
+				c.length,
+				c.expect,
+				actual,
+			)
+		}
+	}
+
+	// Compressed remote data still needs a full download.
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	io.WriteString(w, content)
+	w.Close()
+	if err := db.Remote.Write(ctx, db.Opts.GetRemoteName(key), &buf); err != nil {
+		t.Fatalf("Write to remote failed: %v", err)
+	}
+	if _, err := db.DB.ReadRange(ctx, key, 2, 3); err != errFullDownload {
+		t.Errorf("ReadRange expected %v, got %v", errFullDownload, err)
+	}
+}
+
+func TestWriteIf(t *testing.T) {
+	root, db := createHybridDB(t, "write-if: ")
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+	db.Open(ctx)
+
+	key := fsdb.Key("foo")
+	content := "foo"
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	io.WriteString(w, content)
+	w.Close()
+	if err := db.Remote.Write(ctx, db.Opts.GetRemoteName(key), &buf); err != nil {
+		t.Fatalf("Write to remote failed: %v", err)
+	}
+
+	// Remote only entry should count as existing
+	if err := db.DB.WriteIf(
+		ctx,
+		key,
+		strings.NewReader("bar"),
+		fsdb.IfNotExist,
+	); !fsdb.IsPreconditionFailedError(err) {
+		t.Errorf("Expected PreconditionFailedError, got %v", err)
+	}
+	compareContent(t, db.DB, key, content)
+
+	info, err := db.DB.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if err := db.DB.WriteIf(
+		ctx,
+		key,
+		strings.NewReader("bar"),
+		fsdb.IfMatch(info.ETag),
+	); err != nil {
+		t.Fatalf("WriteIf failed: %v", err)
+	}
+	compareContent(t, db.DB, key, "bar")
+}
+
+func TestReadMany(t *testing.T) {
+	root, db := createHybridDB(t, "read-many: ")
+	defer os.RemoveAll(root)
+	db.Remote.ReadDelay = bucket.MockOperationDelay{
+		Total: time.Millisecond * 50,
+	}
+	ctx := context.Background()
+	db.Open(ctx)
+
+	keys := []fsdb.Key{
+		fsdb.Key("foo"),
+		fsdb.Key("bar"),
+		fsdb.Key("foobar"),
+	}
+	for _, key := range keys {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		io.WriteString(w, string(key))
+		w.Close()
+		if err := db.Remote.Write(ctx, db.Opts.GetRemoteName(key), &buf); err != nil {
+			t.Fatalf("Write to remote failed: %v", err)
+		}
+	}
+
+	started := time.Now()
+	readers, err := db.DB.ReadMany(ctx, keys)
+	elapsed := time.Now().Sub(started)
+	if err != nil {
+		t.Fatalf("ReadMany failed: %v", err)
+	}
+	for i, reader := range readers {
+		buf, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("read content failed: %v", err)
+		}
+		if string(buf) != string(keys[i]) {
+			t.Errorf("read content expected %q, got %q", keys[i], buf)
+		}
+	}
+	if elapsed >= db.Remote.ReadDelay.Total*time.Duration(len(keys)) {
+		t.Errorf("remote reads should be concurrent, took %v", elapsed)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	root, db := createHybridDB(t, "ttl: ")
+	defer os.RemoveAll(root)
+	ttl := time.Millisecond * 100
+	db.Opts.SetUploadDelay(ttl / 4).SetSkipFunc(hybrid.UploadAll)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db.Open(ctx)
+
+	key := fsdb.Key("foo")
+	name := db.Opts.GetRemoteName(key)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	io.WriteString(w, "stale")
+	w.Close()
+	if err := db.Remote.Write(ctx, name, &buf); err != nil {
+		t.Fatalf("Write to remote failed: %v", err)
+	}
+
+	if err := db.DB.WriteWithOptions(
+		ctx,
+		key,
+		strings.NewReader("bar"),
+		fsdb.WriteOptions{TTL: ttl},
+	); err != nil {
+		t.Fatalf("WriteWithOptions failed: %v", err)
+	}
+	// A bucket without metadata support cannot keep the expiration time.
+	plainDB := hybrid.Open(
+		ctx,
+		local.Open(local.NewDefaultOptions(root+"plain")),
+		struct{ bucket.Bucket }{db.Remote},
+		db.Opts,
+	)
+	if err := plainDB.WriteWithOptions(
+		ctx,
+		key,
+		strings.NewReader("bar"),
+		fsdb.WriteOptions{TTL: ttl},
+	); err != hybrid.ErrNoMetadataBucket {
+		t.Errorf("Expected ErrNoMetadataBucket, got %v", err)
+	}
+	// Without the reaper the local copies would never be deleted.
+	noReaperDB := hybrid.Open(
+		ctx,
+		local.Open(local.NewDefaultOptions(root+"noreaper")),
+		db.Remote,
+		hybrid.NewDefaultOptions().SetReapInterval(0),
+	)
+	if err := noReaperDB.WriteWithOptions(
+		ctx,
+		key,
+		strings.NewReader("bar"),
+		fsdb.WriteOptions{TTL: ttl},
+	); err != hybrid.ErrNoReaper {
+		t.Errorf("Expected ErrNoReaper, got %v", err)
+	}
+
+	remoteOnly := fsdb.Key("baz")
+	if err := db.DB.WriteWithOptions(
+		ctx,
+		remoteOnly,
+		strings.NewReader("bar"),
+		fsdb.WriteOptions{TTL: ttl},
+	); err != nil {
+		t.Fatalf("WriteWithOptions failed: %v", err)
+	}
+	compareContent(t, db.DB, key, "bar")
+	// Entries with TTL should be uploaded, and kept locally.
+	time.Sleep(ttl / 2)
+	compareContent(t, db.Local, key, "bar")
+	info, err := db.DB.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Location != fsdb.LocationBoth {
+		t.Errorf("Expected location %v, got %v", fsdb.LocationBoth, info.Location)
+	}
+	// Remote copies should keep the expiration time.
+	if err := db.Local.Delete(ctx, remoteOnly); err != nil {
+		t.Fatalf("Delete from local failed: %v", err)
+	}
+	info, err = db.DB.Stat(ctx, remoteOnly)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Expires.IsZero() {
+		t.Error("Remote copy should have expiration time")
+	}
+
+	time.Sleep(ttl)
+	// Expired entries should not fall back to remote.
+	for _, key := range []fsdb.Key{key, remoteOnly} {
+		if _, err := db.DB.Read(ctx, key); !fsdb.IsNoSuchKeyError(err) {
+			t.Errorf("Read on expired key should return NoSuchKeyError, got %v", err)
+		}
+		if _, err := db.DB.Stat(ctx, key); !fsdb.IsNoSuchKeyError(err) {
+			t.Errorf("Stat on expired key should return NoSuchKeyError, got %v", err)
+		}
+	}
+
+	// Restart with a shorter reap interval.
+	cancel()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	db.Opts.SetReapInterval(ttl / 4)
+	db.Open(ctx)
+	time.Sleep(ttl / 2)
+	if _, err := db.Remote.Read(ctx, name); !db.Remote.IsNotExist(err) {
+		t.Errorf("Remote copy should be deleted by reaper, got %v", err)
+	}
+	if err := db.Local.Delete(ctx, key); !fsdb.IsNoSuchKeyError(err) {
+		t.Errorf("Local entry should be deleted by reaper, got %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	delay := time.Millisecond * 100
+	longer := time.Millisecond * 150
+
+	root, db := createHybridDB(t, "metadata: ")
+	defer os.RemoveAll(root)
+	db.Opts.SetUploadDelay(delay).SetSkipFunc(hybrid.UploadAll)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db.Open(ctx)
+	// A bucket without metadata support.
+	plainLocal := local.Open(local.NewDefaultOptions(root + "plain"))
+	plainDB := hybrid.Open(
+		ctx,
+		plainLocal,
+		struct{ bucket.Bucket }{db.Remote},
+		db.Opts,
+	)
+
+	key := fsdb.Key("foo")
+	content := "bar"
+	metadata := map[string]string{
+		"content-type": "text/plain",
+	}
+	if err := db.DB.WriteWithOptions(
+		ctx,
+		key,
+		strings.NewReader(content),
+		fsdb.WriteOptions{
+			Metadata: map[string]string{
+				hybrid.ReservedMetadataPrefix + "foo": "bar",
+			},
+		},
+	); err == nil {
+		t.Error("WriteWithOptions with reserved metadata key should fail")
+	}
+	if err := db.DB.WriteWithOptions(
+		ctx,
+		key,
+		strings.NewReader(content),
+		fsdb.WriteOptions{Metadata: metadata},
+	); err != nil {
+		t.Fatalf("WriteWithOptions failed: %v", err)
+	}
+	if err := plainDB.WriteWithOptions(
+		ctx,
+		key,
+		strings.NewReader(content),
+		fsdb.WriteOptions{Metadata: metadata},
+	); err != hybrid.ErrNoMetadataBucket {
+		t.Errorf("Expected ErrNoMetadataBucket, got %v", err)
+	}
+	// Entries with metadata left from before.
+	if err := plainLocal.WriteWithOptions(
+		ctx,
+		key,
+		strings.NewReader(content),
+		fsdb.WriteOptions{Metadata: metadata},
+	); err != nil {
+		t.Fatalf("WriteWithOptions failed: %v", err)
+	}
+
+	time.Sleep(longer)
+
+	if _, err := db.Local.Read(ctx, key); !fsdb.IsNoSuchKeyError(err) {
+		t.Errorf(
+			"key should be uploaded to remote and deleted locally, got %v",
+			err,
+		)
+	}
+	info, err := db.DB.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if !reflect.DeepEqual(info.Metadata, metadata) {
+		t.Errorf("Stat metadata expected %v, got %v", metadata, info.Metadata)
+	}
+	reader, actual, err := db.DB.ReadWithMetadata(ctx, key)
+	if err != nil {
+		t.Fatalf("ReadWithMetadata failed: %v", err)
+	}
+	reader.Close()
+	if !reflect.DeepEqual(actual, metadata) {
+		t.Errorf("ReadWithMetadata expected %v, got %v", metadata, actual)
+	}
+	// Now it should be available locally with metadata
+	reader, actual, err = db.Local.ReadWithMetadata(ctx, key)
+	if err != nil {
+		t.Fatalf("ReadWithMetadata from local failed: %v", err)
+	}
+	reader.Close()
+	if !reflect.DeepEqual(actual, metadata) {
+		t.Errorf("ReadWithMetadata from local expected %v, got %v", metadata, actual)
+	}
+
+	// Entries with metadata should be kept locally by plainDB.
+	info, err = plainDB.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Location != fsdb.LocationBoth {
+		t.Errorf("Expected location %v, got %v", fsdb.LocationBoth, info.Location)
+	}
+	// And reported by Flush.
+	err = plainDB.Flush(ctx)
+	if notUploaded, ok := err.(*hybrid.NotUploadedError); !ok {
+		t.Errorf("Expected NotUploadedError from Flush, got %v", err)
+	} else if len(notUploaded.Keys) != 1 || !notUploaded.Keys[0].Equals(key) {
+		t.Errorf("Expected %v not uploaded, got %v", key, notUploaded.Keys)
+	} else if notUploaded.Errors[0] != hybrid.ErrNoMetadataBucket {
+		t.Errorf(
+			"Expected ErrNoMetadataBucket, got %v",
+			notUploaded.Errors[0],
+		)
+	}
+}
+
 func TestSkip(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode")
@@ -225,6 +1093,674 @@ func TestSlowUpload(t *testing.T) {
 	}
 }
 
+// failingBucket fails writes after reading a few bytes.
+type failingBucket struct {
+	*bucket.Mock
+}
+
+func (b failingBucket) Write(ctx context.Context, name string, data io.Reader) error {
+	io.CopyN(ioutil.Discard, data, 10)
+	return errors.New("write failed")
+}
+
+func (b failingBucket) WriteWithMetadata(
+	ctx context.Context,
+	name string,
+	data io.Reader,
+	metadata map[string]string,
+) error {
+	return b.Write(ctx, name, data)
+}
+
+func TestStreamingUpload(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	delay := time.Millisecond * 100
+	longer := time.Millisecond * 300
+
+	// Larger than the pipe and codec buffers.
+	buf := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(1)).Read(buf[:len(buf)/2])
+	content := string(buf)
+	key := fsdb.Key("foo")
+
+	t.Run(
+		"upload",
+		func(t *testing.T) {
+			root, db := createHybridDB(t, "streaming: ")
+			defer os.RemoveAll(root)
+			db.Opts.SetUploadDelay(delay).
+				SetSkipFunc(hybrid.UploadAll)
+			db.Opts.SetCompressionPolicy(codec.DefaultAdaptivePolicy)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			db.Open(ctx)
+
+			if err := db.DB.Write(ctx, key, strings.NewReader(content)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			time.Sleep(longer)
+
+			if keys := scanKeys(t, db.Local); len(keys) != 0 {
+				t.Errorf("Expected no local keys after upload, got %v", keys)
+			}
+			compareContent(t, db.DB, key, content)
+		},
+	)
+
+	t.Run(
+		"failure",
+		func(t *testing.T) {
+			root, db := createHybridDB(t, "streaming: ")
+			defer os.RemoveAll(root)
+			db.Opts.SetUploadDelay(delay).
+				SetSkipFunc(hybrid.UploadAll)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			db.DB = hybrid.Open(ctx, db.Local, failingBucket{db.Remote}, db.Opts)
+
+			if err := db.DB.Write(ctx, key, strings.NewReader(content)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			time.Sleep(longer)
+
+			if keys := scanKeys(t, db.Local); len(keys) != 1 {
+				t.Errorf("Expected local key kept after failed upload, got %v", keys)
+			}
+			compareContent(t, db.DB, key, content)
+			err := db.DB.Flush(ctx)
+			if notUploaded, ok := err.(*hybrid.NotUploadedError); !ok {
+				t.Errorf("Expected NotUploadedError from Flush, got %v", err)
+			} else if len(notUploaded.Keys) != 1 || !notUploaded.Keys[0].Equals(key) {
+				t.Errorf("Expected %v not uploaded, got %v", key, notUploaded.Keys)
+			}
+		},
+	)
+}
+
+func TestStreamingRead(t *testing.T) {
+	root, db := createHybridDB(t, "streaming: ")
+	defer os.RemoveAll(root)
+	tmpDir := local.NewDefaultOptions(root + "local").GetRootTempDir()
+	ctx := context.Background()
+	db.Open(ctx)
+
+	buf := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(1)).Read(buf[:len(buf)/2])
+	content := string(buf)
+	writeRemote := func(t *testing.T, key fsdb.Key) {
+		t.Helper()
+		var compressed bytes.Buffer
+		w, err := db.Opts.GetCodec().NewWriter(&compressed)
+		if err != nil {
+			t.Fatalf("NewWriter failed: %v", err)
+		}
+		io.WriteString(w, content)
+		w.Close()
+		if err := db.Remote.Write(ctx, db.Opts.GetRemoteName(key), &compressed); err != nil {
+			t.Fatalf("Write to remote failed: %v", err)
+		}
+	}
+	checkTempDir := func(t *testing.T) {
+		t.Helper()
+		infos, err := ioutil.ReadDir(tmpDir)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatalf("ReadDir failed: %v", err)
+		}
+		if len(infos) != 0 {
+			t.Errorf("Expected temp dirs removed, got %d", len(infos))
+		}
+	}
+
+	key := fsdb.Key("foo")
+	writeRemote(t, key)
+	compareContent(t, db.DB, key, content)
+	compareContent(t, db.Local, key, content)
+	checkTempDir(t)
+
+	key = fsdb.Key("bar")
+	writeRemote(t, key)
+	if err := db.DB.WriteIf(ctx, key, strings.NewReader("bar"), fsdb.IfExist); err != nil {
+		t.Fatalf("WriteIf failed: %v", err)
+	}
+	compareContent(t, db.DB, key, "bar")
+	checkTempDir(t)
+}
+
+func TestWriteDuringRemoteRead(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	delay := time.Millisecond * 100
+
+	root, db := createHybridDB(t, "write-during-remote-read: ")
+	defer os.RemoveAll(root)
+	// The row lock is not held during the download,
+	// so the write below is committed during the download.
+	db.Remote.ReadDelay.Before = delay * 2
+	ctx := context.Background()
+	db.Open(ctx)
+
+	key := fsdb.Key("foo")
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	io.WriteString(w, "stale")
+	w.Close()
+	if err := db.Remote.Write(ctx, db.Opts.GetRemoteName(key), &buf); err != nil {
+		t.Fatalf("Write to remote failed: %v", err)
+	}
+
+	read := make(chan string, 1)
+	go func() {
+		reader, err := db.DB.Read(ctx, key)
+		if err != nil {
+			t.Errorf("Read failed: %v", err)
+			read <- ""
+			return
+		}
+		defer reader.Close()
+		content, _ := ioutil.ReadAll(reader)
+		read <- string(content)
+	}()
+	time.Sleep(delay)
+	started := time.Now()
+	if err := db.DB.Write(ctx, key, strings.NewReader("new")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed >= delay {
+		t.Errorf("Write should not be blocked by the download, took %v", elapsed)
+	}
+	if content := <-read; content != "new" {
+		t.Errorf("Read expected %q, got %q", "new", content)
+	}
+	compareContent(t, db.Local, key, "new")
+}
+
+func TestFlushClose(t *testing.T) {
+	root, db := createHybridDB(t, "flush-close: ")
+	defer os.RemoveAll(root)
+	db.Opts.SetUploadDelay(time.Hour).SetSkipFunc(hybrid.UploadAll)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db.Open(ctx)
+
+	content := "bar"
+	keys := []fsdb.Key{
+		fsdb.Key("foo"),
+		fsdb.Key("bar"),
+		fsdb.Key("baz"),
+	}
+	for _, key := range keys {
+		if err := db.DB.Write(ctx, key, strings.NewReader(content)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	if err := db.DB.Flush(ctx); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if keys := scanKeys(t, db.Local); len(keys) != 0 {
+		t.Errorf("Expected all keys uploaded after Flush, got %v", keys)
+	}
+	for _, key := range keys {
+		compareContent(t, db.DB, key, content)
+	}
+
+	t.Run(
+		"drain",
+		func(t *testing.T) {
+			if testing.Short() {
+				t.Skip("skipping test in short mode")
+			}
+
+			delay := time.Millisecond * 100
+
+			root, db := createHybridDB(t, "flush-close: ")
+			defer os.RemoveAll(root)
+			db.Remote.WriteDelay = bucket.MockOperationDelay{
+				Before: delay,
+				After:  0,
+			}
+			db.Opts.SetUploadDelay(time.Hour).SetSkipFunc(hybrid.UploadAll)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			db.Open(ctx)
+
+			key := fsdb.Key("foo")
+			if err := db.DB.Write(ctx, key, strings.NewReader(content)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			go db.DB.Flush(ctx)
+			// Close during the upload.
+			time.Sleep(delay / 2)
+			if err := db.DB.Close(ctx); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			if keys := scanKeys(t, db.Local); len(keys) != 0 {
+				t.Errorf("Expected ongoing upload finished by Close, got %v", keys)
+			}
+
+			if err := db.DB.Write(ctx, key, strings.NewReader(content)); err != nil {
+				t.Fatalf("Write after Close failed: %v", err)
+			}
+			compareContent(t, db.DB, key, content)
+			if err := db.DB.Flush(ctx); err == nil {
+				t.Error("Flush after Close should return error")
+			}
+			if err := db.DB.Close(ctx); err != nil {
+				t.Errorf("Second Close failed: %v", err)
+			}
+		},
+	)
+}
+
+func TestUploadQueue(t *testing.T) {
+	content := "bar"
+
+	t.Run(
+		"persist",
+		func(t *testing.T) {
+			root, db := createHybridDB(t, "upload-queue: ")
+			defer os.RemoveAll(root)
+			queueDir := root + "queue"
+			db.Opts.SetUploadDelay(time.Hour).
+				SetUploadMinAge(time.Hour).
+				SetUploadQueueDir(queueDir).
+				SetSkipFunc(hybrid.UploadAll)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			db.Open(ctx)
+
+			for _, key := range []fsdb.Key{
+				fsdb.Key("foo"),
+				fsdb.Key("bar"),
+				fsdb.Key("foo"),
+			} {
+				if err := db.DB.Write(ctx, key, strings.NewReader(content)); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+			}
+			if err := db.DB.WriteWithOptions(
+				ctx,
+				fsdb.Key("baz"),
+				strings.NewReader(content),
+				fsdb.WriteOptions{TTL: time.Hour},
+			); err != nil {
+				t.Fatalf("WriteWithOptions failed: %v", err)
+			}
+			if depth := db.DB.QueueDepth(); depth != 3 {
+				t.Errorf("Expected queue depth 3, got %d", depth)
+			}
+			if err := db.DB.Close(ctx); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			db.Open(ctx)
+			defer db.DB.Close(ctx)
+			if depth := db.DB.QueueDepth(); depth != 3 {
+				t.Errorf("Expected queue depth 3 after reopen, got %d", depth)
+			}
+			if err := db.DB.Flush(ctx); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			if depth := db.DB.QueueDepth(); depth != 0 {
+				t.Errorf("Expected queue depth 0 after Flush, got %d", depth)
+			}
+			infos, err := ioutil.ReadDir(queueDir)
+			if err != nil {
+				t.Fatalf("ReadDir failed: %v", err)
+			}
+			if len(infos) != 0 {
+				t.Errorf("Expected queue files removed after Flush, got %d", len(infos))
+			}
+		},
+	)
+
+	t.Run(
+		"persist-encrypted",
+		func(t *testing.T) {
+			root, db := createHybridDB(t, "upload-queue: ")
+			defer os.RemoveAll(root)
+			queueDir := root + "queue"
+			db.Opts.SetUploadDelay(time.Hour).
+				SetUploadMinAge(time.Hour).
+				SetUploadQueueDir(queueDir).
+				SetSkipFunc(hybrid.UploadAll)
+			db.Opts.SetEncryptor(crypt.NewEncryptor(crypt.StaticKeyProvider{
+				Current: "k1",
+				Keys: map[string][]byte{
+					"k1": bytes.Repeat([]byte{1}, crypt.KeySize),
+				},
+			}))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			db.Open(ctx)
+
+			if err := db.DB.Write(
+				ctx,
+				fsdb.Key("foo"),
+				strings.NewReader(content),
+			); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := db.DB.Close(ctx); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			infos, err := ioutil.ReadDir(queueDir)
+			if err != nil {
+				t.Fatalf("ReadDir failed: %v", err)
+			}
+			for _, info := range infos {
+				data, err := ioutil.ReadFile(queueDir + local.PathSeparator + info.Name())
+				if err != nil {
+					t.Fatalf("ReadFile failed: %v", err)
+				}
+				if !crypt.IsEncrypted(data) {
+					t.Errorf("queue file should be encrypted, got %q", data)
+				}
+			}
+
+			db.Open(ctx)
+			defer db.DB.Close(ctx)
+			if depth := db.DB.QueueDepth(); depth != 1 {
+				t.Errorf("Expected queue depth 1 after reopen, got %d", depth)
+			}
+		},
+	)
+
+	t.Run(
+		"upload",
+		func(t *testing.T) {
+			if testing.Short() {
+				t.Skip("skipping test in short mode")
+			}
+
+			minAge := time.Millisecond * 100
+			longer := time.Millisecond * 200
+
+			root, db := createHybridDB(t, "upload-queue: ")
+			defer os.RemoveAll(root)
+			db.Opts.SetUploadDelay(time.Hour).
+				SetUploadMinAge(minAge).
+				SetSkipFunc(hybrid.UploadAll)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			db.Open(ctx)
+
+			key := fsdb.Key("foo")
+			if err := db.DB.Write(ctx, key, strings.NewReader(content)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			time.Sleep(minAge / 2)
+			if keys := scanKeys(t, db.Local); len(keys) != 1 {
+				t.Errorf("Expected key kept locally before min age, got %v", keys)
+			}
+			if depth := db.DB.QueueDepth(); depth != 1 {
+				t.Errorf("Expected queue depth 1, got %d", depth)
+			}
+
+			time.Sleep(longer)
+			if keys := scanKeys(t, db.Local); len(keys) != 0 {
+				t.Errorf("Expected key uploaded by the queue, got %v", keys)
+			}
+			if depth := db.DB.QueueDepth(); depth != 0 {
+				t.Errorf("Expected queue depth 0, got %d", depth)
+			}
+			compareContent(t, db.DB, key, content)
+		},
+	)
+
+	t.Run(
+		"requeue-during-upload",
+		func(t *testing.T) {
+			if testing.Short() {
+				t.Skip("skipping test in short mode")
+			}
+
+			upload := time.Millisecond * 300
+			step := time.Millisecond * 100
+
+			root, db := createHybridDB(t, "upload-queue: ")
+			defer os.RemoveAll(root)
+			queueDir := root + "queue"
+			db.Opts.SetUploadDelay(time.Hour).
+				SetUploadMinAge(0).
+				SetUploadQueueDir(queueDir).
+				SetSkipFunc(hybrid.UploadAll)
+			db.Remote.WriteDelay.Before = upload
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			db.Open(ctx)
+			defer db.DB.Close(ctx)
+
+			checkFiles := func(t *testing.T, expected int) {
+				t.Helper()
+				infos, err := ioutil.ReadDir(queueDir)
+				if err != nil {
+					t.Fatalf("ReadDir failed: %v", err)
+				}
+				if len(infos) != expected {
+					t.Errorf("Expected %d queue files, got %d", expected, len(infos))
+				}
+			}
+
+			key := fsdb.Key("foo")
+			if err := db.DB.Write(ctx, key, strings.NewReader(content)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			time.Sleep(step)
+			// Queued again while the first upload is still running.
+			if err := db.DB.Write(ctx, key, strings.NewReader("baz")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			// The first upload finished, but the second one is still running.
+			time.Sleep(upload - step/2)
+			checkFiles(t, 1)
+
+			time.Sleep(upload)
+			checkFiles(t, 0)
+			compareContent(t, db.DB, key, "baz")
+		},
+	)
+}
+
+// countingBucket counts the writes.
+type countingBucket struct {
+	*bucket.Mock
+
+	writes *int64
+}
+
+func (b countingBucket) Write(ctx context.Context, name string, data io.Reader) error {
+	atomic.AddInt64(b.writes, 1)
+	return b.Mock.Write(ctx, name, data)
+}
+
+func (b countingBucket) WriteWithMetadata(
+	ctx context.Context,
+	name string,
+	data io.Reader,
+	metadata map[string]string,
+) error {
+	atomic.AddInt64(b.writes, 1)
+	return b.Mock.WriteWithMetadata(ctx, name, data, metadata)
+}
+
+func TestCache(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	// wait is the time to wait for the evictions.
+	wait := time.Millisecond * 100
+
+	content := "bar"
+	keyA := fsdb.Key("a")
+	keyB := fsdb.Key("b")
+	keyC := fsdb.Key("c")
+
+	open := func(t *testing.T, policy hybrid.CachePolicy, entries int) (
+		string,
+		dbCollection,
+		*int64,
+		context.CancelFunc,
+	) {
+		t.Helper()
+		root, db := createHybridDB(t, "cache: ")
+		db.Opts.SetUploadDelay(time.Hour).
+			SetUploadMinAge(time.Hour).
+			SetCachePolicy(policy).
+			SetCacheMaxEntries(entries).
+			SetSkipFunc(hybrid.UploadAll)
+		ctx, cancel := context.WithCancel(context.Background())
+		writes := new(int64)
+		db.DB = hybrid.Open(ctx, db.Local, countingBucket{db.Remote, writes}, db.Opts)
+		return root, db, writes, cancel
+	}
+	write := func(t *testing.T, db dbCollection, keys ...fsdb.Key) {
+		t.Helper()
+		for _, key := range keys {
+			if err := db.DB.Write(
+				context.Background(),
+				key,
+				strings.NewReader(content),
+			); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+	}
+	localKeys := func(t *testing.T, db dbCollection) []fsdb.Key {
+		t.Helper()
+		time.Sleep(wait)
+		keys := scanKeys(t, db.Local)
+		sort.Slice(keys, func(i, j int) bool {
+			return bytes.Compare(keys[i], keys[j]) < 0
+		})
+		return keys
+	}
+	checkLocal := func(t *testing.T, db dbCollection, expected ...fsdb.Key) {
+		t.Helper()
+		if keys := localKeys(t, db); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected local keys %q, got %q", expected, keys)
+		}
+	}
+
+	t.Run(
+		"lru",
+		func(t *testing.T) {
+			root, db, _, cancel := open(t, hybrid.CacheLRU, 2)
+			defer os.RemoveAll(root)
+			defer cancel()
+
+			write(t, db, keyA, keyB)
+			if err := db.DB.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			checkLocal(t, db, keyA, keyB)
+
+			compareContent(t, db.DB, keyA, content)
+			write(t, db, keyC)
+			checkLocal(t, db, keyA, keyC)
+
+			// Download b again, which evicts a as the least recently used.
+			compareContent(t, db.DB, keyB, content)
+			checkLocal(t, db, keyB, keyC)
+		},
+	)
+
+	t.Run(
+		"lfu",
+		func(t *testing.T) {
+			root, db, _, cancel := open(t, hybrid.CacheLFU, 2)
+			defer os.RemoveAll(root)
+			defer cancel()
+
+			write(t, db, keyA, keyB)
+			if err := db.DB.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			compareContent(t, db.DB, keyA, content)
+			compareContent(t, db.DB, keyA, content)
+			compareContent(t, db.DB, keyB, content)
+			write(t, db, keyC)
+			checkLocal(t, db, keyA, keyC)
+		},
+	)
+
+	t.Run(
+		"dirty",
+		func(t *testing.T) {
+			root, db, writes, cancel := open(t, hybrid.CacheLRU, 1)
+			defer os.RemoveAll(root)
+			defer cancel()
+
+			write(t, db, keyA, keyB, keyC)
+			checkLocal(t, db, keyA, keyB, keyC)
+
+			if err := db.DB.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			if keys := localKeys(t, db); len(keys) != 1 {
+				t.Errorf("Expected 1 key kept locally after uploads, got %q", keys)
+			}
+
+			// The cached key is not uploaded again.
+			if err := db.DB.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			if n := atomic.LoadInt64(writes); n != 3 {
+				t.Errorf("Expected 3 uploads, got %d", n)
+			}
+		},
+	)
+
+	t.Run(
+		"restart",
+		func(t *testing.T) {
+			root, db, writes, cancel := open(t, hybrid.CacheLRU, 3)
+			defer os.RemoveAll(root)
+			defer cancel()
+
+			write(t, db, keyA, keyB)
+			if err := db.DB.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			write(t, db, keyC)
+			checkLocal(t, db, keyA, keyB, keyC)
+			if err := db.DB.Close(context.Background()); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			// Reopen with a smaller budget,
+			// the uploaded entries left from before are evictable without uploading
+			// them again.
+			db.Opts.SetCacheMaxEntries(1)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			db.DB = hybrid.Open(ctx, db.Local, countingBucket{db.Remote, writes}, db.Opts)
+			defer db.DB.Close(ctx)
+			checkLocal(t, db, keyC)
+			if n := atomic.LoadInt64(writes); n != 2 {
+				t.Errorf("Expected 2 uploads, got %d", n)
+			}
+
+			// The dirty entry left from before is still uploaded.
+			if err := db.DB.Flush(ctx); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			if n := atomic.LoadInt64(writes); n != 3 {
+				t.Errorf("Expected 3 uploads, got %d", n)
+			}
+			compareContent(t, db.DB, keyA, content)
+		},
+	)
+}
+
 func TestUploadRaceCondition(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode")
@@ -263,7 +1799,8 @@ func TestUploadRaceCondition(t *testing.T) {
 	go func() {
 		time.Sleep(secondWrite)
 		if err := db.DB.Write(ctx, key, strings.NewReader(content2)); err != nil {
-			t.Fatalf("Write failed: %v", err)
+			t.Errorf("Write failed: %v", err)
+			return
 		}
 		compareContent(t, db.DB, key, content2)
 	}()
@@ -308,7 +1845,8 @@ func TestRemoteReadRaceCondition(t *testing.T) {
 	go func() {
 		time.Sleep(secondWrite)
 		if err := db.DB.Write(ctx, key, strings.NewReader(content2)); err != nil {
-			t.Fatalf("Write failed: %v", err)
+			t.Errorf("Write failed: %v", err)
+			return
 		}
 	}()
 
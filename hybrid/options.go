@@ -1,25 +1,82 @@
 package hybrid
 
 import (
+	"compress/gzip"
 	"crypto/sha512"
 	"encoding/hex"
 	"log"
 	"time"
 
 	"github.com/fishy/fsdb"
+	"github.com/fishy/fsdb/codec"
+	"github.com/fishy/fsdb/crypt"
 )
 
 // Default options values.
 const (
-	DefaultUploadDelay     time.Duration = time.Minute * 5
+	DefaultUploadDelay     time.Duration = time.Hour
+	DefaultUploadMinAge    time.Duration = time.Minute * 5
 	DefaultUploadThreadNum               = 5
 	DefaultUseLock                       = true
+	DefaultBatchThreadNum                = 10
+	DefaultReapInterval    time.Duration = time.Hour
+
+	DefaultCachePolicy     = CacheOff
+	DefaultCacheMaxBytes   = 0
+	DefaultCacheMaxEntries = 0
 )
 
+// CachePolicy defines whether uploaded entries are kept locally as cache,
+// and how they are evicted.
+type CachePolicy int
+
+// CachePolicy values.
+const (
+	// CacheOff deletes the local copies right after they are uploaded,
+	// and keeps the downloaded entries locally only until they are uploaded
+	// again.
+	CacheOff CachePolicy = iota
+
+	// CacheLRU keeps uploaded and downloaded entries locally,
+	// and evicts the least recently used ones first when the local FSDB is over
+	// the cache budget.
+	CacheLRU
+
+	// CacheLFU keeps uploaded and downloaded entries locally,
+	// and evicts the least frequently used ones first when the local FSDB is
+	// over the cache budget.
+	// Ties are broken by the least recently used.
+	CacheLFU
+)
+
+func (policy CachePolicy) String() string {
+	switch policy {
+	default:
+		return "unknown"
+	case CacheOff:
+		return "off"
+	case CacheLRU:
+		return "lru"
+	case CacheLFU:
+		return "lfu"
+	}
+}
+
+// DefaultCodec is the default codec used to compress the data uploaded to
+// remote bucket, which is gzip with best compression level.
+var DefaultCodec = codec.Gzip(gzip.BestCompression)
+
+// DefaultCompressionPolicy is the default compression policy,
+// which always compresses data.
+var DefaultCompressionPolicy = codec.AlwaysCompress
+
 // DefaultNameFunc is the default name function used.
 //
 // The format is:
 //     fsdb/data/<sha-512/224 of key>.gz
+//
+// The ".gz" suffix is kept for compatibility regardless of the codec used,
+// as the codec of the remote data is detected when reading it.
 func DefaultNameFunc(key fsdb.Key) string {
 	hash := sha512.Sum512_224(key)
 	return "fsdb/data/" + hex.EncodeToString(hash[:]) + ".gz"
@@ -41,14 +98,46 @@ var DefaultSkipFunc = UploadAll
 // Options defines a read-only view of options used in hybrid FSDB.
 type Options interface {
 	// GetUploadDelay returns the delay between two upload scan loops.
+	//
+	// Written entries are uploaded by the upload queue,
+	// so the scan loops are only a safety net for the entries missed by the
+	// queue (e.g. written before a crash without a queue directory),
+	// and could use a much longer delay.
 	GetUploadDelay() time.Duration
 
+	// GetUploadMinAge returns the minimum time an entry stays in the upload
+	// queue after it's written, before it's uploaded.
+	//
+	// Entries written again during that time are only uploaded once.
+	GetUploadMinAge() time.Duration
+
+	// GetUploadQueueDir returns the directory the upload queue is persisted
+	// into, so that it survives restarts.
+	//
+	// Empty string means the upload queue is only kept in memory,
+	// and entries queued before a restart are left to the scan loops.
+	GetUploadQueueDir() string
+
 	// GetUploadThreadNum returns the number of threads used in upload scan loops.
 	//
 	// The higher the number, the faster the uploads,
 	// but it also means heavier disk I/O load.
 	GetUploadThreadNum() int
 
+	// GetBatchThreadNum returns the number of threads used by each batch
+	// operation.
+	//
+	// Keys not exist locally will be downloaded from the remote bucket
+	// concurrently.
+	GetBatchThreadNum() int
+
+	// GetReapInterval returns the delay between two reaper loops deleting
+	// expired entries from both local and remote bucket.
+	//
+	// Non-positive values mean the reaper is disabled,
+	// and WriteWithOptions rejects entries with TTL.
+	GetReapInterval() time.Duration
+
 	// GetUseLock returns whether we should use a row lock.
 	//
 	// Uses a row lock guarantees that we do not overwrite newer data with stale
@@ -65,6 +154,48 @@ type Options interface {
 	// GetRemoteName returns the name for the data file on remote bucket.
 	GetRemoteName(key fsdb.Key) string
 
+	// GetCodec returns the codec used to compress the data uploaded to remote
+	// bucket.
+	GetCodec() codec.Codec
+
+	// GetCodecs returns all the codecs the remote data could be compressed by.
+	//
+	// They are the codec returned by GetCodec,
+	// the codecs registered by RegisterCodecs,
+	// and the built-in codecs.
+	// When reading from remote bucket,
+	// the codec is detected by the magic bytes among them,
+	// and falls back to the one returned by GetCodec.
+	GetCodecs() []codec.Codec
+
+	// GetCompressionPolicy returns the policy deciding whether to compress the
+	// data uploaded to remote bucket.
+	GetCompressionPolicy() codec.Policy
+
+	// GetEncryptor returns the encryptor encrypting the data uploaded to remote
+	// bucket, or nil if encryption is off.
+	GetEncryptor() *crypt.Encryptor
+
+	// GetRequireEncryption returns whether to reject unencrypted remote data
+	// when an encryptor is set.
+	GetRequireEncryption() bool
+
+	// GetCachePolicy returns the policy of keeping uploaded entries locally as
+	// cache.
+	GetCachePolicy() CachePolicy
+
+	// GetCacheMaxBytes returns the byte budget of the local FSDB in cache mode,
+	// counted by the stored (compressed) sizes of the entries.
+	//
+	// Non-positive values mean unlimited.
+	GetCacheMaxBytes() int64
+
+	// GetCacheMaxEntries returns the entry budget of the local FSDB in cache
+	// mode.
+	//
+	// Non-positive values mean unlimited.
+	GetCacheMaxEntries() int
+
 	// SkipKey returns true if the key should not be uploaded to remote bucket
 	// (retain locally), or false if the key should be uploaded to remote bucket.
 	SkipKey(key fsdb.Key) bool
@@ -84,9 +215,28 @@ type OptionsBuilder interface {
 	// SetUploadDelay sets the delay between two upload scan loops.
 	SetUploadDelay(delay time.Duration) OptionsBuilder
 
+	// SetUploadMinAge sets the minimum time an entry stays in the upload queue
+	// after it's written, before it's uploaded.
+	SetUploadMinAge(age time.Duration) OptionsBuilder
+
+	// SetUploadQueueDir sets the directory the upload queue is persisted into.
+	//
+	// Every queued key is stored as a small file in it,
+	// so it should not be shared with anything else,
+	// including other hybrid FSDBs.
+	// The directory is created on Open if it does not exist.
+	SetUploadQueueDir(dir string) OptionsBuilder
+
 	// SetUploadThreadNum sets the number of threads used in upload scan loops.
 	SetUploadThreadNum(threads int) OptionsBuilder
 
+	// SetBatchThreadNum sets the number of threads used by each batch operation
+	// (ReadMany, WriteMany and DeleteMany).
+	SetBatchThreadNum(threads int) OptionsBuilder
+
+	// SetReapInterval sets the delay between two reaper loops.
+	SetReapInterval(interval time.Duration) OptionsBuilder
+
 	// SetUseLock sets whether to use a row lock.
 	SetUseLock(lock bool) OptionsBuilder
 
@@ -95,26 +245,114 @@ type OptionsBuilder interface {
 
 	// SetRemoteNameFunc sets the function for GetRemoteName.
 	SetRemoteNameFunc(f func(fsdb.Key) string) OptionsBuilder
+
+	// SetCodec sets the codec used to compress the data uploaded to remote
+	// bucket.
+	//
+	// It's safe to change on an existing hybrid FSDB,
+	// as long as the codecs previously used are still registered.
+	//
+	// Data uploaded with codec.None is prefixed by a short header,
+	// so it's never mistaken as compressed data when read back.
+	SetCodec(c codec.Codec) OptionsBuilder
+
+	// RegisterCodecs registers custom codecs,
+	// so that remote data compressed by them can be read.
+	//
+	// Custom codecs need to implement codec.Magic to be detected.
+	// The built-in codecs are always registered.
+	RegisterCodecs(codecs ...codec.Codec) OptionsBuilder
+
+	// SetCompressionPolicy sets the policy deciding whether to compress the data
+	// uploaded to remote bucket.
+	//
+	// Data not worth compressing is uploaded uncompressed,
+	// with the short header of uncompressed data to keep it detectable on reads.
+	SetCompressionPolicy(p codec.Policy) OptionsBuilder
+
+	// SetEncryptor sets the encryptor encrypting the data uploaded to remote
+	// bucket, after compression.
+	//
+	// Remote data uploaded before the encryptor is set is still readable,
+	// and encrypted remote data is decrypted by the key ID in it,
+	// so the key provider must keep the keys used by the existing remote data.
+	// nil turns encryption off for new uploads.
+	//
+	// Encryption of the local data is set in the options of the local FSDB
+	// separately.
+	// Remote data is never re-encrypted,
+	// including by RotateKeys of the local FSDB,
+	// until the entry is uploaded again.
+	//
+	// The keys persisted in the upload queue directory are also encrypted by it.
+	SetEncryptor(e *crypt.Encryptor) OptionsBuilder
+
+	// SetRequireEncryption sets whether to reject unencrypted remote data when
+	// an encryptor is set, instead of reading it as uploaded before the
+	// encryptor was set.
+	//
+	// Reads of unencrypted remote data return an error with it on.
+	// It has no effect without an encryptor.
+	SetRequireEncryption(require bool) OptionsBuilder
+
+	// SetCachePolicy sets the policy of keeping uploaded entries locally as
+	// cache.
+	//
+	// With a policy other than CacheOff,
+	// uploaded and downloaded entries are kept locally as clean entries,
+	// and evicted per the policy when the local FSDB is over the budget set by
+	// SetCacheMaxBytes or SetCacheMaxEntries.
+	// Entries not uploaded yet (dirty ones) count towards the budget,
+	// but are never evicted.
+	SetCachePolicy(policy CachePolicy) OptionsBuilder
+
+	// SetCacheMaxBytes sets the byte budget of the local FSDB in cache mode.
+	SetCacheMaxBytes(bytes int64) OptionsBuilder
+
+	// SetCacheMaxEntries sets the entry budget of the local FSDB in cache mode.
+	SetCacheMaxEntries(entries int) OptionsBuilder
 }
 
 type options struct {
 	delay    time.Duration
+	minAge   time.Duration
+	queueDir string
 	threads  int
+	batch    int
+	reap     time.Duration
 	logger   *log.Logger
 	lock     bool
 	nameFunc func(fsdb.Key) string
 	skipFunc func(fsdb.Key) bool
+	codec    codec.Codec
+	codecs   []codec.Codec
+	policy   codec.Policy
+	enc      *crypt.Encryptor
+	encOnly  bool
+
+	cache        CachePolicy
+	cacheBytes   int64
+	cacheEntries int
 }
 
 // NewDefaultOptions creates the default options.
 func NewDefaultOptions() OptionsBuilder {
 	return &options{
 		delay:    DefaultUploadDelay,
+		minAge:   DefaultUploadMinAge,
 		threads:  DefaultUploadThreadNum,
+		batch:    DefaultBatchThreadNum,
+		reap:     DefaultReapInterval,
 		logger:   nil,
 		lock:     DefaultUseLock,
 		nameFunc: DefaultNameFunc,
 		skipFunc: DefaultSkipFunc,
+		codec:    DefaultCodec,
+		policy:   DefaultCompressionPolicy,
+
+		cache:        DefaultCachePolicy,
+		cacheBytes:   DefaultCacheMaxBytes,
+		cacheEntries: DefaultCacheMaxEntries,
 	}
 }
 
@@ -122,10 +360,26 @@ func (opt *options) GetUploadDelay() time.Duration {
 	return opt.delay
 }
 
+func (opt *options) GetUploadMinAge() time.Duration {
+	return opt.minAge
+}
+
+func (opt *options) GetUploadQueueDir() string {
+	return opt.queueDir
+}
+
 func (opt *options) GetUploadThreadNum() int {
 	return opt.threads
 }
 
+func (opt *options) GetBatchThreadNum() int {
+	return opt.batch
+}
+
+func (opt *options) GetReapInterval() time.Duration {
+	return opt.reap
+}
+
 func (opt *options) GetUseLock() bool {
 	return opt.lock
 }
@@ -138,6 +392,39 @@ func (opt *options) GetRemoteName(key fsdb.Key) string {
 	return opt.nameFunc(key)
 }
 
+func (opt *options) GetCodec() codec.Codec {
+	return opt.codec
+}
+
+func (opt *options) GetCodecs() []codec.Codec {
+	codecs := append([]codec.Codec{opt.codec}, opt.codecs...)
+	return append(codecs, codec.Builtins()...)
+}
+
+func (opt *options) GetCompressionPolicy() codec.Policy {
+	return opt.policy
+}
+
+func (opt *options) GetEncryptor() *crypt.Encryptor {
+	return opt.enc
+}
+
+func (opt *options) GetRequireEncryption() bool {
+	return opt.encOnly
+}
+
+func (opt *options) GetCachePolicy() CachePolicy {
+	return opt.cache
+}
+
+func (opt *options) GetCacheMaxBytes() int64 {
+	return opt.cacheBytes
+}
+
+func (opt *options) GetCacheMaxEntries() int {
+	return opt.cacheEntries
+}
+
 func (opt *options) SkipKey(key fsdb.Key) bool {
 	return opt.skipFunc(key)
 }
@@ -151,11 +438,31 @@ func (opt *options) SetUploadDelay(delay time.Duration) OptionsBuilder {
 	return opt
 }
 
+func (opt *options) SetUploadMinAge(age time.Duration) OptionsBuilder {
+	opt.minAge = age
+	return opt
+}
+
+func (opt *options) SetUploadQueueDir(dir string) OptionsBuilder {
+	opt.queueDir = dir
+	return opt
+}
+
 func (opt *options) SetUploadThreadNum(threads int) OptionsBuilder {
 	opt.threads = threads
 	return opt
 }
 
+func (opt *options) SetBatchThreadNum(threads int) OptionsBuilder {
+	opt.batch = threads
+	return opt
+}
+
+func (opt *options) SetReapInterval(interval time.Duration) OptionsBuilder {
+	opt.reap = interval
+	return opt
+}
+
 func (opt *options) SetUseLock(lock bool) OptionsBuilder {
 	opt.lock = lock
 	return opt
@@ -171,6 +478,46 @@ func (opt *options) SetRemoteNameFunc(f func(fsdb.Key) string) OptionsBuilder {
 	return opt
 }
 
+func (opt *options) SetCodec(c codec.Codec) OptionsBuilder {
+	opt.codec = c
+	return opt
+}
+
+func (opt *options) RegisterCodecs(codecs ...codec.Codec) OptionsBuilder {
+	opt.codecs = append(opt.codecs, codecs...)
+	return opt
+}
+
+func (opt *options) SetCompressionPolicy(p codec.Policy) OptionsBuilder {
+	opt.policy = p
+	return opt
+}
+
+func (opt *options) SetEncryptor(e *crypt.Encryptor) OptionsBuilder {
+	opt.enc = e
+	return opt
+}
+
+func (opt *options) SetRequireEncryption(require bool) OptionsBuilder {
+	opt.encOnly = require
+	return opt
+}
+
+func (opt *options) SetCachePolicy(policy CachePolicy) OptionsBuilder {
+	opt.cache = policy
+	return opt
+}
+
+func (opt *options) SetCacheMaxBytes(bytes int64) OptionsBuilder {
+	opt.cacheBytes = bytes
+	return opt
+}
+
+func (opt *options) SetCacheMaxEntries(entries int) OptionsBuilder {
+	opt.cacheEntries = entries
+	return opt
+}
+
 func (opt *options) SetSkipFunc(f func(fsdb.Key) bool) {
 	opt.skipFunc = f
 }
@@ -0,0 +1,330 @@
+package hybrid
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fishy/rowlock"
+
+	"github.com/fishy/fsdb"
+	"github.com/fishy/fsdb/crypt"
+)
+
+// uploadQueue is the queue of the written keys waiting to be uploaded,
+// oldest first.
+//
+// A key is only queued once.
+// Queuing it again moves it to the back with the new time.
+//
+// Every push of a key gets a new generation.
+// The generation of the last push is kept after the key is popped,
+// until an upload covering it is done,
+// so that a key queued again during an upload is not removed by that upload.
+//
+// When persisted,
+// every queued key is also stored as a file named by the hash of the key under
+// the queue directory,
+// with the queued time as its modification time.
+// The content of the file is the key, encrypted if an encryptor is set.
+// The file is kept until the key is uploaded,
+// so that keys popped but not uploaded before a crash are queued again on the
+// next Open.
+// The files are written and removed outside of the lock of the queue,
+// serialized per key by the file lock instead.
+type uploadQueue struct {
+	dir   string
+	enc   *crypt.Encryptor
+	files *rowlock.RowLock
+
+	lock sync.Mutex
+	list *list.List
+	keys map[string]*list.Element
+	// gens are the generations of the last pushes of the keys not uploaded yet,
+	// including the popped ones.
+	gens map[string]uint64
+	gen  uint64
+
+	// wake is signaled when a key is queued,
+	// so that the upload loop waiting on an empty queue is woken up.
+	wake chan struct{}
+}
+
+type queuedKey struct {
+	key    fsdb.Key
+	queued time.Time
+	gen    uint64
+}
+
+// newUploadQueue creates an upload queue persisted into dir,
+// or only kept in memory if dir is empty.
+// The persisted keys are encrypted by e if it's non-nil.
+//
+// The keys persisted in dir are loaded into the queue.
+// Invalid files, e.g. partially written ones by a crash, are removed.
+// Encrypted files are skipped if e is nil.
+//
+// If dir cannot be read,
+// it returns the error along with a queue only kept in memory.
+func newUploadQueue(dir string, e *crypt.Encryptor) (*uploadQueue, error) {
+	q := &uploadQueue{
+		enc:   e,
+		files: rowlock.NewRowLock(rowlock.MutexNewLocker),
+		list:  list.New(),
+		keys:  make(map[string]*list.Element),
+		gens:  make(map[string]uint64),
+		wake:  make(chan struct{}, 1),
+	}
+	if dir == "" {
+		return q, nil
+	}
+	dir = filepath.Clean(dir) + string(filepath.Separator)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return q, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return q, err
+	}
+	q.dir = dir
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	for _, info := range infos {
+		content, err := ioutil.ReadFile(q.dir + info.Name())
+		if err != nil {
+			continue
+		}
+		key := fsdb.Key(content)
+		if crypt.IsEncrypted(content) {
+			if q.enc == nil {
+				continue
+			}
+			key, err = q.enc.Decrypt(content)
+		}
+		if err != nil || q.filename(key) != info.Name() {
+			os.Remove(q.dir + info.Name())
+			continue
+		}
+		q.gen++
+		q.keys[string(key)] = q.list.PushBack(&queuedKey{
+			key:    key,
+			queued: info.ModTime(),
+			gen:    q.gen,
+		})
+		q.gens[string(key)] = q.gen
+	}
+	return q, nil
+}
+
+// filename returns the filename of the persisted key under the queue
+// directory.
+func (q *uploadQueue) filename(key fsdb.Key) string {
+	hash := sha512.Sum512_224(key)
+	return hex.EncodeToString(hash[:])
+}
+
+// push queues the key at now.
+//
+// The key is queued in memory even if it failed to be persisted.
+func (q *uploadQueue) push(key fsdb.Key, now time.Time) error {
+	q.lock.Lock()
+	if elem, ok := q.keys[string(key)]; ok {
+		q.list.Remove(elem)
+	}
+	q.gen++
+	gen := q.gen
+	q.keys[string(key)] = q.list.PushBack(&queuedKey{
+		key:    key,
+		queued: now,
+		gen:    gen,
+	})
+	q.gens[string(key)] = gen
+	select {
+	default:
+	case q.wake <- struct{}{}:
+	}
+	q.lock.Unlock()
+
+	if q.dir == "" {
+		return nil
+	}
+	q.files.Lock(string(key))
+	defer q.files.Unlock(string(key))
+	if q.current(key) != gen {
+		// Already persisted by a newer push, or uploaded.
+		return nil
+	}
+	content := []byte(key)
+	if q.enc != nil {
+		var err error
+		if content, err = q.enc.Encrypt(key); err != nil {
+			return err
+		}
+	}
+	path := q.dir + q.filename(key)
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		return err
+	}
+	return os.Chtimes(path, now, now)
+}
+
+// pop pops the oldest key with its generation,
+// if it's queued for at least minAge at now.
+//
+// Otherwise it returns false,
+// with how long to wait until the oldest key is old enough,
+// or a negative duration if the queue is empty.
+func (q *uploadQueue) pop(now time.Time, minAge time.Duration) (
+	key fsdb.Key,
+	gen uint64,
+	wait time.Duration,
+	ok bool,
+) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	front := q.list.Front()
+	if front == nil {
+		return nil, 0, -1, false
+	}
+	queued := front.Value.(*queuedKey)
+	if wait = queued.queued.Add(minAge).Sub(now); wait > 0 {
+		return nil, 0, wait, false
+	}
+	q.list.Remove(front)
+	delete(q.keys, string(queued.key))
+	return queued.key, queued.gen, 0, true
+}
+
+// current returns the generation of the last push of the key,
+// or 0 if it's not queued nor waiting for its upload.
+func (q *uploadQueue) current(key fsdb.Key) uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.gens[string(key)]
+}
+
+// remove removes the key from the queue and its persisted file,
+// if it's not pushed again since the generation.
+//
+// It's called after an upload of the key covering the generation succeeded or
+// was skipped.
+func (q *uploadQueue) remove(key fsdb.Key, gen uint64) error {
+	q.lock.Lock()
+	if gen == 0 || q.gens[string(key)] != gen {
+		q.lock.Unlock()
+		return nil
+	}
+	delete(q.gens, string(key))
+	if elem, ok := q.keys[string(key)]; ok {
+		q.list.Remove(elem)
+		delete(q.keys, string(key))
+	}
+	q.lock.Unlock()
+
+	if q.dir == "" {
+		return nil
+	}
+	q.files.Lock(string(key))
+	defer q.files.Unlock(string(key))
+	if q.current(key) != 0 {
+		// Pushed again since, the file belongs to the new push.
+		return nil
+	}
+	err := os.Remove(q.dir + q.filename(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// len returns the number of queued keys.
+func (q *uploadQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.list.Len()
+}
+
+func (db *impl) QueueDepth() int {
+	return db.queue.len()
+}
+
+// enqueue queues the key written locally into the upload queue,
+// unless it's skipped by the skip function.
+//
+// Failures to persist the queue are only logged,
+// as the key will still be uploaded by either the queue in memory or the
+// scan loop.
+func (db *impl) enqueue(key fsdb.Key) {
+	if db.opts.SkipKey(key) {
+		return
+	}
+	if err := db.queue.push(key, time.Now()); err != nil {
+		if logger := db.opts.GetLogger(); logger != nil {
+			logger.Printf("failed to persist %v into upload queue: %v", key, err)
+		}
+	}
+}
+
+// dequeue removes the key from the upload queue after an upload covering the
+// generation succeeded or was skipped.
+func (db *impl) dequeue(key fsdb.Key, gen uint64) {
+	if err := db.queue.remove(key, gen); err != nil {
+		if logger := db.opts.GetLogger(); logger != nil {
+			logger.Printf("failed to remove %v from upload queue: %v", key, err)
+		}
+	}
+}
+
+// startQueueLoop sends the keys in the upload queue to the upload workers
+// once they are queued for the minimum upload age,
+// until ctx is canceled or db is closed.
+func (db *impl) startQueueLoop(ctx context.Context, jobs chan<- uploadJob) {
+	minAge := db.opts.GetUploadMinAge()
+	for {
+		key, gen, wait, ok := db.queue.pop(time.Now(), minAge)
+		if !ok {
+			if !db.waitQueue(ctx, wait) {
+				return
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-db.stop:
+			return
+		case jobs <- uploadJob{key: key, queued: true, gen: gen}:
+		}
+	}
+}
+
+// waitQueue waits for the duration, or until a new key is queued.
+//
+// Negative wait means to wait only for a new key.
+// It returns false if ctx is canceled or db is closed during the wait.
+func (db *impl) waitQueue(ctx context.Context, wait time.Duration) bool {
+	var due <-chan time.Time
+	if wait >= 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		due = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-db.stop:
+		return false
+	case <-db.queue.wake:
+	case <-due:
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package fsdb
+
+import (
+	"context"
+	"time"
+)
+
+// Location defines where an entry is stored.
+//
+// Location values are bit flags and can be combined.
+type Location int
+
+// Location values.
+const (
+	LocationLocal Location = 1 << iota
+	LocationRemote
+
+	LocationBoth = LocationLocal | LocationRemote
+)
+
+func (loc Location) String() string {
+	switch loc {
+	default:
+		return "unknown"
+	case LocationLocal:
+		return "local"
+	case LocationRemote:
+		return "remote"
+	case LocationBoth:
+		return "both"
+	}
+}
+
+// EntryInfo defines the metadata of an entry, returned by Stat.
+type EntryInfo struct {
+	// Size is the size of the stored data in bytes,
+	// after compression if the entry is compressed.
+	//
+	// It's -1 if unknown.
+	Size int64
+
+	// LogicalSize is the size of the uncompressed data in bytes.
+	//
+	// It's -1 if it cannot be known without reading the whole entry.
+	LogicalSize int64
+
+	// ModTime is the last modification time of the entry.
+	ModTime time.Time
+
+	// Compressed reports whether the stored data is compressed.
+	//
+	// It's false if it cannot be known without reading the entry,
+	// e.g. for entries only stored in the remote bucket of a hybrid FSDB.
+	Compressed bool
+
+	// Location reports where the entry is stored.
+	Location Location
+
+	// ETag is an opaque string that changes when the content of the entry
+	// changes.
+	//
+	// It's empty if unknown.
+	ETag string
+
+	// Expires is the time the entry expires.
+	//
+	// It's zero if the entry never expires.
+	Expires time.Time
+
+	// Metadata is the user-defined metadata of the entry,
+	// written by WriteWithOptions.
+	//
+	// It's nil if the entry has no metadata.
+	Metadata map[string]string
+}
+
+// Exists checks whether a key exists in an FSDB, using its Stat function.
+func Exists(ctx context.Context, db FSDB, key Key) (bool, error) {
+	_, err := db.Stat(ctx, key)
+	if err == nil {
+		return true, nil
+	}
+	if IsNoSuchKeyError(err) {
+		return false, nil
+	}
+	return false, err
+}
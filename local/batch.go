@@ -0,0 +1,23 @@
+package local
+
+import (
+	"context"
+	"io"
+
+	"github.com/fishy/fsdb"
+)
+
+func (db *impl) ReadMany(
+	ctx context.Context,
+	keys []fsdb.Key,
+) ([]io.ReadCloser, error) {
+	return fsdb.ReadMany(ctx, keys, db.opts.GetBatchThreadNum(), db.Read)
+}
+
+func (db *impl) WriteMany(ctx context.Context, entries []fsdb.Entry) error {
+	return fsdb.WriteMany(ctx, entries, db.opts.GetBatchThreadNum(), db.Write)
+}
+
+func (db *impl) DeleteMany(ctx context.Context, keys []fsdb.Key) error {
+	return fsdb.DeleteMany(ctx, keys, db.opts.GetBatchThreadNum(), db.Delete)
+}
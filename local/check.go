@@ -0,0 +1,600 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fishy/errbatch"
+
+	"github.com/fishy/fsdb"
+	"github.com/fishy/fsdb/codec"
+	"github.com/fishy/fsdb/crypt"
+)
+
+var errNotStale = errors.New("fsdb/local: not stale yet")
+
+// ProblemType is the type of a problem found by Check.
+type ProblemType int
+
+// ProblemType values.
+const (
+	// ProblemHashMismatch means the entry directory does not match the hash of
+	// the key in its key file.
+	//
+	// Repair moves the entry into the right directory,
+	// or removes it if the right directory already has an entry.
+	// It fails instead if either directory contains the other,
+	// which usually means the collision slots option doesn't match the FSDB.
+	ProblemHashMismatch ProblemType = iota
+
+	// ProblemDuplicateData means the entry has more than one data files
+	// (e.g. both data and data.gz).
+	//
+	// Repair keeps the one matching the ETag in the meta file
+	// (or the newest one if none matches), and removes the others.
+	ProblemDuplicateData
+
+	// ProblemMissingData means the entry has the key file but no data file.
+	//
+	// Repair removes the entry.
+	ProblemMissingData
+
+	// ProblemCorruptGzip means the compressed data file of the entry can't be
+	// decompressed,
+	// or the encrypted data file of the entry can't be decrypted.
+	//
+	// Despite the name, it's reported for all the codecs, not only gzip.
+	//
+	// Repair removes the entry, as its data is already lost.
+	ProblemCorruptGzip
+
+	// ProblemStrayFile means the file or directory does not belong to the
+	// layout under the data directory,
+	// including the files left by writes interrupted before moving the key
+	// files.
+	//
+	// Repair removes them,
+	// but the files left by interrupted writes are only removed when their
+	// entry directories are stale.
+	ProblemStrayFile
+
+	// ProblemTempDirLeak means the temp directory is stale.
+	//
+	// Repair recovers then removes it, as Recover does.
+	ProblemTempDirLeak
+
+	// ProblemChecksumMismatch means the data of the entry does not match the
+	// checksum stored in the meta file.
+	//
+	// Repair removes the entry, as its data is already lost.
+	ProblemChecksumMismatch
+
+	// ProblemCorruptKey means the encrypted key file of the entry can't be
+	// decrypted, e.g. it's truncated.
+	//
+	// Repair removes the entry, as it can't be read or written without the key.
+	ProblemCorruptKey
+)
+
+func (t ProblemType) String() string {
+	switch t {
+	default:
+		return "unknown"
+	case ProblemHashMismatch:
+		return "hash-mismatch"
+	case ProblemDuplicateData:
+		return "duplicate-data"
+	case ProblemMissingData:
+		return "missing-data"
+	case ProblemCorruptGzip:
+		return "corrupt-gzip"
+	case ProblemStrayFile:
+		return "stray-file"
+	case ProblemTempDirLeak:
+		return "temp-dir-leak"
+	case ProblemChecksumMismatch:
+		return "checksum-mismatch"
+	case ProblemCorruptKey:
+		return "corrupt-key"
+	}
+}
+
+// ProblemTypes are all the problem types reported by Check, in order.
+var ProblemTypes = []ProblemType{
+	ProblemHashMismatch,
+	ProblemDuplicateData,
+	ProblemMissingData,
+	ProblemCorruptGzip,
+	ProblemStrayFile,
+	ProblemTempDirLeak,
+	ProblemChecksumMismatch,
+	ProblemCorruptKey,
+}
+
+// Problem is a problem found by Check.
+type Problem struct {
+	Type ProblemType
+
+	// Path is the path of the entry directory, file or temp directory.
+	Path string
+
+	// Err is the error caused the problem, if any.
+	Err error
+
+	// Repaired is true if the problem is repaired.
+	Repaired bool
+
+	// RepairErr is the error returned by the repair, if any.
+	RepairErr error
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%v: %s", p.Type, p.Path)
+	if p.Err != nil {
+		s += fmt.Sprintf(": %v", p.Err)
+	}
+	if p.Repaired {
+		s += " (repaired)"
+	} else if p.RepairErr != nil {
+		s += fmt.Sprintf(" (repair failed: %v)", p.RepairErr)
+	}
+	return s
+}
+
+// CheckOptions defines the options used by Check.
+type CheckOptions struct {
+	// Repair makes Check repair the problems found.
+	//
+	// See ProblemType values for what repair does on each of them.
+	Repair bool
+
+	// Quick makes Check skip reading the data files,
+	// so corrupt compressed data and checksum mismatches are not detected.
+	Quick bool
+}
+
+// CheckResult is the result of Check.
+type CheckResult struct {
+	// Entries is the number of entries checked.
+	Entries int64
+
+	// Problems are the problems found.
+	Problems []Problem
+}
+
+// Count returns the number of problems of the type found and repaired.
+func (r *CheckResult) Count(t ProblemType) (found, repaired int) {
+	for _, p := range r.Problems {
+		if p.Type != t {
+			continue
+		}
+		found++
+		if p.Repaired {
+			repaired++
+		}
+	}
+	return
+}
+
+type checker struct {
+	db     *impl
+	opts   CheckOptions
+	result *CheckResult
+
+	// relocated are the entry directories repaired by relocating,
+	// so they won't be checked again if the walk reaches them later.
+	relocated map[string]bool
+
+	// dataFiles are the filenames of the data files of all the codecs.
+	dataFiles map[string]bool
+}
+
+// Check walks the FSDB with the given options,
+// and reports the problems found.
+//
+// It's heavy on IO and takes a long time.
+// In repair mode,
+// it should only run when no one else is using the same FSDB.
+//
+// Check only reports the problems it can tell from the data on disk.
+// Entries it can't check because of the options,
+// e.g. encrypted ones when no encryptor is set or the key is unknown,
+// or data files of codecs not registered,
+// make it stop and return the error instead,
+// so the options must match the ones used by the FSDB.
+//
+// When an error is returned,
+// the result contains the problems found before the error.
+func Check(ctx context.Context, opts Options, checkOpts CheckOptions) (*CheckResult, error) {
+	db := &impl{
+		opts:  opts,
+		locks: newRowLock(),
+	}
+	c := &checker{
+		db:        db,
+		opts:      checkOpts,
+		result:    new(CheckResult),
+		relocated: make(map[string]bool),
+		dataFiles: make(map[string]bool),
+	}
+	for _, filename := range db.dataFilenames() {
+		c.dataFiles[filename] = true
+	}
+	if err := c.checkTempDirs(ctx); err != nil {
+		return c.result, err
+	}
+	root := opts.GetRootDataDir()
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		// Empty FSDB.
+		return c.result, nil
+	}
+	if err := c.checkDir(ctx, root); err != nil {
+		return c.result, err
+	}
+	return c.result, nil
+}
+
+// report adds a problem to the result,
+// and calls repair on it in repair mode.
+func (c *checker) report(t ProblemType, path string, err error, repair func() error) {
+	p := Problem{
+		Type: t,
+		Path: path,
+		Err:  err,
+	}
+	if c.opts.Repair {
+		p.RepairErr = repair()
+		p.Repaired = p.RepairErr == nil
+	}
+	c.result.Problems = append(c.result.Problems, p)
+}
+
+// stray reports a stray file or directory.
+func (c *checker) stray(path string) {
+	c.report(ProblemStrayFile, path, nil, func() error {
+		return os.RemoveAll(path)
+	})
+}
+
+func (c *checker) checkTempDirs(ctx context.Context) error {
+	dirs, err := c.db.staleTempDirs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		dir := dir
+		c.report(ProblemTempDirLeak, dir, nil, func() error {
+			return c.db.recoverTempDir(dir)
+		})
+	}
+	return nil
+}
+
+// checkDir checks dir under the root data directory recursively.
+func (c *checker) checkDir(ctx context.Context, dir string) error {
+	select {
+	default:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if c.isEntryDir(infos) {
+		if c.relocated[dir] {
+			return nil
+		}
+		return c.checkEntry(dir, infos)
+	}
+	for _, info := range infos {
+		path := dir + info.Name()
+		if !info.IsDir() {
+			c.stray(path)
+			continue
+		}
+		if err := c.checkDir(ctx, path+PathSeparator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isEntryDir returns true if the directory contains any files belong to an
+// entry directory.
+func (c *checker) isEntryDir(infos []os.FileInfo) bool {
+	for _, info := range infos {
+		switch name := info.Name(); name {
+		case KeyFilename,
+			MetaFilename,
+			MetadataFilename,
+			VersionsDirname:
+			return true
+		default:
+			if c.dataFiles[name] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkEntry checks the entry directory.
+//
+// Noncurrent versions are not checked.
+func (c *checker) checkEntry(dir string, infos []os.FileInfo) error {
+	files := make(map[string]bool)
+	for _, info := range infos {
+		name := info.Name()
+		switch {
+		default:
+			c.stray(dir + name)
+		case strings.HasPrefix(name, DataFilename+".") && !c.dataFiles[name]:
+			return fmt.Errorf(
+				"fsdb/local: data file %s of unknown codec",
+				dir+name,
+			)
+		case name == KeyFilename,
+			name == MetaFilename,
+			name == MetadataFilename,
+			c.dataFiles[name]:
+			if info.IsDir() {
+				c.stray(dir + name)
+				continue
+			}
+			files[name] = true
+		case name == VersionsDirname:
+			if !info.IsDir() {
+				c.stray(dir + name)
+			}
+		}
+	}
+
+	if !files[KeyFilename] {
+		if len(files) > 0 {
+			// Left by a write interrupted before moving the key file.
+			c.report(ProblemStrayFile, dir, nil, func() error {
+				info, err := os.Lstat(dir)
+				if err != nil {
+					return err
+				}
+				if !c.db.isStale(info.ModTime()) {
+					return errNotStale
+				}
+				return c.db.removeUncommitted(dir)
+			})
+		}
+		return nil
+	}
+
+	c.result.Entries++
+	key, err := c.db.readKey(dir + KeyFilename)
+	if err == crypt.ErrDecrypt {
+		c.report(ProblemCorruptKey, dir+KeyFilename, err, func() error {
+			// Without the key there's no row lock or key index to update.
+			return os.RemoveAll(dir)
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	meta, err := readMeta(dir)
+	if err != nil {
+		return err
+	}
+	if err := c.db.checkDecrypt(meta); err != nil {
+		return err
+	}
+	remove := func() error {
+		return c.db.removeEntry(key, dir)
+	}
+
+	// In the order Read looks for them.
+	var codecs []codec.Codec
+	for _, dc := range c.db.opts.GetCodecs() {
+		if files[dataFilename(dc)] {
+			codecs = append(codecs, dc)
+		}
+	}
+	switch {
+	case len(codecs) == 0:
+		c.report(ProblemMissingData, dir, nil, remove)
+		return nil
+	case len(codecs) > 1:
+		c.report(ProblemDuplicateData, dir, nil, func() error {
+			kept, err := c.db.dedupData(dir, codecs)
+			if err == nil {
+				codecs = []codec.Codec{kept}
+			}
+			return err
+		})
+	}
+
+	if !c.opts.Quick {
+		// The same data file Read would choose.
+		dataCodec := codecs[0]
+		err := c.db.verifyData(key, dir)
+		switch {
+		case err == nil:
+		case fsdb.IsChecksumMismatchError(err):
+			c.report(ProblemChecksumMismatch, dir, err, remove)
+		case isCorruptData(err, dataCodec):
+			c.report(ProblemCorruptGzip, dir+dataFilename(dataCodec), err, remove)
+		default:
+			return err
+		}
+		if err != nil && c.opts.Repair {
+			return nil
+		}
+	}
+
+	if !c.db.isEntryDirOf(key, dir) {
+		c.report(ProblemHashMismatch, dir, nil, func() error {
+			expected, err := c.db.relocateEntry(key, dir)
+			c.relocated[expected] = true
+			return err
+		})
+	}
+	return nil
+}
+
+// checkDecrypt returns the error if the data file encrypted per meta can't be
+// decrypted with the options,
+// e.g. no encryptor is set or the key is unknown.
+func (db *impl) checkDecrypt(meta *entryMeta) error {
+	if meta.KeyID == "" {
+		return nil
+	}
+	e := db.opts.GetEncryptor()
+	if e == nil {
+		return errNoEncryptor
+	}
+	return e.CheckKey(meta.KeyID)
+}
+
+// isCorruptData returns true if the error returned by verifyData means the data
+// file of the codec is corrupt.
+//
+// I/O errors are not, as the data file might be intact.
+func isCorruptData(err error, c codec.Codec) bool {
+	if err == crypt.ErrDecrypt {
+		return true
+	}
+	if _, ok := err.(*os.PathError); ok {
+		return false
+	}
+	return c.Suffix() != ""
+}
+
+// verifyData reads the data file under dir fully as Read does,
+// to verify the checksum.
+func (db *impl) verifyData(key fsdb.Key, dir string) error {
+	meta, err := readMeta(dir)
+	if err != nil {
+		return err
+	}
+	reader, err := db.openData(dir, meta)
+	if err != nil {
+		return err
+	}
+	reader = verifyChecksum(reader, key, meta)
+	defer reader.Close()
+	_, err = io.Copy(ioutil.Discard, reader)
+	return err
+}
+
+// removeEntry removes the entry directory of the key.
+func (db *impl) removeEntry(key fsdb.Key, dir string) error {
+	db.locks.Lock(string(key))
+	defer db.locks.Unlock(string(key))
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if db.opts.GetUseKeyIndex() {
+		return db.removeIndex(key)
+	}
+	return nil
+}
+
+// dedupData removes all but one of the data files of the codecs under dir,
+// and returns the codec of the one kept.
+//
+// The one matching the ETag in meta file is kept.
+// If none matches,
+// the newest one of the readable ones is kept.
+func (db *impl) dedupData(dir string, codecs []codec.Codec) (codec.Codec, error) {
+	meta, err := readMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	var keep codec.Codec
+	var keepModTime int64
+	for _, c := range codecs {
+		etag, err := db.dataETag(dir, c, meta)
+		if err != nil {
+			continue
+		}
+		if meta.ETag != "" && etag == meta.ETag {
+			keep = c
+			break
+		}
+		info, err := os.Lstat(dir + dataFilename(c))
+		if err != nil {
+			return nil, err
+		}
+		if modTime := info.ModTime().UnixNano(); keep == nil || modTime > keepModTime {
+			keep = c
+			keepModTime = modTime
+		}
+	}
+	if keep == nil {
+		// None is readable, keep the first one.
+		keep = codecs[0]
+	}
+	var errs errbatch.ErrBatch
+	for _, c := range codecs {
+		if c.Suffix() != keep.Suffix() {
+			errs.Add(os.Remove(dir + dataFilename(c)))
+		}
+	}
+	return keep, errs.Compile()
+}
+
+// relocateEntry moves the entry of the key from dir into the expected
+// directory,
+// or removes it if the expected directory already has the key file.
+//
+// It fails if either directory contains the other,
+// e.g. when the collision slots option doesn't match the FSDB,
+// as the relocation would remove other entries.
+// It also fails before moving anything if the key is too long for the key
+// index.
+//
+// The expected directory is returned.
+func (db *impl) relocateEntry(key fsdb.Key, dir string) (expected string, err error) {
+	if err := db.checkIndexKey(key); err != nil {
+		return "", err
+	}
+	db.locks.Lock(string(key))
+	defer db.locks.Unlock(string(key))
+	unlock := db.lockSlots(key)
+	defer unlock()
+	expected = db.opts.GetDirForKey(key)
+	if db.opts.GetUseCollisionSlots() {
+		if expected, err = db.allocEntry(key); err != nil {
+			return expected, err
+		}
+	}
+	if strings.HasPrefix(dir, expected) || strings.HasPrefix(expected, dir) {
+		return expected, fmt.Errorf(
+			"fsdb/local: can't relocate %s into %s, check collision slots option",
+			dir,
+			expected,
+		)
+	}
+	if _, err := os.Lstat(expected + KeyFilename); err == nil {
+		return expected, os.RemoveAll(dir)
+	}
+	// Anything left in the expected directory is from interrupted writes.
+	if err := os.RemoveAll(expected); err != nil {
+		return expected, err
+	}
+	if err := mkdirAll(filepath.Dir(filepath.Clean(expected)), false); err != nil {
+		return expected, err
+	}
+	if err := os.Rename(dir, expected); err != nil {
+		return expected, err
+	}
+	if db.opts.GetUseKeyIndex() {
+		return expected, db.addIndex(key)
+	}
+	return expected, nil
+}
@@ -0,0 +1,281 @@
+package local
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fishy/fsdb"
+)
+
+// scrubChunkSize is the size of each read by the scrubber.
+const scrubChunkSize = 64 * 1024
+
+// newChecksum returns the name and a new hash of the checksum algorithm.
+//
+// Unknown algorithms fall back to crc32c.
+func newChecksum(algo ChecksumAlgorithm) (string, hash.Hash) {
+	if algo == ChecksumSHA256 {
+		return algo.String(), sha256.New()
+	}
+	return ChecksumCRC32C.String(), crc32.New(crc32cTable)
+}
+
+// formatChecksum formats the checksum as "<algorithm>:<hex>".
+func formatChecksum(name string, h hash.Hash) string {
+	return name + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// etagChecksum returns the crc32c checksum in the ETag,
+// in the same format as formatChecksum,
+// or empty string if the ETag is empty or malformed.
+func etagChecksum(etag string) string {
+	i := strings.Index(etag, "-")
+	if i != 8 {
+		return ""
+	}
+	return ChecksumCRC32C.String() + ":" + etag[:i]
+}
+
+// checksumReader verifies the checksum of the data read at EOF.
+type checksumReader struct {
+	io.ReadCloser
+
+	key      fsdb.Key
+	name     string
+	hash     hash.Hash
+	expected string
+	err      error
+}
+
+// verifyChecksum wraps reader to verify the checksum stored in meta,
+// or the crc32c in the ETag if there's no checksum stored.
+//
+// If meta has neither (entries written by older versions),
+// or the checksum algorithm is unknown,
+// reader is returned as-is.
+func verifyChecksum(
+	reader io.ReadCloser,
+	key fsdb.Key,
+	meta *entryMeta,
+) io.ReadCloser {
+	expected := meta.Checksum
+	if expected == "" {
+		expected = etagChecksum(meta.ETag)
+	}
+	for _, algo := range []ChecksumAlgorithm{ChecksumCRC32C, ChecksumSHA256} {
+		if !strings.HasPrefix(expected, algo.String()+":") {
+			continue
+		}
+		name, h := newChecksum(algo)
+		r := &checksumReader{
+			ReadCloser: reader,
+			key:        key,
+			name:       name,
+			hash:       h,
+			expected:   expected,
+		}
+		if file, ok := reader.(*os.File); ok {
+			return &seekableChecksumReader{
+				checksumReader: r,
+				file:           file,
+			}
+		}
+		return r
+	}
+	return reader
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.ReadCloser.Read(p)
+	if r.hash == nil {
+		return n, err
+	}
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if actual := formatChecksum(r.name, r.hash); actual != r.expected {
+			r.err = &fsdb.ChecksumMismatchError{
+				Key:      r.key,
+				Expected: r.expected,
+				Actual:   actual,
+			}
+			return n, r.err
+		}
+	}
+	return n, err
+}
+
+// Close closes the underlying reader,
+// and returns the ChecksumMismatchError if it's already returned by Read.
+func (r *checksumReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
+
+// seekableChecksumReader is a checksumReader on uncompressed data files,
+// which keeps the io.Seeker and io.ReaderAt implementations of *os.File.
+//
+// Reads via ReadAt are not verified.
+type seekableChecksumReader struct {
+	*checksumReader
+
+	file *os.File
+}
+
+// Seek seeks the data file.
+//
+// Seeking to anywhere other than the beginning disables the verification,
+// as the data is no longer read sequentially.
+func (r *seekableChecksumReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.file.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	if r.hash != nil {
+		if pos == 0 {
+			r.hash.Reset()
+		} else {
+			r.hash = nil
+		}
+	}
+	return pos, nil
+}
+
+func (r *seekableChecksumReader) ReadAt(p []byte, off int64) (int, error) {
+	return r.file.ReadAt(p, off)
+}
+
+func (db *impl) Scrub(
+	ctx context.Context,
+	bytesPerSecond int64,
+	badFunc func(key fsdb.Key, err error),
+) error {
+	limiter := &rateLimiter{
+		rate:    bytesPerSecond,
+		started: time.Now(),
+	}
+	if err := db.ScanKeys(
+		ctx,
+		func(key fsdb.Key) bool {
+			err := db.scrubKey(ctx, key, limiter)
+			if err == nil {
+				return true
+			}
+			select {
+			default:
+			case <-ctx.Done():
+				return false
+			}
+			if badFunc != nil {
+				badFunc(key, err)
+			}
+			return true
+		},
+		fsdb.IgnoreAll,
+	); err != nil {
+		return err
+	}
+
+	select {
+	default:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// scrubKey reads the entry of the key fully to verify its checksum.
+func (db *impl) scrubKey(
+	ctx context.Context,
+	key fsdb.Key,
+	limiter *rateLimiter,
+) error {
+	reader, err := db.Read(ctx, key)
+	if fsdb.IsNoSuchKeyError(err) {
+		// Deleted or expired after scanned.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	buf := make([]byte, scrubChunkSize)
+	for {
+		n, err := reader.Read(buf)
+		if err := limiter.wait(ctx, n); err != nil {
+			return err
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (db *impl) StartScrubber(
+	ctx context.Context,
+	interval time.Duration,
+	bytesPerSecond int64,
+	badFunc func(key fsdb.Key, err error),
+) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// All errors will be retried on next run, safe to ignore.
+				db.Scrub(ctx, bytesPerSecond, badFunc)
+			}
+		}
+	}()
+}
+
+// rateLimiter limits the average rate of bytes read since started.
+type rateLimiter struct {
+	// rate is in bytes per second,
+	// non-positive values mean unlimited.
+	rate    int64
+	started time.Time
+	bytes   int64
+}
+
+// wait records n more bytes read,
+// and blocks until the average rate is within limit.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	l.bytes += int64(n)
+	// Split the calculation to avoid overflow.
+	elapsed := time.Duration(l.bytes/l.rate)*time.Second +
+		time.Duration(l.bytes%l.rate)*time.Second/time.Duration(l.rate)
+	d := time.Until(l.started.Add(elapsed))
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -1,7 +1,8 @@
 // Package local provides an implementation of key-value store on your
 // filesystem.
 //
-// It implements fsdb.Local interface.
+// It implements fsdb.Local interface,
+// with some extra features only available locally defined in DB interface.
 //
 // Layout
 //
@@ -15,21 +16,57 @@
 //           b1/
 //             b0/
 //               e50d74419e2244eaa7328235f71b48c7e1c33b23f6f9517d14/
-//                 key     // Key file
-//                 data    // Data file if no compression
-//                 data.gz // Data file if gzip enabled
+//                 key       // Key file
+//                 meta      // Meta file, containing ETag, etc.
+//                 metadata  // User-defined metadata file, if any
+//                 data      // Data file if no compression
+//                 data.gz   // Data file if gzip enabled
+//                 data.zst  // Data file if zstd enabled, etc.
+//                 versions/ // Noncurrent versions, if versioning enabled
 //
 // There could also be temporary files for unfinished write operations under
 //     <fsdb-root>/_tmp/fsdb_<tmpdir>/
+// and for unfinished transactions under
+//     <fsdb-root>/_tmp/fsdb_txn_<tmpdir>/
 //
 // Both hash function and directory levels are configurable.
 //
+// Two keys with the same hash can't be stored by default,
+// and operations on the second key return KeyCollisionError.
+// With collision slots turned on in options,
+// entries are stored in numbered slot directories under the hashed
+// directory instead:
+//     <fsdb-root>/data/6c/b1/b0/e50d74419e2244eaa7328235f71b48c7e1c33b23f6f9517d14/
+//       0/  // Entry directory of the first key
+//       1/  // Entry directory of a different key with the same hash
+// and the slot of a key is found by comparing the key files under them.
+// Slots freed by deletes are reused by later writes.
+//
 // Atomicity
 //
-// There's no extra locks in the implementation.
 // The atomicity relies on the atomicity guaranteed by your filesystem on
 // operations like move (rename), delete, open, etc.
 //
+// The only lock used in the implementation is a row lock held by write and
+// delete operations while moving files into (or deleting) the entry directory.
+// It makes WriteIf atomic against other operations on the same FSDB.
+// With collision slots,
+// writes also lock the hashed directory while choosing and moving files into
+// the slot.
+// It does not protect operations from other processes sharing the same
+// directories.
+//
+// Durability
+//
+// By default no fsync is called,
+// so a power loss could leave an empty or missing data file even though the
+// write operation returned nil error.
+// Use SyncData or SyncFull sync mode to trade write performance for
+// durability.
+// Run the benchmark mentioned in the Compression section to measure the cost
+// of different sync modes on your filesystem
+// (the sample result there predates sync modes).
+//
 // Read Before Overwriting Finishes on the Same Key
 //
 // If you issue a read operation before an overwrite operation (write operation
@@ -48,25 +85,168 @@
 // Read operations issued before Step 3 will get the old data.
 // Read operations issued after Step 3 will get the new data.
 //
+// For the WriteCloser returned by Create,
+// Step 1 happens in Create, Step 2 happens while writing to it,
+// and Step 3 and 4 happen in Close.
+//
 // Two Write Operations on the Same Key
 //
 // If you issue a write operation before another write operation on the same key
 // finishes, the one that finishes first will be overwritten by the other.
+// Use WriteIf with fsdb.IfMatch to detect such cases.
+//
+// Transactions
+//
+// Txn returned by Begin groups writes and deletes on multiple keys.
+// All the changes are staged under a single temporary directory.
+// On Commit, row locks of all the keys are held,
+// and an intent file listing all the changes is written into the temporary
+// directory before the changes are moved into the entry directories.
+// Read operations also take the row lock briefly while opening the files,
+// so they never see a partially committed transaction.
+//
+// If the process crashed in the middle of a Commit,
+// Open or Recover rolls the transaction forward if the intent file exists,
+// or rolls it back otherwise.
+// If Commit failed after the intent file is written,
+// it returns TxnIncompleteError and keeps the row locks,
+// until Recover finishes applying the transaction.
+//
+// Crash Recovery
+//
+// A write interrupted by a crash leaves its temporary directory behind.
+// If it was interrupted after Step 3 started,
+// the entry directory could also have the new data file without the key file
+// (the key file is always moved last).
+//
+// Open and Recover treat temporary directories not modified for the stale
+// temp dir age set in options as left by crashes.
+// Writes with the data file already moved are finished,
+// unless the entry was overwritten since.
+// Other temporary directories are removed.
+// Recover also removes the files of entries without the key files,
+// when their entry directories are also stale.
+// Scans never remove them, they only skip such entries.
+//
+// Check does a more thorough consistency check, with optional repair.
+// It must use the same options as the FSDB,
+// including the encryptor, hash function and codecs.
+// It's also available as the fsck subcommand of
+// github.com/fishy/fsdb/cmd/fsdb.
+//
+// ETag
+//
+// The ETag of an entry is the crc32c and size of its uncompressed data,
+// stored in the meta file under the entry directory.
+// Entries written by older versions of this package don't have ETags until
+// they are overwritten.
+//
+// Checksums
+//
+// The crc32c in the ETag also serves as the checksum of the uncompressed data
+// by default.
+// When SHA-256 is configured via options,
+// the meta file also stores a SHA-256 checksum.
+// Readers returned by Read verify the checksum when they reach EOF,
+// and return fsdb.ChecksumMismatchError instead of io.EOF on mismatches.
+// Partial reads (e.g. ReadRange not reading till the end) are not verified.
+//
+// Scrub (or StartScrubber in the background) reads all the entries at a
+// bounded rate to detect bit rots before they are read by others.
+//
+// Versioning
+//
+// When versioning is enabled via options,
+// the old value is hard linked (or copied) into
+//     <entry-dir>/versions/<version-id>/
+// before Step 3 in the write sequence,
+// instead of being deleted.
+// Noncurrent versions can be listed, read and restored by ListVersions,
+// ReadVersion and RestoreVersion.
+//
+// Noncurrent versions no longer needed per options are garbage collected
+// after writes on the same key, and along ScanKeys.
+// Delete removes the entry together with all its noncurrent versions.
+//
+// Expiration
+//
+// The expiration time of an entry written by WriteWithOptions with TTL is
+// stored in the meta file.
+// Expired entries are still on the disk until they are deleted by
+// DeleteExpired, which could be called periodically by StartReaper.
+//
+// Ranged Reads
+//
+// For entries stored without compression,
+// the ReadCloser returned by Read also implements io.ReaderAt and io.Seeker.
+//
+// ReadRange seeks directly to the offset on entries stored without
+// compression.
+// For compressed entries it has to decompress and discard the data before
+// offset.
+//
+// Key Index
+//
+// As the directory layout is based on hash values,
+// ScanKeys visits the keys in no particular order.
+// ListKeys without the optional key index has to scan and sort all the keys.
+//
+// When the key index is turned on,
+// an empty file is also stored for every key under
+//     <fsdb-root>/_index/
+// with the hex encoded key as the path,
+// so that ListKeys can walk them in lexicographic order,
+// and skip the ones not matching the prefix.
+//
+// Please note that the key index puts a limit on the key size,
+// as the full path length of the index file is about 2.25 times of the key
+// size.
+// Writes of keys too long for the key index fail with ErrKeyTooLong before
+// anything is written.
 //
 // Compression
 //
-// This implementation supports optional gzip compression with configurable
-// compression levels.
+// This implementation supports optional compression using the codecs defined
+// in package codec, with gzip, zstd and snappy built in.
+// The codec is set by SetCodec,
+// or SetUseGzip and SetGzipLevel for gzip.
+// Custom codecs can be added via RegisterCodecs.
 //
-// If you changed the compression option on a non-empty local fsdb,
+// The data file of each entry has the suffix of its codec,
+// and Read looks for the data files of all the codecs registered,
+// starting from the current one.
+// So if you changed the compression option on a non-empty local fsdb,
 // the old data is still readable and the new data will be stored per new
-// compression option.
+// compression option,
+// as long as the codecs used by the old data are still registered.
+//
+// Already compressed data (e.g. media files) is not worth compressing again.
+// With an adaptive compression policy set by SetCompressionPolicy,
+// writes compress a sample at the beginning of the data first,
+// and store the entry uncompressed if the sample doesn't save enough.
+// The choice is recorded by the data filename,
+// so reads are not affected.
+//
+// Encryption
+//
+// With an encryptor from package crypt set by SetEncryptor,
+// data files are encrypted at rest (after compression),
+// and the ID of the key used is stored in the meta file.
+// Key files, along with the intent files of transactions,
+// can also be encrypted by SetEncryptKeys.
+// Directory names are still the hashes of the keys,
+// and the meta, metadata and key index files are not encrypted.
+//
+// Entries written before the encryptor is set are still readable.
+// RotateKeys rewrites the entries not encrypted by the current key,
+// after which old keys can be removed from the key provider,
+// unless there are noncurrent versions still encrypted by them.
 //
 // Run
 //     go test -bench .
 // will show you the read and write benchmark results of different compression
-// options of the filesystem under current directory for different typical sizes
-// of random binary data.
+// options and sync modes of the filesystem under current directory for
+// different typical sizes of random binary data.
 // Please note that the write time includes the time used to generate the random
 // binary data.
 // Also note that the read time could be much smaller than reality when the
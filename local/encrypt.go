@@ -0,0 +1,133 @@
+package local
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/fishy/errbatch"
+
+	"github.com/fishy/fsdb"
+	"github.com/fishy/fsdb/crypt"
+)
+
+func (db *impl) RotateKeys(ctx context.Context) error {
+	e := db.opts.GetEncryptor()
+	if e == nil {
+		return errNoEncryptor
+	}
+	current, err := e.CurrentKeyID()
+	if err != nil {
+		return err
+	}
+
+	var errs errbatch.ErrBatch
+	if err := db.ScanKeys(
+		ctx,
+		func(key fsdb.Key) bool {
+			errs.Add(db.rotateKey(ctx, key, current))
+			return true
+		},
+		func(path string, err error) bool {
+			errs.Add(err)
+			return true
+		},
+	); err != nil {
+		errs.Add(err)
+	}
+
+	select {
+	default:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return errs.Compile()
+}
+
+// rotateKey rewrites the entry of the key,
+// if it's not encrypted as the current options require.
+func (db *impl) rotateKey(ctx context.Context, key fsdb.Key, current string) error {
+	select {
+	default:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	dir, err := db.checkKey(key)
+	if fsdb.IsNoSuchKeyError(err) {
+		// Deleted after scanned.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	meta, err := readMeta(dir)
+	if err != nil {
+		return err
+	}
+	rotated, err := db.isRotated(dir, meta, current)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Deleted after scanned.
+			return nil
+		}
+		return err
+	}
+	if rotated {
+		return nil
+	}
+
+	reader, metadata, err := db.ReadWithMetadata(ctx, key)
+	if err != nil {
+		if fsdb.IsNoSuchKeyError(err) {
+			// Deleted or expired after scanned.
+			return nil
+		}
+		return err
+	}
+	defer reader.Close()
+
+	// Make sure the entry is not changed by other writes in the meantime.
+	precondition := fsdb.IfExist
+	if meta.ETag != "" {
+		precondition = fsdb.IfMatch(meta.ETag)
+	}
+	w, err := db.create(ctx, key, &precondition)
+	if err != nil {
+		if fsdb.IsPreconditionFailedError(err) {
+			return nil
+		}
+		return err
+	}
+	w.rewrite = true
+	w.metadata = metadata
+	if meta.Expires != nil {
+		w.expires = *meta.Expires
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.Close(); err != nil && !fsdb.IsPreconditionFailedError(err) {
+		return err
+	}
+	return nil
+}
+
+// isRotated returns true if both the data file and the key file under dir are
+// already encrypted as the current options require.
+func (db *impl) isRotated(dir string, meta *entryMeta, current string) (bool, error) {
+	if meta.KeyID != current {
+		return false, nil
+	}
+	content, err := ioutil.ReadFile(dir + KeyFilename)
+	if err != nil {
+		return false, err
+	}
+	id, encrypted := crypt.KeyID(content)
+	if db.opts.GetEncryptKeys() {
+		return encrypted && id == current, nil
+	}
+	return !encrypted, nil
+}
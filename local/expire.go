@@ -0,0 +1,90 @@
+package local
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/fishy/errbatch"
+
+	"github.com/fishy/fsdb"
+)
+
+func (db *impl) DeleteExpired(
+	ctx context.Context,
+	beforeDelete func(key fsdb.Key) error,
+) error {
+	var errs errbatch.ErrBatch
+	if err := db.ScanKeys(
+		ctx,
+		func(key fsdb.Key) bool {
+			errs.Add(db.deleteIfExpired(key, beforeDelete))
+			return true
+		},
+		fsdb.IgnoreAll,
+	); err != nil {
+		errs.Add(err)
+	}
+	return errs.Compile()
+}
+
+// deleteIfExpired deletes the entry if it's expired.
+func (db *impl) deleteIfExpired(
+	key fsdb.Key,
+	beforeDelete func(key fsdb.Key) error,
+) error {
+	dir, err := db.checkKey(key)
+	if fsdb.IsNoSuchKeyError(err) {
+		// Deleted after scanned.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	meta, err := readMeta(dir)
+	if err != nil {
+		return err
+	}
+	if meta.expired().IsZero() {
+		return nil
+	}
+
+	db.locks.Lock(string(key))
+	defer db.locks.Unlock(string(key))
+	// Check again, as it could be overwritten before we got the lock.
+	meta, err = readMeta(dir)
+	if err != nil {
+		return err
+	}
+	if meta.expired().IsZero() {
+		return nil
+	}
+	if beforeDelete != nil {
+		if err := beforeDelete(key); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if db.opts.GetUseKeyIndex() {
+		return db.removeIndex(key)
+	}
+	return nil
+}
+
+func (db *impl) StartReaper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// All errors will be retried on next run, safe to ignore.
+				db.DeleteExpired(ctx, nil)
+			}
+		}
+	}()
+}
@@ -0,0 +1,295 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fishy/fsdb"
+)
+
+// The key index stores an empty file for every key under the index directory.
+//
+// The path of the file is the hex encoded key, split into chunks of
+// indexCharsPerLevel characters.
+// All chunks but the last one are directories with indexDirSuffix,
+// and the last one is the file with indexFileSuffix.
+// As indexFileSuffix < indexDirSuffix < any hex character,
+// filepath.Walk visits the index files in the lexicographic order of the keys.
+const (
+	indexCharsPerLevel = 8
+	indexDirSuffix     = "-"
+	indexFileSuffix    = "+"
+)
+
+// maxIndexPathLen is the max length of the path of an index file,
+// which is PATH_MAX on Linux minus the terminating NUL.
+const maxIndexPathLen = 4095
+
+// ErrKeyTooLong is the error returned by writes when the key index is used and
+// the path of the index file of the key would be too long.
+var ErrKeyTooLong = errors.New("fsdb/local: key too long for the key index")
+
+// indexPath returns the path of the index file of the key.
+func indexPath(root string, key fsdb.Key) string {
+	hexKey := hex.EncodeToString(key)
+	var builder strings.Builder
+	builder.WriteString(root)
+	for len(hexKey) > indexCharsPerLevel {
+		builder.WriteString(hexKey[:indexCharsPerLevel])
+		builder.WriteString(indexDirSuffix)
+		builder.WriteString(PathSeparator)
+		hexKey = hexKey[indexCharsPerLevel:]
+	}
+	builder.WriteString(hexKey)
+	builder.WriteString(indexFileSuffix)
+	return builder.String()
+}
+
+// checkIndexKey returns ErrKeyTooLong if the key index is used and the key is
+// too long for it.
+//
+// It must be called before writing anything of the key,
+// so that the entry is never committed without its index file.
+func (db *impl) checkIndexKey(key fsdb.Key) error {
+	if !db.opts.GetUseKeyIndex() {
+		return nil
+	}
+	if len(indexPath(db.opts.GetRootIndexDir(), key)) > maxIndexPathLen {
+		return ErrKeyTooLong
+	}
+	return nil
+}
+
+// parseIndexPath returns the hex encoded key (or key prefix for directories)
+// of a path under the index directory.
+func parseIndexPath(root string, path string) string {
+	path = strings.TrimPrefix(path, root)
+	var builder strings.Builder
+	for _, chunk := range strings.Split(path, PathSeparator) {
+		chunk = strings.TrimSuffix(chunk, indexDirSuffix)
+		chunk = strings.TrimSuffix(chunk, indexFileSuffix)
+		builder.WriteString(chunk)
+	}
+	return builder.String()
+}
+
+// addIndex adds the key into the key index.
+func (db *impl) addIndex(key fsdb.Key) error {
+	path := indexPath(db.opts.GetRootIndexDir(), key)
+	if err := os.MkdirAll(filepath.Dir(path), FileModeForDirs); err != nil && !os.IsExist(err) {
+		return err
+	}
+	f, err := createFile(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// removeIndex removes the key from the key index,
+// and removes the parent directories that become empty.
+func (db *impl) removeIndex(key fsdb.Key) error {
+	root := db.opts.GetRootIndexDir()
+	path := indexPath(root, key)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dir := filepath.Dir(path)
+	// root ends with PathSeparator while dir does not,
+	// so this stops before reaching root.
+	for strings.HasPrefix(dir, root) {
+		// It only works on empty directories.
+		if os.Remove(dir) != nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
+
+func (db *impl) ListKeys(
+	ctx context.Context,
+	opts fsdb.ListOptions,
+) (keys []fsdb.Key, next fsdb.Key, err error) {
+	select {
+	default:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	if !db.opts.GetUseKeyIndex() {
+		return db.listKeysByScan(ctx, opts)
+	}
+
+	root := db.opts.GetRootIndexDir()
+	hexPrefix := hex.EncodeToString(opts.Prefix)
+	hexStartAfter := ""
+	if opts.StartAfter != nil {
+		hexStartAfter = hex.EncodeToString(opts.StartAfter)
+	}
+	keys = make([]fsdb.Key, 0)
+	err = filepath.Walk(
+		root,
+		func(path string, info os.FileInfo, err error) error {
+			select {
+			default:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			if err != nil {
+				if os.IsNotExist(err) {
+					// Empty index, or a directory removed during the walk.
+					return nil
+				}
+				return err
+			}
+			hexKey := parseIndexPath(root, path)
+			if info.IsDir() {
+				// All keys under this directory start with hexKey.
+				if !strings.HasPrefix(hexKey, hexPrefix) &&
+					!strings.HasPrefix(hexPrefix, hexKey) {
+					if hexKey > hexPrefix {
+						return errCanceled
+					}
+					return filepath.SkipDir
+				}
+				if opts.StartAfter != nil {
+					n := len(hexKey)
+					if len(hexStartAfter) < n {
+						n = len(hexStartAfter)
+					}
+					if hexKey[:n] < hexStartAfter[:n] {
+						return filepath.SkipDir
+					}
+				}
+				return nil
+			}
+			if !strings.HasSuffix(path, indexFileSuffix) {
+				return nil
+			}
+			if !strings.HasPrefix(hexKey, hexPrefix) {
+				if hexKey > hexPrefix {
+					return errCanceled
+				}
+				return nil
+			}
+			if opts.StartAfter != nil && hexKey <= hexStartAfter {
+				return nil
+			}
+			key, err := hex.DecodeString(hexKey)
+			if err != nil {
+				// Not a valid index file, ignore.
+				return nil
+			}
+			if opts.Limit > 0 && len(keys) >= opts.Limit {
+				next = keys[len(keys)-1]
+				return errLimitReached
+			}
+			keys = append(keys, fsdb.Key(key))
+			return nil
+		},
+	)
+	if err == errCanceled || err == errLimitReached {
+		err = nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, next, nil
+}
+
+// listKeysByScan implements ListKeys without key index,
+// by scanning all keys and sorting them.
+func (db *impl) listKeysByScan(
+	ctx context.Context,
+	opts fsdb.ListOptions,
+) (keys []fsdb.Key, next fsdb.Key, err error) {
+	keys = make([]fsdb.Key, 0)
+	if err := db.ScanKeys(
+		ctx,
+		func(key fsdb.Key) bool {
+			if !bytes.HasPrefix(key, opts.Prefix) {
+				return true
+			}
+			if opts.StartAfter != nil && bytes.Compare(key, opts.StartAfter) <= 0 {
+				return true
+			}
+			keys = append(keys, key)
+			return true
+		},
+		fsdb.IgnoreAll,
+	); err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	if opts.Limit > 0 && len(keys) > opts.Limit {
+		keys = keys[:opts.Limit]
+		next = keys[len(keys)-1]
+	}
+	return keys, next, nil
+}
+
+// RebuildKeyIndex rebuilds the key index of the local FSDB using the given
+// options.
+//
+// It removes index entries of keys no longer exist,
+// and adds index entries for all existing keys using ScanKeys,
+// so it's heavy on IO.
+// It's useful after turning on key index on an existing FSDB.
+func RebuildKeyIndex(ctx context.Context, opts Options) error {
+	db := &impl{opts: opts}
+	root := opts.GetRootIndexDir()
+
+	if err := filepath.Walk(
+		root,
+		func(path string, info os.FileInfo, err error) error {
+			select {
+			default:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() || !strings.HasSuffix(path, indexFileSuffix) {
+				return nil
+			}
+			key, err := hex.DecodeString(parseIndexPath(root, path))
+			if err != nil {
+				return os.Remove(path)
+			}
+			if _, err := db.Stat(ctx, key); fsdb.IsNoSuchKeyError(err) {
+				return db.removeIndex(key)
+			}
+			return nil
+		},
+	); err != nil {
+		return err
+	}
+
+	var indexErr error
+	if err := db.ScanKeys(
+		ctx,
+		func(key fsdb.Key) bool {
+			indexErr = db.addIndex(key)
+			return indexErr == nil
+		},
+		fsdb.IgnoreAll,
+	); err != nil {
+		return err
+	}
+	return indexErr
+}
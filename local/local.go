@@ -1,8 +1,6 @@
 package local
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
@@ -11,10 +9,14 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fishy/wrapreader"
 
 	"github.com/fishy/fsdb"
+	"github.com/fishy/fsdb/codec"
+	"github.com/fishy/fsdb/crypt"
 )
 
 // Make sure *KeyCollisionError satisfies error interface.
@@ -23,12 +25,21 @@ var _ error = (*KeyCollisionError)(nil)
 const tempDirPrefix = "fsdb_"
 const tempDirMode os.FileMode = 0700
 
-var errCanceled = errors.New("fsdb/local: canceled by keyFunc")
+var (
+	errCanceled     = errors.New("fsdb/local: canceled by keyFunc")
+	errWriterClosed = errors.New("fsdb/local: writer already closed")
+	errLimitReached = errors.New("fsdb/local: limit reached")
+	errNoEncryptor  = errors.New("fsdb/local: no encryptor set")
+)
 
 // Filenames used under the entry directory.
 const (
-	KeyFilename = "key"
+	KeyFilename      = "key"
+	MetaFilename     = "meta"
+	MetadataFilename = "metadata"
 
+	// DataFilename is the filename of the uncompressed data file.
+	// Compressed data files append the suffixes of their codecs to it.
 	DataFilename     = "data"
 	GzipDataFilename = "data.gz"
 )
@@ -53,216 +64,507 @@ func (err *KeyCollisionError) Error() string {
 	)
 }
 
+// DB is the local FSDB,
+// with features only available to the local implementation.
+type DB interface {
+	fsdb.Local
+
+	// Begin starts a transaction.
+	//
+	// See Txn for more details.
+	Begin(ctx context.Context) (Txn, error)
+
+	// StartReaper starts a background goroutine calling DeleteExpired every
+	// interval, until ctx is canceled.
+	StartReaper(ctx context.Context, interval time.Duration)
+
+	// ListVersions lists the noncurrent versions of the key, newest first.
+	//
+	// It's always empty if versioning is not enabled in options.
+	ListVersions(ctx context.Context, key fsdb.Key) ([]Version, error)
+
+	// ReadVersion opens a noncurrent version of the key for read.
+	ReadVersion(ctx context.Context, key fsdb.Key, id string) (io.ReadCloser, error)
+
+	// RestoreVersion makes a copy of a noncurrent version of the key the
+	// current version.
+	RestoreVersion(ctx context.Context, key fsdb.Key, id string) error
+
+	// Scrub reads all the entries to verify their checksums.
+	//
+	// The reads are limited to bytesPerSecond in uncompressed bytes on average,
+	// which also bounds the disk reads.
+	// Non-positive bytesPerSecond means unlimited.
+	//
+	// badFunc, if non-nil, is called for every entry failed the verification,
+	// with either a ChecksumMismatchError or other I/O errors.
+	// Entries without checksums (written by older versions of this package)
+	// are read but not verified.
+	Scrub(
+		ctx context.Context,
+		bytesPerSecond int64,
+		badFunc func(key fsdb.Key, err error),
+	) error
+
+	// StartScrubber starts a background goroutine calling Scrub every interval,
+	// until ctx is canceled.
+	StartScrubber(
+		ctx context.Context,
+		interval time.Duration,
+		bytesPerSecond int64,
+		badFunc func(key fsdb.Key, err error),
+	)
+
+	// RotateKeys re-encrypts all the entries not encrypted by the current key
+	// of the encryptor set in options,
+	// including unencrypted ones.
+	// Key files are also re-encrypted or decrypted to match the encrypt keys
+	// option.
+	//
+	// Only the current versions are rotated.
+	// Noncurrent versions keep using the keys they were encrypted by,
+	// so those keys must be kept until the versions are pruned.
+	//
+	// It returns an error if no encryptor is set.
+	// Entries changed by other writes during the rotation are skipped.
+	//
+	// It only covers the entries of this FSDB.
+	// The remote data of a hybrid FSDB using it is encrypted separately and
+	// never re-encrypted.
+	RotateKeys(ctx context.Context) error
+
+	// Recover cleans up after writes and transactions interrupted by a crash.
+	//
+	// Temp directories not modified for longer than the stale temp dir age set
+	// in options are recovered then removed:
+	// transactions interrupted while committing are rolled forward,
+	// writes interrupted after moving the data file are finished,
+	// and the others are discarded.
+	// It then walks all the entry directories,
+	// and removes the data files left by writes interrupted before moving the
+	// key files, if their entry directories are also stale.
+	//
+	// Recover also finishes applying the transactions that failed to be fully
+	// applied by Commit of this DB, and unlocks their keys.
+	//
+	// Recover is best effort.
+	// Failed ones are kept to be retried by the next Recover.
+	Recover(ctx context.Context) error
+}
+
+// Make sure *impl satisfies DB interface.
+var _ DB = (*impl)(nil)
+
 type impl struct {
-	opts Options
+	opts  Options
+	locks *rowLock
+
+	// pending are the transactions failed to be fully applied by Commit,
+	// keyed by their directories.
+	pendingLock sync.Mutex
+	pending     map[string]*pendingTxn
 }
 
 // Open opens an FSDB with the given options.
 //
 // There's no need to close it.
-func Open(opts Options) fsdb.Local {
-	return &impl{
-		opts: opts,
-	}
+//
+// Open also recovers the stale temp directories left by writes and
+// transactions interrupted by a crash, as Recover does.
+// But unlike Recover, it does not scan the entries.
+// Recovery is best effort,
+// temp directories failed to recover are retried on the next Open or Recover.
+func Open(opts Options) DB {
+	db := &impl{
+		opts:  opts,
+		locks: newRowLock(),
+	}
+	db.recoverTempDirs(context.Background())
+	return db
 }
 
 func (db *impl) Read(ctx context.Context, key fsdb.Key) (io.ReadCloser, error) {
+	return db.read(ctx, key, nil)
+}
+
+func (db *impl) ReadWithMetadata(
+	ctx context.Context,
+	key fsdb.Key,
+) (io.ReadCloser, map[string]string, error) {
+	var metadata map[string]string
+	reader, err := db.read(ctx, key, &metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reader, metadata, nil
+}
+
+// read opens the entry for read.
+//
+// If metadata is non-nil, the user-defined metadata will also be read into it.
+func (db *impl) read(
+	ctx context.Context,
+	key fsdb.Key,
+	metadata *map[string]string,
+) (io.ReadCloser, error) {
 	select {
 	default:
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 
-	dir := db.opts.GetDirForKey(key)
-	keyFile := dir + KeyFilename
-	if _, err := os.Lstat(keyFile); os.IsNotExist(err) {
-		return nil, &fsdb.NoSuchKeyError{Key: key}
-	}
-	if err := checkKeyCollision(key, keyFile); err != nil {
+	dir, err := db.checkKey(key)
+	if err != nil {
 		return nil, err
 	}
 
-	if db.opts.GetUseGzip() {
-		reader, err := readGzip(dir)
-		if os.IsNotExist(err) {
-			reader, err = readPlain(dir)
-			if os.IsNotExist(err) {
-				return nil, &fsdb.NoSuchKeyError{Key: key}
-			}
-			return reader, err
+	// Only lock while opening the file,
+	// so that readers won't see a partially committed transaction.
+	// Once opened, the file content won't be affected by later commits.
+	db.locks.RLock(string(key))
+	defer db.locks.RUnlock(string(key))
+
+	meta, err := readMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	if expired := meta.expired(); !expired.IsZero() {
+		return nil, &fsdb.NoSuchKeyError{Key: key, Expired: expired}
+	}
+	if metadata != nil {
+		if *metadata, err = readMetadata(dir); err != nil {
+			return nil, err
 		}
-		return reader, err
 	}
 
-	reader, err := readPlain(dir)
+	reader, err := db.openData(dir, meta)
 	if os.IsNotExist(err) {
-		reader, err = readGzip(dir)
+		return nil, &fsdb.NoSuchKeyError{Key: key}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return verifyChecksum(reader, key, meta), nil
+}
+
+// openData opens the data file under dir,
+// which is either an entry directory or a version directory,
+// with the meta under the same dir.
+//
+// The data files are looked for in the order of GetCodecs.
+func (db *impl) openData(dir string, meta *entryMeta) (io.ReadCloser, error) {
+	for _, c := range db.opts.GetCodecs() {
+		reader, err := db.openDataFile(dir, c, meta)
 		if os.IsNotExist(err) {
-			return nil, &fsdb.NoSuchKeyError{Key: key}
+			continue
 		}
 		return reader, err
 	}
-	return reader, err
+	return nil, os.ErrNotExist
+}
+
+func (db *impl) ReadRange(
+	ctx context.Context,
+	key fsdb.Key,
+	offset int64,
+	length int64,
+) (io.ReadCloser, error) {
+	reader, err := db.Read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return fsdb.ReadRange(reader, offset, length)
 }
 
 func (db *impl) Write(
 	ctx context.Context,
 	key fsdb.Key,
 	data io.Reader,
-) (err error) {
-	select {
-	default:
-	case <-ctx.Done():
-		return ctx.Err()
-	}
+) error {
+	return db.write(ctx, key, data, nil, fsdb.WriteOptions{})
+}
 
-	dir := db.opts.GetDirForKey(key)
-	keyFile := dir + KeyFilename
-	if _, err = os.Lstat(keyFile); err == nil {
-		if err = checkKeyCollision(key, keyFile); err != nil {
-			return err
-		}
-	}
-	tmpdir, err := db.getTempDir()
+func (db *impl) WriteWithOptions(
+	ctx context.Context,
+	key fsdb.Key,
+	data io.Reader,
+	opts fsdb.WriteOptions,
+) error {
+	return db.write(ctx, key, data, nil, opts)
+}
+
+func (db *impl) WriteIf(
+	ctx context.Context,
+	key fsdb.Key,
+	data io.Reader,
+	precondition fsdb.Precondition,
+) error {
+	return db.write(ctx, key, data, &precondition, fsdb.WriteOptions{})
+}
+
+// write writes data using a writer.
+func (db *impl) write(
+	ctx context.Context,
+	key fsdb.Key,
+	data io.Reader,
+	precondition *fsdb.Precondition,
+	opts fsdb.WriteOptions,
+) error {
+	w, err := db.createWithOptions(ctx, key, opts, precondition)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(tmpdir)
+	if _, err = io.Copy(w, data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
 
+func (db *impl) Delete(ctx context.Context, key fsdb.Key) error {
 	select {
 	default:
 	case <-ctx.Done():
 		return ctx.Err()
 	}
 
-	// Write temp key file
-	tmpKeyFile := tmpdir + KeyFilename
-	if err = func() error {
-		f, err := createFile(tmpKeyFile)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		if _, err = io.Copy(f, bytes.NewReader(key)); err != nil {
-			return err
-		}
-		return nil
-	}(); err != nil {
+	dir, err := db.checkKey(key)
+	if err != nil {
 		return err
 	}
 
-	select {
-	default:
-	case <-ctx.Done():
-		return ctx.Err()
+	db.locks.Lock(string(key))
+	defer db.locks.Unlock(string(key))
+	if err := os.RemoveAll(dir); err != nil {
+		return err
 	}
-
-	// Write temp data file
-	var tmpDataFile string
-	var dataFile string
-	if db.opts.GetUseGzip() {
-		tmpDataFile = tmpdir + GzipDataFilename
-		dataFile = dir + GzipDataFilename
-		if err = func() error {
-			f, err := createFile(tmpDataFile)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			writer, err := gzip.NewWriterLevel(f, db.opts.GetGzipLevel())
-			if err != nil {
-				return err
-			}
-			defer writer.Close()
-			if _, err = io.Copy(writer, data); err != nil {
-				return err
-			}
-			return nil
-		}(); err != nil {
-			return err
-		}
-	} else {
-		tmpDataFile = tmpdir + DataFilename
-		dataFile = dir + DataFilename
-		if err = func() error {
-			f, err := createFile(tmpDataFile)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			if _, err = io.Copy(f, data); err != nil {
-				return err
-			}
-			return nil
-		}(); err != nil {
+	if db.opts.GetSyncMode() >= SyncFull {
+		if err := syncDir(filepath.Dir(filepath.Clean(dir))); err != nil {
 			return err
 		}
 	}
+	if db.opts.GetUseKeyIndex() {
+		return db.removeIndex(key)
+	}
+	return nil
+}
 
+func (db *impl) Stat(ctx context.Context, key fsdb.Key) (*fsdb.EntryInfo, error) {
 	select {
 	default:
 	case <-ctx.Done():
-		return ctx.Err()
+		return nil, ctx.Err()
 	}
 
-	// Move data file
-	if err = os.MkdirAll(dir, FileModeForDirs); err != nil && !os.IsExist(err) {
-		return err
+	dir, err := db.checkKey(key)
+	if err != nil {
+		return nil, err
 	}
-	if err = os.Rename(tmpDataFile, dataFile); err != nil {
-		return err
+
+	info, meta, err := db.statEntry(dir)
+	if os.IsNotExist(err) {
+		return nil, &fsdb.NoSuchKeyError{Key: key}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expired := meta.expired(); !expired.IsZero() {
+		return nil, &fsdb.NoSuchKeyError{Key: key, Expired: expired}
 	}
-	for _, file := range []string{DataFilename, GzipDataFilename} {
-		fullpath := dir + file
-		if dataFile == fullpath {
+	return info, nil
+}
+
+// statEntry returns the info and meta under dir,
+// which is either an entry directory or a version directory.
+//
+// If there's no data file under dir, it returns an error satisfies
+// os.IsNotExist.
+func (db *impl) statEntry(dir string) (*fsdb.EntryInfo, *entryMeta, error) {
+	// Use the same order as Read.
+	for _, c := range db.opts.GetCodecs() {
+		stat, err := os.Lstat(dir + dataFilename(c))
+		if os.IsNotExist(err) {
 			continue
 		}
-		if err = os.Remove(fullpath); err != nil && !os.IsNotExist(err) {
-			return err
+		if err != nil {
+			return nil, nil, err
+		}
+		meta, err := readMeta(dir)
+		if err != nil {
+			return nil, nil, err
 		}
+		info := &fsdb.EntryInfo{
+			Size:        stat.Size(),
+			LogicalSize: stat.Size(),
+			ModTime:     stat.ModTime(),
+			Location:    fsdb.LocationLocal,
+			ETag:        meta.ETag,
+		}
+		if meta.KeyID != "" {
+			info.LogicalSize = crypt.PlaintextSize(stat.Size(), meta.KeyID)
+		}
+		if c.Suffix() != "" {
+			info.Compressed = true
+			info.LogicalSize = -1
+		}
+		if meta.Expires != nil {
+			info.Expires = *meta.Expires
+		}
+		if info.Metadata, err = readMetadata(dir); err != nil {
+			return nil, nil, err
+		}
+		return info, meta, nil
 	}
+	return nil, nil, os.ErrNotExist
+}
 
+func (db *impl) ScanKeys(
+	ctx context.Context,
+	keyFunc fsdb.KeyFunc,
+	errFunc fsdb.ErrFunc,
+) error {
+	return db.ResumeScanKeys(
+		ctx,
+		"",
+		func(key fsdb.Key, cursor string) bool {
+			return keyFunc(key)
+		},
+		errFunc,
+	)
+}
+
+// ResumeScanKeys scans the keys starting after the given cursor.
+//
+// The cursor is the relative path of the entry directory from the root data
+// directory.
+// As filepath.Walk visits directories in lexical order,
+// everything not after the cursor in that order is skipped.
+func (db *impl) ResumeScanKeys(
+	ctx context.Context,
+	cursor string,
+	keyFunc fsdb.CursorKeyFunc,
+	errFunc fsdb.ErrFunc,
+) error {
 	select {
 	default:
 	case <-ctx.Done():
 		return ctx.Err()
 	}
 
-	// Move key file
-	return os.Rename(tmpKeyFile, keyFile)
+	root := db.opts.GetRootDataDir()
+	if err := db.scanDir(ctx, root, root, cursor, keyFunc, errFunc); err != errCanceled {
+		return err
+	}
+	return nil
 }
 
-func (db *impl) Delete(ctx context.Context, key fsdb.Key) error {
+// ScanKeysParallel works like ScanKeys,
+// but splits the scan by the top level directories under the root data
+// directory, and scans them concurrently using the given number of workers.
+//
+// keyFunc and errFunc could be called concurrently from different goroutines.
+func (db *impl) ScanKeysParallel(
+	ctx context.Context,
+	workers int,
+	keyFunc fsdb.KeyFunc,
+	errFunc fsdb.ErrFunc,
+) error {
 	select {
 	default:
 	case <-ctx.Done():
 		return ctx.Err()
 	}
 
-	dir := db.opts.GetDirForKey(key)
-	keyFile := dir + KeyFilename
-	if _, err := os.Lstat(keyFile); os.IsNotExist(err) {
-		return &fsdb.NoSuchKeyError{Key: key}
+	if workers < 1 {
+		workers = 1
+	}
+	root := db.opts.GetRootDataDir()
+	infos, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		// Empty FSDB.
+		return nil
 	}
-	if err := checkKeyCollision(key, keyFile); err != nil {
+	if err != nil {
+		if errFunc(root, err) {
+			return nil
+		}
 		return err
 	}
-	return os.RemoveAll(dir)
-}
 
-func (db *impl) ScanKeys(
-	ctx context.Context,
-	keyFunc fsdb.KeyFunc,
-	errFunc fsdb.ErrFunc,
-) error {
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dirs := make(chan string)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for dir := range dirs {
+				if err := db.scanDir(
+					scanCtx,
+					root,
+					dir,
+					"",
+					func(key fsdb.Key, cursor string) bool {
+						return keyFunc(key)
+					},
+					errFunc,
+				); err != nil {
+					errs <- err
+					// Stop other workers.
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	func() {
+		defer close(dirs)
+		for _, info := range infos {
+			if !info.IsDir() {
+				continue
+			}
+			select {
+			case <-scanCtx.Done():
+				return
+			case dirs <- root + info.Name():
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+
 	select {
 	default:
 	case <-ctx.Done():
 		return ctx.Err()
 	}
+	for err := range errs {
+		// The other workers would return context.Canceled because of us,
+		// so the first error returned is the only one matters.
+		if err != errCanceled {
+			return err
+		}
+		return nil
+	}
+	return nil
+}
 
-	if err := filepath.Walk(
-		db.opts.GetRootDataDir(),
+// scanDir scans the keys under dir (which is under root).
+//
+// It returns errCanceled when keyFunc returns false.
+func (db *impl) scanDir(
+	ctx context.Context,
+	root string,
+	dir string,
+	cursor string,
+	keyFunc fsdb.CursorKeyFunc,
+	errFunc fsdb.ErrFunc,
+) error {
+	return filepath.Walk(
+		dir,
 		func(path string, info os.FileInfo, err error) error {
 			select {
 			default:
@@ -276,6 +578,14 @@ func (db *impl) ScanKeys(
 				}
 				return err
 			}
+			rel := strings.TrimPrefix(path, root)
+			if info.IsDir() && info.Name() == VersionsDirname {
+				// Garbage collect noncurrent versions along the scan.
+				//
+				// Failures will be retried by the next write or scan, safe to ignore.
+				db.pruneVersions(filepath.Dir(path) + PathSeparator)
+				return filepath.SkipDir
+			}
 			if info.IsDir() {
 				// Try remove empty directories.
 				//
@@ -286,36 +596,54 @@ func (db *impl) ScanKeys(
 				// a previously walked directory becomes empty.
 				// That could get removed on next scan.
 				os.Remove(path)
+				if rel != "" && cursor != "" &&
+					!strings.HasPrefix(cursor, rel+PathSeparator) &&
+					compareCursor(rel, cursor) <= 0 {
+					return filepath.SkipDir
+				}
 				return nil
 			}
 			if filepath.Base(path) == KeyFilename {
-				key, err := readKey(path)
+				entry := filepath.Dir(rel)
+				if cursor != "" && compareCursor(entry, cursor) <= 0 {
+					return nil
+				}
+				key, err := db.readKey(path)
 				if err != nil {
 					if errFunc(path, err) {
 						return nil
 					}
 					return err
 				}
-				ret := keyFunc(key)
+				ret := keyFunc(key, entry)
 				if !ret {
 					return errCanceled
 				}
 			}
 			return nil
 		},
-	); err != errCanceled {
-		return err
+	)
+}
+
+// compareCursor compares two cursors in the order of filepath.Walk.
+func compareCursor(a, b string) int {
+	partsA := strings.Split(a, PathSeparator)
+	partsB := strings.Split(b, PathSeparator)
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		if c := strings.Compare(partsA[i], partsB[i]); c != 0 {
+			return c
+		}
 	}
-	return nil
+	return len(partsA) - len(partsB)
 }
 
-// getTempDir returns a temp directory ready to use.
-func (db *impl) getTempDir() (dir string, err error) {
+// getTempDir returns a temp directory with the given prefix ready to use.
+func (db *impl) getTempDir(prefix string) (dir string, err error) {
 	root := db.opts.GetRootTempDir()
 	if err = os.MkdirAll(root, tempDirMode); err != nil && !os.IsExist(err) {
 		return
 	}
-	dir, err = ioutil.TempDir(root, tempDirPrefix)
+	dir, err = ioutil.TempDir(root, prefix)
 	if !strings.HasSuffix(dir, PathSeparator) {
 		dir += PathSeparator
 	}
@@ -325,8 +653,8 @@ func (db *impl) getTempDir() (dir string, err error) {
 // checkKeyCollision checks for key collision.
 //
 // It returns a KeyCollisionError if detected.
-func checkKeyCollision(key fsdb.Key, path string) error {
-	old, err := readKey(path)
+func (db *impl) checkKeyCollision(key fsdb.Key, path string) error {
+	old, err := db.readKey(path)
 	if err != nil {
 		return err
 	}
@@ -340,7 +668,9 @@ func checkKeyCollision(key fsdb.Key, path string) error {
 }
 
 // readKey reads a key from the giving path.
-func readKey(path string) (fsdb.Key, error) {
+//
+// Encrypted key files are decrypted.
+func (db *impl) readKey(path string) (fsdb.Key, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -351,36 +681,136 @@ func readKey(path string) (fsdb.Key, error) {
 	if err != nil {
 		return nil, err
 	}
+	if crypt.IsEncrypted(key) {
+		e := db.opts.GetEncryptor()
+		if e == nil {
+			return nil, errNoEncryptor
+		}
+		return e.Decrypt(key)
+	}
 	return fsdb.Key(key), nil
 }
 
+// encodeKey returns the content of the key file of the key,
+// which is encrypted if key encryption is on.
+func (db *impl) encodeKey(key fsdb.Key) ([]byte, error) {
+	if e := db.opts.GetEncryptor(); e != nil && db.opts.GetEncryptKeys() {
+		return e.Encrypt(key)
+	}
+	return key, nil
+}
+
 func createFile(path string) (*os.File, error) {
 	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, FileModeForFiles)
 }
 
-// readPlain reads the uncompressed data file
-func readPlain(dir string) (io.ReadCloser, error) {
-	dataFile := dir + DataFilename
-	if _, err := os.Lstat(dataFile); err != nil {
-		return nil, err
+// writeFile writes content into path.
+//
+// If sync is true, the file is fsynced before closing.
+func writeFile(path string, content []byte, sync bool) error {
+	f, err := createFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
 	}
-	return os.Open(dataFile)
+	return f.Close()
 }
 
-// readGzip reads the gzipped data file
-func readGzip(dir string) (io.ReadCloser, error) {
-	dataFile := dir + GzipDataFilename
-	if _, err := os.Lstat(dataFile); err != nil {
-		return nil, err
-	}
-	file, err := os.Open(dataFile)
+// syncDir fsyncs the directory,
+// so that the changes of its entries (create, rename, delete) are durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// mkdirAll works like os.MkdirAll with FileModeForDirs.
+//
+// If sync is true,
+// the parent directories of the directories created are also fsynced.
+func mkdirAll(dir string, sync bool) error {
+	var created []string
+	if sync {
+		for path := filepath.Clean(dir); ; path = filepath.Dir(path) {
+			if _, err := os.Lstat(path); err == nil || filepath.Dir(path) == path {
+				break
+			}
+			created = append(created, path)
+		}
+	}
+	if err := os.MkdirAll(dir, FileModeForDirs); err != nil && !os.IsExist(err) {
+		return err
+	}
+	// Sync from top to bottom.
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := syncDir(filepath.Dir(created[i])); err != nil {
+			return err
+		}
 	}
-	reader, err := gzip.NewReader(file)
+	return nil
+}
+
+// dataFilename returns the filename of the data file compressed by the codec.
+func dataFilename(c codec.Codec) string {
+	return DataFilename + c.Suffix()
+}
+
+// dataFilenames returns the filenames of the data files of all the codecs,
+// in the order of GetCodecs.
+func (db *impl) dataFilenames() []string {
+	codecs := db.opts.GetCodecs()
+	filenames := make([]string, len(codecs))
+	for i, c := range codecs {
+		filenames[i] = dataFilename(c)
+	}
+	return filenames
+}
+
+// openDataFile opens the data file compressed by the codec under dir,
+// and decrypts it if it's encrypted per meta.
+//
+// The uncompressed and unencrypted data file is returned as *os.File.
+func (db *impl) openDataFile(
+	dir string,
+	c codec.Codec,
+	meta *entryMeta,
+) (io.ReadCloser, error) {
+	file, err := os.Open(dir + dataFilename(c))
 	if err != nil {
-		file.Close()
 		return nil, err
 	}
+	if c.Suffix() == "" && meta.KeyID == "" {
+		return file, nil
+	}
+	var reader io.Reader = file
+	if meta.KeyID != "" {
+		e := db.opts.GetEncryptor()
+		if e == nil {
+			file.Close()
+			return nil, errNoEncryptor
+		}
+		if reader, err = e.NewReader(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if c.Suffix() != "" {
+		if reader, err = c.NewReader(reader); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
 	return wrapreader.Wrap(reader, file), nil
 }
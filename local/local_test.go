@@ -4,16 +4,24 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/fishy/fsdb"
+	"github.com/fishy/fsdb/codec"
+	"github.com/fishy/fsdb/crypt"
 	"github.com/fishy/fsdb/local"
 )
 
@@ -55,6 +63,52 @@ func TestReadWriteDelete(t *testing.T) {
 	testReadEmpty(t, db, key)
 }
 
+func TestSyncMode(t *testing.T) {
+	for _, mode := range []local.SyncMode{local.SyncNone, local.SyncData, local.SyncFull} {
+		t.Run(
+			mode.String(),
+			func(t *testing.T) {
+				ctx := context.Background()
+				root, err := ioutil.TempDir("", "fsdb_")
+				if err != nil {
+					t.Fatalf("failed to get tmp dir: %v", err)
+				}
+				defer os.RemoveAll(root)
+				opts := local.NewDefaultOptions(root).SetSyncMode(mode).SetKeepVersions(1)
+				db := local.Open(opts)
+
+				key := fsdb.Key("foo")
+				testWrite(t, db, key, lorem)
+				testRead(t, db, key, lorem)
+				if err := db.WriteWithOptions(
+					ctx,
+					key,
+					strings.NewReader("bar"),
+					fsdb.WriteOptions{Metadata: map[string]string{"foo": "bar"}},
+				); err != nil {
+					t.Fatalf("WriteWithOptions failed: %v", err)
+				}
+				testRead(t, db, key, "bar")
+
+				txn, err := db.Begin(ctx)
+				if err != nil {
+					t.Fatalf("Begin failed: %v", err)
+				}
+				if err := txn.Write(ctx, key, strings.NewReader("foobar")); err != nil {
+					t.Fatalf("Txn.Write failed: %v", err)
+				}
+				if err := txn.Commit(ctx); err != nil {
+					t.Fatalf("Commit failed: %v", err)
+				}
+				testRead(t, db, key, "foobar")
+
+				testDelete(t, db, key)
+				testReadEmpty(t, db, key)
+			},
+		)
+	}
+}
+
 func TestGzip(t *testing.T) {
 	root, err := ioutil.TempDir("", "fsdb_")
 	if err != nil {
@@ -106,53 +160,2216 @@ func TestChangeCompression(t *testing.T) {
 	testReadEmpty(t, gzipDb, key)
 }
 
-func TestScan(t *testing.T) {
+// customCodec is gzip with a different suffix.
+type customCodec struct {
+	codec.Codec
+}
+
+func (customCodec) Name() string {
+	return "custom"
+}
+
+func (customCodec) Suffix() string {
+	return ".custom"
+}
+
+func TestCodecs(t *testing.T) {
+	custom := customCodec{codec.Gzip(gzip.BestSpeed)}
+	codecs := append(codec.Builtins(), custom)
+	for _, writeCodec := range codecs {
+		t.Run(
+			writeCodec.Name(),
+			func(t *testing.T) {
+				root, err := ioutil.TempDir("", "fsdb_")
+				if err != nil {
+					t.Fatalf("failed to get tmp dir: %v", err)
+				}
+				defer os.RemoveAll(root)
+				opts := local.NewDefaultOptions(root).
+					SetCodec(writeCodec).
+					RegisterCodecs(custom)
+				db := local.Open(opts)
+
+				key := fsdb.Key("foo")
+				testWrite(t, db, key, lorem)
+				testRead(t, db, key, lorem)
+				dir := opts.GetDirForKey(key)
+				filename := local.DataFilename + writeCodec.Suffix()
+				if _, err := os.Lstat(dir + filename); err != nil {
+					t.Errorf("data file %s not found: %v", filename, err)
+				}
+				info, err := db.Stat(context.Background(), key)
+				if err != nil {
+					t.Fatalf("Stat failed: %v", err)
+				}
+				if info.Compressed != (writeCodec.Suffix() != "") {
+					t.Errorf("Compressed expected %v, got %v", !info.Compressed, info.Compressed)
+				}
+
+				for _, readCodec := range codecs {
+					readOpts := local.NewDefaultOptions(root).
+						SetCodec(readCodec).
+						RegisterCodecs(custom)
+					testRead(t, local.Open(readOpts), key, lorem)
+				}
+
+				// Overwrite with a different codec.
+				otherOpts := local.NewDefaultOptions(root).
+					SetCodec(codec.Zstd(0)).
+					RegisterCodecs(custom)
+				if writeCodec.Suffix() == codec.Zstd(0).Suffix() {
+					otherOpts.SetCodec(codec.None)
+				}
+				other := local.Open(otherOpts)
+				testWrite(t, other, key, "bar")
+				testRead(t, db, key, "bar")
+				if _, err := os.Lstat(dir + filename); !os.IsNotExist(err) {
+					t.Errorf("old data file %s should be removed, got %v", filename, err)
+				}
+			},
+		)
+	}
+
+	t.Run(
+		"unregistered",
+		func(t *testing.T) {
+			root, err := ioutil.TempDir("", "fsdb_")
+			if err != nil {
+				t.Fatalf("failed to get tmp dir: %v", err)
+			}
+			defer os.RemoveAll(root)
+			key := fsdb.Key("foo")
+			db := local.Open(local.NewDefaultOptions(root).SetCodec(custom))
+			testWrite(t, db, key, lorem)
+
+			// Without the custom codec registered the data file is invisible.
+			testReadEmpty(t, local.Open(local.NewDefaultOptions(root)), key)
+		},
+	)
+}
+
+func TestCompressionPolicy(t *testing.T) {
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
 	ctx := context.Background()
+	opts := local.NewDefaultOptions(root).
+		SetCodec(codec.Zstd(0)).
+		SetCompressionPolicy(codec.Policy{
+			SampleSize: 1024,
+			MinSavings: 0.1,
+		})
+	db := local.Open(opts)
+
+	buf := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(buf)
+	random := string(buf)
+	compressible := strings.Repeat(lorem, 10)
+
+	checkFile := func(t *testing.T, key fsdb.Key, compressed bool) {
+		t.Helper()
+		filename := local.DataFilename
+		if compressed {
+			filename += codec.Zstd(0).Suffix()
+		}
+		if _, err := os.Lstat(opts.GetDirForKey(key) + filename); err != nil {
+			t.Errorf("data file %s not found: %v", filename, err)
+		}
+		info, err := db.Stat(ctx, key)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if info.Compressed != compressed {
+			t.Errorf("Compressed expected %v, got %v", compressed, info.Compressed)
+		}
+	}
+
+	for _, c := range []struct {
+		label      string
+		data       string
+		compressed bool
+	}{
+		{"random", random, false},
+		{"compressible", compressible, true},
+		{"short-random", random[:100], false},
+		{"short-compressible", lorem, true},
+		{"empty", "", false},
+	} {
+		t.Run(
+			c.label,
+			func(t *testing.T) {
+				key := fsdb.Key(c.label)
+				testWrite(t, db, key, c.data)
+				testRead(t, db, key, c.data)
+				checkFile(t, key, c.compressed)
+			},
+		)
+	}
+
+	t.Run(
+		"overwrite",
+		func(t *testing.T) {
+			key := fsdb.Key("overwrite")
+			testWrite(t, db, key, compressible)
+			checkFile(t, key, true)
+			testWrite(t, db, key, random)
+			checkFile(t, key, false)
+			testRead(t, db, key, random)
+		},
+	)
+
+	t.Run(
+		"txn",
+		func(t *testing.T) {
+			txn, err := db.Begin(ctx)
+			if err != nil {
+				t.Fatalf("Begin failed: %v", err)
+			}
+			keyRandom := fsdb.Key("txn-random")
+			keyCompressible := fsdb.Key("txn-compressible")
+			if err := txn.Write(ctx, keyRandom, strings.NewReader(random)); err != nil {
+				t.Fatalf("txn Write failed: %v", err)
+			}
+			if err := txn.Write(ctx, keyCompressible, strings.NewReader(compressible)); err != nil {
+				t.Fatalf("txn Write failed: %v", err)
+			}
+			if err := txn.Commit(ctx); err != nil {
+				t.Fatalf("Commit failed: %v", err)
+			}
+			testRead(t, db, keyRandom, random)
+			checkFile(t, keyRandom, false)
+			testRead(t, db, keyCompressible, compressible)
+			checkFile(t, keyCompressible, true)
+		},
+	)
+}
+
+func TestEncryption(t *testing.T) {
 	root, err := ioutil.TempDir("", "fsdb_")
 	if err != nil {
 		t.Fatalf("failed to get tmp dir: %v", err)
 	}
 	defer os.RemoveAll(root)
-	opts := local.NewDefaultOptions(root)
+	ctx := context.Background()
+
+	keys := crypt.StaticKeyProvider{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, crypt.KeySize),
+			"k2": bytes.Repeat([]byte{2}, crypt.KeySize),
+		},
+	}
+	opts := local.NewDefaultOptions(root).
+		SetEncryptor(crypt.NewEncryptor(keys)).
+		SetEncryptKeys(true)
 	db := local.Open(opts)
 
-	keys := make(map[string]bool)
-	keyFunc := func(ret bool) func(key fsdb.Key) bool {
-		return func(key fsdb.Key) bool {
-			keys[string(key)] = true
-			return ret
+	checkFiles := func(t *testing.T, key fsdb.Key, keyID string, encryptKey bool) {
+		t.Helper()
+		dir := opts.GetDirForKey(key)
+		content, err := ioutil.ReadFile(dir + local.DataFilename)
+		if err != nil {
+			t.Fatalf("failed to read data file: %v", err)
+		}
+		if id, _ := crypt.KeyID(content); id != keyID {
+			t.Errorf("data file key id expected %q, got %q", keyID, id)
+		}
+		if keyID != "" && bytes.Contains(content, []byte("Lorem")) {
+			t.Error("encrypted data file contains plaintext")
+		}
+		content, err = ioutil.ReadFile(dir + local.KeyFilename)
+		if err != nil {
+			t.Fatalf("failed to read key file: %v", err)
+		}
+		if crypt.IsEncrypted(content) != encryptKey {
+			t.Errorf("key file encrypted expected %v, got %q", encryptKey, content)
 		}
 	}
-	err = db.ScanKeys(ctx, keyFunc(true), fsdb.IgnoreAll)
+
+	key := fsdb.Key("foo")
+	testWrite(t, db, key, lorem)
+	testRead(t, db, key, lorem)
+	checkFiles(t, key, "k1", true)
+	info, err := db.Stat(ctx, key)
 	if err != nil {
-		t.Fatalf("ScanKeys failed: %v", err)
+		t.Fatalf("Stat failed: %v", err)
 	}
-	if len(keys) != 0 {
-		t.Errorf("Scan empty db got keys: %+v", keys)
+	if info.LogicalSize != int64(len(lorem)) {
+		t.Errorf("LogicalSize expected %d, got %d", len(lorem), info.LogicalSize)
 	}
 
-	expectKeys := map[string]bool{
-		"foo":    true,
-		"bar":    true,
-		"foobar": true,
+	t.Run(
+		"no-encryptor",
+		func(t *testing.T) {
+			plain := local.Open(local.NewDefaultOptions(root))
+			if _, err := plain.Read(ctx, key); err == nil {
+				t.Error("Read without encryptor should fail")
+			}
+		},
+	)
+
+	t.Run(
+		"compressed",
+		func(t *testing.T) {
+			gzipKey := fsdb.Key("gzip")
+			gzipDB := local.Open(local.NewDefaultOptions(root).
+				SetEncryptor(crypt.NewEncryptor(keys)).
+				SetUseGzip(true))
+			testWrite(t, gzipDB, gzipKey, lorem)
+			testRead(t, gzipDB, gzipKey, lorem)
+			content, err := ioutil.ReadFile(opts.GetDirForKey(gzipKey) + local.GzipDataFilename)
+			if err != nil {
+				t.Fatalf("failed to read data file: %v", err)
+			}
+			if !crypt.IsEncrypted(content) {
+				t.Error("gzip data file is not encrypted")
+			}
+			if err := gzipDB.Delete(ctx, gzipKey); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+		},
+	)
+
+	t.Run(
+		"rotate",
+		func(t *testing.T) {
+			plainKey := fsdb.Key("plain")
+			testWrite(t, local.Open(local.NewDefaultOptions(root)), plainKey, lorem)
+			checkFiles(t, plainKey, "", false)
+
+			if err := local.Open(local.NewDefaultOptions(root)).RotateKeys(ctx); err == nil {
+				t.Error("RotateKeys without encryptor should fail")
+			}
+
+			keys.Current = "k2"
+			rotateDB := local.Open(local.NewDefaultOptions(root).
+				SetEncryptor(crypt.NewEncryptor(keys)))
+			if err := rotateDB.RotateKeys(ctx); err != nil {
+				t.Fatalf("RotateKeys failed: %v", err)
+			}
+			checkFiles(t, key, "k2", false)
+			checkFiles(t, plainKey, "k2", false)
+
+			delete(keys.Keys, "k1")
+			db := local.Open(local.NewDefaultOptions(root).
+				SetEncryptor(crypt.NewEncryptor(keys)))
+			testRead(t, db, key, lorem)
+			testRead(t, db, plainKey, lorem)
+		},
+	)
+}
+
+// collidingHash is a hash ignoring its input, so all keys collide.
+type collidingHash struct{}
+
+func (collidingHash) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (collidingHash) Sum(b []byte) []byte {
+	return append(b, 0xde, 0xad, 0xbe, 0xef)
+}
+
+func (collidingHash) Reset() {}
+
+func (collidingHash) Size() int {
+	return 4
+}
+
+func (collidingHash) BlockSize() int {
+	return 1
+}
+
+func TestKeyCollision(t *testing.T) {
+	ctx := context.Background()
+	newHash := func() hash.Hash {
+		return collidingHash{}
 	}
-	for key := range expectKeys {
-		testWrite(t, db, fsdb.Key(key), "")
+	foo := fsdb.Key("foo")
+	bar := fsdb.Key("bar")
+	baz := fsdb.Key("baz")
+
+	t.Run(
+		"error",
+		func(t *testing.T) {
+			root, err := ioutil.TempDir("", "fsdb_")
+			if err != nil {
+				t.Fatalf("failed to get tmp dir: %v", err)
+			}
+			defer os.RemoveAll(root)
+			db := local.Open(local.NewDefaultOptions(root).SetHashFunc(newHash))
+
+			testWrite(t, db, foo, "foo")
+			err = db.Write(ctx, bar, strings.NewReader("bar"))
+			if _, ok := err.(*local.KeyCollisionError); !ok {
+				t.Errorf("Expected KeyCollisionError, got %v", err)
+			}
+			if _, err := db.Read(ctx, bar); err == nil {
+				t.Error("Read on colliding key should fail")
+			}
+			testRead(t, db, foo, "foo")
+		},
+	)
+
+	t.Run(
+		"slots",
+		func(t *testing.T) {
+			root, err := ioutil.TempDir("", "fsdb_")
+			if err != nil {
+				t.Fatalf("failed to get tmp dir: %v", err)
+			}
+			defer os.RemoveAll(root)
+			opts := local.NewDefaultOptions(root).
+				SetHashFunc(newHash).
+				SetUseCollisionSlots(true)
+			db := local.Open(opts)
+			dir := opts.GetDirForKey(foo)
+			checkSlot := func(t *testing.T, slot string, key fsdb.Key) {
+				t.Helper()
+				content, err := ioutil.ReadFile(dir + slot + local.PathSeparator + local.KeyFilename)
+				if err != nil {
+					t.Fatalf("failed to read key file of slot %s: %v", slot, err)
+				}
+				if !key.Equals(content) {
+					t.Errorf("slot %s expected key %q, got %q", slot, key, content)
+				}
+			}
+
+			testWrite(t, db, foo, "foo")
+			testWrite(t, db, bar, "bar")
+			testWrite(t, db, baz, "baz")
+			testRead(t, db, foo, "foo")
+			testRead(t, db, bar, "bar")
+			testRead(t, db, baz, "baz")
+			checkSlot(t, "0", foo)
+			checkSlot(t, "1", bar)
+			checkSlot(t, "2", baz)
+
+			// Overwrite stays in the same slot.
+			testWrite(t, db, bar, "bar2")
+			testRead(t, db, bar, "bar2")
+			checkSlot(t, "1", bar)
+
+			// Freed slot is reused.
+			testDelete(t, db, bar)
+			testReadEmpty(t, db, bar)
+			testRead(t, db, foo, "foo")
+			testRead(t, db, baz, "baz")
+			qux := fsdb.Key("qux")
+			testWrite(t, db, qux, "qux")
+			checkSlot(t, "1", qux)
+
+			txn, err := db.Begin(ctx)
+			if err != nil {
+				t.Fatalf("Begin failed: %v", err)
+			}
+			if err := txn.Write(ctx, bar, strings.NewReader("bar3")); err != nil {
+				t.Fatalf("txn Write failed: %v", err)
+			}
+			if err := txn.Delete(ctx, foo); err != nil {
+				t.Fatalf("txn Delete failed: %v", err)
+			}
+			if err := txn.Commit(ctx); err != nil {
+				t.Fatalf("Commit failed: %v", err)
+			}
+			testReadEmpty(t, db, foo)
+			testRead(t, db, bar, "bar3")
+			checkSlot(t, "3", bar)
+
+			keys := make(map[string]bool)
+			if err := db.ScanKeys(
+				ctx,
+				func(key fsdb.Key) bool {
+					keys[string(key)] = true
+					return true
+				},
+				fsdb.StopAll,
+			); err != nil {
+				t.Fatalf("ScanKeys failed: %v", err)
+			}
+			expect := map[string]bool{"bar": true, "baz": true, "qux": true}
+			if !reflect.DeepEqual(keys, expect) {
+				t.Errorf("ScanKeys expected %v, got %v", expect, keys)
+			}
+
+			result, err := local.Check(ctx, opts, local.CheckOptions{})
+			if err != nil {
+				t.Fatalf("Check failed: %v", err)
+			}
+			if result.Entries != 3 || len(result.Problems) != 0 {
+				t.Errorf(
+					"Expected 3 entries and no problems, got %d, %v",
+					result.Entries,
+					result.Problems,
+				)
+			}
+
+			// Repair without slots never removes the slots.
+			result, err = local.Check(
+				ctx,
+				local.NewDefaultOptions(root).SetHashFunc(newHash),
+				local.CheckOptions{Repair: true},
+			)
+			if err != nil {
+				t.Fatalf("Check failed: %v", err)
+			}
+			if found, repaired := result.Count(local.ProblemHashMismatch); found != 3 || repaired != 0 {
+				t.Errorf(
+					"Expected 3 hash mismatches not repaired, got %d, %d: %v",
+					found,
+					repaired,
+					result.Problems,
+				)
+			}
+			testRead(t, db, bar, "bar3")
+			testRead(t, db, baz, "baz")
+			testRead(t, db, qux, "qux")
+		},
+	)
+}
+
+func TestCreate(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
 	}
-	if err := db.ScanKeys(ctx, keyFunc(true), fsdb.StopAll); err != nil {
-		t.Fatalf("ScanKeys failed: %v", err)
+	defer os.RemoveAll(root)
+	opts := local.NewDefaultOptions(root).SetUseGzip(true)
+	db := local.Open(opts)
+
+	key := fsdb.Key("foo")
+	w, err := db.Create(ctx, key)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	for _, line := range strings.SplitAfter(lorem, "\n") {
+		if _, err := io.WriteString(w, line); err != nil {
+			t.Fatalf("Write to writer failed: %v", err)
+		}
+	}
+	// Not committed yet
+	testReadEmpty(t, db, key)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	testRead(t, db, key, lorem)
+	if _, err := w.Write([]byte("foo")); err == nil {
+		t.Errorf("Write after Close should fail")
+	}
+	if err := w.Abort(); err != nil {
+		t.Errorf("Abort after Close should be no-op, got %v", err)
+	}
+
+	// Aborted writes leave the entry untouched
+	w, err = db.Create(ctx, key)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := io.WriteString(w, "bar"); err != nil {
+		t.Fatalf("Write to writer failed: %v", err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+	testRead(t, db, key, lorem)
+	if err := w.Close(); err == nil {
+		t.Errorf("Close after Abort should fail")
+	}
+
+	// Options and precondition are applied on commit
+	metadata := map[string]string{"content-type": "text/plain"}
+	precondition := fsdb.IfNotExist
+	w, err = db.CreateWithOptions(
+		ctx,
+		key,
+		fsdb.WriteOptions{Metadata: metadata},
+		&precondition,
+	)
+	if err == nil {
+		t.Errorf("CreateWithOptions on existing key with IfNotExist should fail")
+		w.Abort()
+	}
+	precondition = fsdb.IfExist
+	w, err = db.CreateWithOptions(
+		ctx,
+		key,
+		fsdb.WriteOptions{Metadata: metadata},
+		&precondition,
+	)
+	if err != nil {
+		t.Fatalf("CreateWithOptions failed: %v", err)
+	}
+	if _, err := io.WriteString(w, "bar"); err != nil {
+		t.Fatalf("Write to writer failed: %v", err)
+	}
+	if err := db.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := w.Close(); !fsdb.IsPreconditionFailedError(err) {
+		t.Errorf("Close expected PreconditionFailedError, got %v", err)
+	}
+	w, err = db.CreateWithOptions(ctx, key, fsdb.WriteOptions{Metadata: metadata}, nil)
+	if err != nil {
+		t.Fatalf("CreateWithOptions failed: %v", err)
+	}
+	if _, err := io.WriteString(w, "bar"); err != nil {
+		t.Fatalf("Write to writer failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	testRead(t, db, key, "bar")
+	info, err := db.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if !reflect.DeepEqual(info.Metadata, metadata) {
+		t.Errorf("Stat metadata expected %v, got %v", metadata, info.Metadata)
+	}
+
+	tmpFiles, err := ioutil.ReadDir(opts.GetRootTempDir())
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(tmpFiles) != 0 {
+		t.Errorf("Temp dir should be empty, got %d files", len(tmpFiles))
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	key := fsdb.Key("foo")
+	for _, useGzip := range []bool{false, true} {
+		db := local.Open(local.NewDefaultOptions(root).SetUseGzip(useGzip))
+		testWrite(t, db, key, lorem)
+
+		reader, err := db.Read(ctx, key)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		_, isReaderAt := reader.(io.ReaderAt)
+		_, isSeeker := reader.(io.Seeker)
+		reader.Close()
+		if isReaderAt == useGzip || isSeeker == useGzip {
+			t.Errorf(
+				"gzip: %v, reader is io.ReaderAt: %v, is io.Seeker: %v",
+				useGzip,
+				isReaderAt,
+				isSeeker,
+			)
+		}
+
+		for _, c := range []struct {
+			offset, length int64
+			expect         string
+		}{
+			{0, -1, lorem},
+			{0, 5, lorem[:5]},
+			{6, 5, lorem[6:11]},
+			{6, -1, lorem[6:]},
+			{int64(len(lorem)) - 5, 10, lorem[len(lorem)-5:]},
+			{int64(len(lorem)) + 5, 10, ""},
+		} {
+			reader, err := db.ReadRange(ctx, key, c.offset, c.length)
+			if err != nil {
+				t.Fatalf("ReadRange(%d, %d) failed: %v", c.offset, c.length, err)
+			}
+			actual, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatalf("Read content failed: %v", err)
+			}
+			if string(actual) != c.expect {
+				t.Errorf(
+					"ReadRange(%d, %d) expected %q, got %q",
+					c.offset,
+					c.length,
+					c.expect,
+					actual,
+				)
+			}
+		}
+
+		if _, err := db.ReadRange(ctx, key, -1, 1); err == nil {
+			t.Errorf("ReadRange with negative offset should fail")
+		}
+		testDelete(t, db, key)
+		if _, err := db.ReadRange(ctx, key, 0, 1); !fsdb.IsNoSuchKeyError(err) {
+			t.Errorf("Expected NoSuchKeyError, got: %v", err)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	db := local.Open(local.NewDefaultOptions(root).SetBatchThreadNum(3))
+
+	n := 10
+	keys := make([]fsdb.Key, n)
+	entries := make([]fsdb.Entry, n)
+	for i := range keys {
+		keys[i] = fsdb.Key(fmt.Sprintf("key%d", i))
+		entries[i] = fsdb.Entry{
+			Key:  keys[i],
+			Data: strings.NewReader(fmt.Sprintf("value%d", i)),
+		}
+	}
+	if err := db.WriteMany(ctx, entries); err != nil {
+		t.Fatalf("WriteMany failed: %v", err)
 	}
+
+	missing := fsdb.Key("missing")
+	readers, err := db.ReadMany(ctx, append(keys, missing))
+	if !fsdb.IsBatchError(err) {
+		t.Errorf("Expected BatchError, got %v", err)
+	} else {
+		errs := err.(*fsdb.BatchError).Errors
+		if !fsdb.IsNoSuchKeyError(errs[n]) {
+			t.Errorf("Expected NoSuchKeyError for %v, got %v", missing, errs[n])
+		}
+	}
+	if readers[n] != nil {
+		t.Errorf("Expected nil reader for %v", missing)
+	}
+	for i, reader := range readers[:n] {
+		if reader == nil {
+			t.Errorf("Expected non-nil reader for %v", keys[i])
+			continue
+		}
+		actual, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("Read content failed: %v", err)
+		}
+		if expect := fmt.Sprintf("value%d", i); string(actual) != expect {
+			t.Errorf("Read content expected %q, got %q", expect, actual)
+		}
+	}
+
+	if err := db.DeleteMany(ctx, keys); err != nil {
+		t.Fatalf("DeleteMany failed: %v", err)
+	}
+	for _, key := range keys {
+		testReadEmpty(t, db, key)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	opts := local.NewDefaultOptions(root).SetUseKeyIndex(true)
+	db := local.Open(opts)
+
+	key1 := fsdb.Key("foo")
+	key2 := fsdb.Key("bar")
+	key3 := fsdb.Key("foobar")
+	testWrite(t, db, key3, "foobar")
+
+	txn, err := db.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if err := txn.Write(ctx, key1, strings.NewReader("old")); err != nil {
+		t.Fatalf("Txn.Write failed: %v", err)
+	}
+	if err := txn.Write(ctx, key1, strings.NewReader("foo")); err != nil {
+		t.Fatalf("Txn.Write failed: %v", err)
+	}
+	if err := txn.Write(ctx, key2, strings.NewReader("bar")); err != nil {
+		t.Fatalf("Txn.Write failed: %v", err)
+	}
+	if err := txn.Delete(ctx, key3); err != nil {
+		t.Fatalf("Txn.Delete failed: %v", err)
+	}
+	// Nothing visible before commit.
+	testReadEmpty(t, db, key1)
+	testReadEmpty(t, db, key2)
+	testRead(t, db, key3, "foobar")
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	testRead(t, db, key1, "foo")
+	testRead(t, db, key2, "bar")
+	testReadEmpty(t, db, key3)
+	keys, _, err := db.ListKeys(ctx, fsdb.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListKeys failed: %v", err)
+	}
+	expectKeys := []fsdb.Key{key2, key1}
 	if !reflect.DeepEqual(keys, expectKeys) {
-		t.Errorf("ScanKeys expected %+v, got %+v", expectKeys, keys)
+		t.Errorf("ListKeys expected %v, got %v", expectKeys, keys)
+	}
+	if err := txn.Commit(ctx); err == nil {
+		t.Error("Commit on a closed transaction should fail")
 	}
 
-	keys = make(map[string]bool)
-	if err := db.ScanKeys(ctx, keyFunc(false), fsdb.StopAll); err != nil {
-		t.Fatalf("ScanKeys failed: %v", err)
+	t.Run(
+		"Rollback",
+		func(t *testing.T) {
+			txn, err := db.Begin(ctx)
+			if err != nil {
+				t.Fatalf("Begin failed: %v", err)
+			}
+			if err := txn.Write(ctx, key1, strings.NewReader("rollback")); err != nil {
+				t.Fatalf("Txn.Write failed: %v", err)
+			}
+			if err := txn.Delete(ctx, key2); err != nil {
+				t.Fatalf("Txn.Delete failed: %v", err)
+			}
+			if err := txn.Rollback(); err != nil {
+				t.Fatalf("Rollback failed: %v", err)
+			}
+			testRead(t, db, key1, "foo")
+			testRead(t, db, key2, "bar")
+		},
+	)
+
+	t.Run(
+		"NoSuchKey",
+		func(t *testing.T) {
+			txn, err := db.Begin(ctx)
+			if err != nil {
+				t.Fatalf("Begin failed: %v", err)
+			}
+			if err := txn.Write(ctx, key1, strings.NewReader("nosuchkey")); err != nil {
+				t.Fatalf("Txn.Write failed: %v", err)
+			}
+			if err := txn.Delete(ctx, key3); err != nil {
+				t.Fatalf("Txn.Delete failed: %v", err)
+			}
+			if err := txn.Commit(ctx); !fsdb.IsNoSuchKeyError(err) {
+				t.Errorf("Commit expected NoSuchKeyError, got %v", err)
+			}
+			testRead(t, db, key1, "foo")
+		},
+	)
+
+	infos, err := ioutil.ReadDir(opts.GetRootTempDir())
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
 	}
-	if len(keys) != 1 {
-		t.Errorf("Scan should stop after the first key, got: %+v", keys)
+	if len(infos) != 0 {
+		t.Errorf("Temp dir should be empty, got %d entries", len(infos))
+	}
+}
+
+func TestTxnRecover(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	opts := local.NewDefaultOptions(root)
+	db := local.Open(opts)
+
+	key1 := fsdb.Key("foo")
+	key2 := fsdb.Key("bar")
+	key3 := fsdb.Key("foobar")
+	testWrite(t, db, key2, "bar")
+
+	writeFile := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	stage := func(dir string, key fsdb.Key, data string) {
+		t.Helper()
+		writeFile(dir+local.KeyFilename, string(key))
+		writeFile(dir+local.DataFilename, data)
+	}
+
+	// A transaction interrupted after the intent file is written,
+	// writing key1 and deleting key2.
+	committed := opts.GetRootTempDir() + "fsdb_txn_committed" + local.PathSeparator
+	stage(committed+"0"+local.PathSeparator, key1, "foo")
+	writeFile(
+		committed+"intent",
+		fmt.Sprintf(
+			`[{"key":%q,"staged":"0","data":%q},{"key":%q}]`,
+			base64.StdEncoding.EncodeToString(key1),
+			local.DataFilename,
+			base64.StdEncoding.EncodeToString(key2),
+		),
+	)
+	// A transaction interrupted before the intent file is written,
+	// writing key3.
+	uncommitted := opts.GetRootTempDir() + "fsdb_txn_uncommitted" + local.PathSeparator
+	stage(uncommitted+"0"+local.PathSeparator, key3, "foobar")
+
+	db = local.Open(opts.SetStaleTempDirAge(0))
+	testRead(t, db, key1, "foo")
+	testReadEmpty(t, db, key2)
+	testReadEmpty(t, db, key3)
+	for _, dir := range []string{committed, uncommitted} {
+		if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed, got %v", dir, err)
+		}
 	}
+	if _, err := db.Stat(ctx, key1); err != nil {
+		t.Errorf("Stat failed: %v", err)
+	}
+
+	// An encrypted intent file, writing key3.
+	e := crypt.NewEncryptor(crypt.StaticKeyProvider{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, crypt.KeySize),
+		},
+	})
+	intent, err := e.Encrypt([]byte(fmt.Sprintf(
+		`[{"key":%q,"staged":"0","data":%q}]`,
+		base64.StdEncoding.EncodeToString(key3),
+		local.DataFilename,
+	)))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	encrypted := opts.GetRootTempDir() + "fsdb_txn_encrypted" + local.PathSeparator
+	stage(encrypted+"0"+local.PathSeparator, key3, "foobar")
+	writeFile(encrypted+"intent", string(intent))
+	db = local.Open(opts.SetEncryptor(e).SetEncryptKeys(true))
+	testRead(t, db, key3, "foobar")
+}
+
+func TestTxnIncomplete(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	opts := local.NewDefaultOptions(root)
+	db := local.Open(opts)
+
+	key1 := fsdb.Key("bar")
+	key2 := fsdb.Key("foo")
+	testWrite(t, db, key2, "foo")
+
+	// A non-empty directory in place of the data file fails the commit before
+	// key2 is deleted.
+	blocker := opts.GetDirForKey(key1) + local.DataFilename
+	if err := os.MkdirAll(blocker+local.PathSeparator+"blocker", 0700); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+
+	txn, err := db.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if err := txn.Write(ctx, key1, strings.NewReader("bar")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := txn.Delete(ctx, key2); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	err = txn.Commit(ctx)
+	if _, ok := err.(*local.TxnIncompleteError); !ok {
+		t.Fatalf("Commit expected TxnIncompleteError, got %v", err)
+	}
+
+	// Keys of the incomplete transaction stay locked.
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		testReadEmpty(t, db, key2)
+	}()
+	select {
+	case <-read:
+		t.Error("Read should be blocked by the incomplete transaction")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if err := db.Recover(ctx); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	<-read
+	testRead(t, db, key1, "bar")
+}
+
+func TestRecover(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	opts := local.NewDefaultOptions(root)
+	db := local.Open(opts)
+
+	move := func(from, to string) {
+		t.Helper()
+		if err := os.Rename(from, to); err != nil {
+			t.Fatalf("Rename failed: %v", err)
+		}
+	}
+	copyFile := func(from, to string) {
+		t.Helper()
+		content, err := ioutil.ReadFile(from)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if err := ioutil.WriteFile(to, content, 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	mkdir := func(name string) string {
+		t.Helper()
+		dir := opts.GetRootTempDir() + name + local.PathSeparator
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		return dir
+	}
+
+	// A write interrupted after the data file is moved.
+	key1 := fsdb.Key("foo")
+	testWrite(t, db, key1, "foo")
+	info, err := db.Stat(ctx, key1)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	interrupted := mkdir("fsdb_interrupted")
+	dir1 := opts.GetDirForKey(key1)
+	move(dir1+local.KeyFilename, interrupted+local.KeyFilename)
+	move(dir1+local.MetaFilename, interrupted+local.MetaFilename)
+	testReadEmpty(t, db, key1)
+
+	// A write interrupted after the data file is moved,
+	// then overwritten by another write.
+	key2 := fsdb.Key("bar")
+	testWrite(t, db, key2, "bar")
+	overwritten := mkdir("fsdb_overwritten")
+	dir2 := opts.GetDirForKey(key2)
+	copyFile(dir2+local.KeyFilename, overwritten+local.KeyFilename)
+	copyFile(dir2+local.MetaFilename, overwritten+local.MetaFilename)
+	testWrite(t, db, key2, "foobar")
+
+	// A write interrupted before commit.
+	key3 := fsdb.Key("foobar")
+	uncommitted := mkdir("fsdb_uncommitted")
+	if err := ioutil.WriteFile(
+		uncommitted+local.KeyFilename,
+		key3,
+		0600,
+	); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := ioutil.WriteFile(
+		uncommitted+local.DataFilename,
+		[]byte("foobar"),
+		0600,
+	); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	// An entry left without key file.
+	key4 := fsdb.Key("barfoo")
+	testWrite(t, db, key4, "barfoo")
+	dir4 := opts.GetDirForKey(key4)
+	if err := os.Remove(dir4 + local.KeyFilename); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+
+	tempDirs := []string{interrupted, overwritten, uncommitted}
+
+	// Nothing is stale yet.
+	db = local.Open(opts)
+	if err := db.Recover(ctx); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	testReadEmpty(t, db, key1)
+	for _, dir := range tempDirs {
+		if _, err := os.Lstat(dir); err != nil {
+			t.Errorf("%s should be kept, got %v", dir, err)
+		}
+	}
+	if _, err := os.Lstat(dir4 + local.DataFilename); err != nil {
+		t.Errorf("data file of %q should be kept, got %v", key4, err)
+	}
+
+	db = local.Open(opts.SetStaleTempDirAge(0))
+	// Scans are read-only.
+	if err := db.ScanKeys(ctx, func(fsdb.Key) bool { return true }, fsdb.IgnoreAll); err != nil {
+		t.Fatalf("ScanKeys failed: %v", err)
+	}
+	if _, err := os.Lstat(dir4 + local.DataFilename); err != nil {
+		t.Errorf("data file of %q should be kept by ScanKeys, got %v", key4, err)
+	}
+	if err := db.Recover(ctx); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	testRead(t, db, key1, "foo")
+	newInfo, err := db.Stat(ctx, key1)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if newInfo.ETag != info.ETag {
+		t.Errorf("ETag expected %q, got %q", info.ETag, newInfo.ETag)
+	}
+	testRead(t, db, key2, "foobar")
+	testReadEmpty(t, db, key3)
+	testReadEmpty(t, db, key4)
+	for _, dir := range tempDirs {
+		if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed, got %v", dir, err)
+		}
+	}
+	if _, err := os.Lstat(dir4 + local.DataFilename); !os.IsNotExist(err) {
+		t.Errorf("data file of %q should be removed, got %v", key4, err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	opts := local.NewDefaultOptions(root).SetStaleTempDirAge(0)
+	db := local.Open(opts)
+	gzipDb := local.Open(local.NewDefaultOptions(root).SetUseGzip(true))
+
+	writeFile := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	remove := func(path string) {
+		t.Helper()
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("Remove failed: %v", err)
+		}
+	}
+
+	good := fsdb.Key("good")
+	testWrite(t, db, good, "good")
+	writeFile(opts.GetDirForKey(good)+"stray", "stray")
+	writeFile(opts.GetRootDataDir()+"stray", "stray")
+
+	misplaced := fsdb.Key("misplaced")
+	testWrite(t, db, misplaced, "misplaced")
+	wrongDir := opts.GetDirForKey(fsdb.Key("wrong"))
+	if err := os.MkdirAll(filepath.Dir(filepath.Clean(wrongDir)), 0700); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := os.Rename(opts.GetDirForKey(misplaced), wrongDir); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+
+	dup := fsdb.Key("dup")
+	testWrite(t, db, dup, "dup")
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	w.Write([]byte("stale"))
+	w.Close()
+	writeFile(opts.GetDirForKey(dup)+local.GzipDataFilename, buf.String())
+
+	noData := fsdb.Key("nodata")
+	testWrite(t, db, noData, "nodata")
+	remove(opts.GetDirForKey(noData) + local.DataFilename)
+
+	noKey := fsdb.Key("nokey")
+	testWrite(t, db, noKey, "nokey")
+	remove(opts.GetDirForKey(noKey) + local.KeyFilename)
+
+	corrupt := fsdb.Key("corrupt")
+	testWrite(t, gzipDb, corrupt, lorem)
+	writeFile(opts.GetDirForKey(corrupt)+local.GzipDataFilename, buf.String()[:10])
+
+	rot := fsdb.Key("rot")
+	testWrite(t, db, rot, "rot")
+	writeFile(opts.GetDirForKey(rot)+local.DataFilename, "bit")
+
+	badKey := fsdb.Key("badkey")
+	testWrite(t, db, badKey, "badkey")
+	// Truncated encrypted key.
+	writeFile(opts.GetDirForKey(badKey)+local.KeyFilename, string(crypt.Magic))
+
+	writeFile(opts.GetRootTempDir()+"fsdb_leak"+local.PathSeparator+"foo", "foo")
+
+	expected := map[local.ProblemType]int{
+		local.ProblemHashMismatch:     1,
+		local.ProblemDuplicateData:    1,
+		local.ProblemMissingData:      1,
+		local.ProblemCorruptGzip:      1,
+		local.ProblemStrayFile:        3,
+		local.ProblemTempDirLeak:      1,
+		local.ProblemChecksumMismatch: 1,
+		local.ProblemCorruptKey:       1,
+	}
+	checkOpts := local.NewDefaultOptions(root).
+		SetStaleTempDirAge(0).
+		SetEncryptor(crypt.NewEncryptor(crypt.StaticKeyProvider{
+			Current: "k1",
+			Keys: map[string][]byte{
+				"k1": bytes.Repeat([]byte{1}, crypt.KeySize),
+			},
+		}))
+	for _, repair := range []bool{false, true} {
+		result, err := local.Check(ctx, checkOpts, local.CheckOptions{Repair: repair})
+		if err != nil {
+			t.Fatalf("Check(repair=%v) failed: %v", repair, err)
+		}
+		if result.Entries != 7 {
+			t.Errorf("Check(repair=%v) expected 7 entries, got %d", repair, result.Entries)
+		}
+		for _, pt := range local.ProblemTypes {
+			found, repaired := result.Count(pt)
+			if found != expected[pt] {
+				t.Errorf(
+					"Check(repair=%v) expected %d %v problems, got %d: %v",
+					repair,
+					expected[pt],
+					pt,
+					found,
+					result.Problems,
+				)
+			}
+			if repair && repaired != found {
+				t.Errorf(
+					"Check(repair=%v) expected %d %v problems repaired, got %d: %v",
+					repair,
+					found,
+					pt,
+					repaired,
+					result.Problems,
+				)
+			}
+		}
+	}
+
+	result, err := local.Check(ctx, opts, local.CheckOptions{})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if result.Entries != 3 || len(result.Problems) != 0 {
+		t.Errorf(
+			"Expected 3 entries and no problems after repair, got %d, %v",
+			result.Entries,
+			result.Problems,
+		)
+	}
+	testRead(t, db, good, "good")
+	testRead(t, db, misplaced, "misplaced")
+	testRead(t, db, dup, "dup")
+	testReadEmpty(t, db, noData)
+	testReadEmpty(t, db, noKey)
+	testReadEmpty(t, db, corrupt)
+	testReadEmpty(t, db, rot)
+	if _, err := os.Lstat(opts.GetDirForKey(badKey)); !os.IsNotExist(err) {
+		t.Errorf("Entry with corrupt key should be removed, got %v", err)
+	}
+}
+
+func TestCheckOptionsMismatch(t *testing.T) {
+	ctx := context.Background()
+	keys := crypt.StaticKeyProvider{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, crypt.KeySize),
+		},
+	}
+	key := fsdb.Key("foo")
+
+	for label, opts := range map[string]func(root string) local.OptionsBuilder{
+		"data": func(root string) local.OptionsBuilder {
+			return local.NewDefaultOptions(root).
+				SetEncryptor(crypt.NewEncryptor(keys)).
+				SetCodec(codec.Zstd(0))
+		},
+		"key": func(root string) local.OptionsBuilder {
+			return local.NewDefaultOptions(root).
+				SetEncryptor(crypt.NewEncryptor(keys)).
+				SetEncryptKeys(true)
+		},
+	} {
+		t.Run(
+			label,
+			func(t *testing.T) {
+				root, err := ioutil.TempDir("", "fsdb_")
+				if err != nil {
+					t.Fatalf("failed to get tmp dir: %v", err)
+				}
+				defer os.RemoveAll(root)
+				db := local.Open(opts(root))
+				testWrite(t, db, key, lorem)
+
+				for check, checkOpts := range map[string]local.Options{
+					"no-encryptor": local.NewDefaultOptions(root),
+					"unknown-key": local.NewDefaultOptions(root).
+						SetEncryptor(crypt.NewEncryptor(crypt.StaticKeyProvider{})),
+				} {
+					result, err := local.Check(ctx, checkOpts, local.CheckOptions{Repair: true})
+					if err == nil {
+						t.Errorf("%s: Check should fail, got %v", check, result.Problems)
+					}
+					if len(result.Problems) != 0 {
+						t.Errorf("%s: Check expected no problems, got %v", check, result.Problems)
+					}
+					testRead(t, db, key, lorem)
+				}
+			},
+		)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	good := fsdb.Key("good")
+	bad := fsdb.Key("bad")
+	for _, algo := range []local.ChecksumAlgorithm{
+		local.ChecksumCRC32C,
+		local.ChecksumSHA256,
+	} {
+		for _, useGzip := range []bool{false, true} {
+			t.Run(
+				fmt.Sprintf("%v-gzip-%v", algo, useGzip),
+				func(t *testing.T) {
+					opts := local.NewDefaultOptions(root).
+						SetChecksumAlgorithm(algo).
+						SetUseGzip(useGzip)
+					db := local.Open(opts)
+					testWrite(t, db, good, lorem)
+					testWrite(t, db, bad, lorem)
+					testRead(t, db, good, lorem)
+
+					// crc32c checksums are already in the ETags.
+					meta, err := ioutil.ReadFile(opts.GetDirForKey(good) + local.MetaFilename)
+					if err != nil {
+						t.Fatalf("ReadFile failed: %v", err)
+					}
+					stored := strings.Contains(string(meta), `"checksum"`)
+					if stored != (algo != local.ChecksumCRC32C) {
+						t.Errorf("Unexpected checksum stored in meta file: %s", meta)
+					}
+
+					// Flip the content of bad without changing the size.
+					corrupted := strings.Replace(lorem, "Lorem", "lorem", 1)
+					if useGzip {
+						buf := new(bytes.Buffer)
+						w := gzip.NewWriter(buf)
+						w.Write([]byte(corrupted))
+						w.Close()
+						corrupted = buf.String()
+					}
+					filename := local.DataFilename
+					if useGzip {
+						filename = local.GzipDataFilename
+					}
+					if err := ioutil.WriteFile(
+						opts.GetDirForKey(bad)+filename,
+						[]byte(corrupted),
+						0600,
+					); err != nil {
+						t.Fatalf("WriteFile failed: %v", err)
+					}
+
+					reader, err := db.Read(ctx, bad)
+					if err != nil {
+						t.Fatalf("Read failed: %v", err)
+					}
+					if _, err := ioutil.ReadAll(reader); !fsdb.IsChecksumMismatchError(err) {
+						t.Errorf("Expected ChecksumMismatchError from Read, got %v", err)
+					}
+					if err := reader.Close(); !fsdb.IsChecksumMismatchError(err) {
+						t.Errorf("Expected ChecksumMismatchError from Close, got %v", err)
+					}
+
+					// Partial reads are not verified.
+					reader, err = db.ReadRange(ctx, bad, 6, 5)
+					if err != nil {
+						t.Fatalf("ReadRange failed: %v", err)
+					}
+					if _, err := ioutil.ReadAll(reader); err != nil {
+						t.Errorf("ReadRange read failed: %v", err)
+					}
+					reader.Close()
+
+					var badKeys []fsdb.Key
+					if err := db.Scrub(
+						ctx,
+						0,
+						func(key fsdb.Key, err error) {
+							if !fsdb.IsChecksumMismatchError(err) {
+								t.Errorf("Expected ChecksumMismatchError for %q, got %v", key, err)
+							}
+							badKeys = append(badKeys, key)
+						},
+					); err != nil {
+						t.Fatalf("Scrub failed: %v", err)
+					}
+					if !reflect.DeepEqual(badKeys, []fsdb.Key{bad}) {
+						t.Errorf("Scrub expected bad keys %q, got %q", []fsdb.Key{bad}, badKeys)
+					}
+				},
+			)
+		}
+	}
+}
+
+func TestScrubRate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	db := local.Open(local.NewDefaultOptions(root))
+	for i := 0; i < 5; i++ {
+		testWrite(t, db, fsdb.Key(fmt.Sprintf("key%d", i)), lorem)
+	}
+
+	// 5 entries of lorem at 10 entries per second.
+	rate := int64(len(lorem) * 10)
+	expected := 500 * time.Millisecond
+	started := time.Now()
+	if err := db.Scrub(ctx, rate, nil); err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < expected*9/10 {
+		t.Errorf("Scrub expected to take at least %v, took %v", expected, elapsed)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	db := local.Open(local.NewDefaultOptions(root).SetUseKeyIndex(true))
+
+	ttl := time.Millisecond * 50
+	key1 := fsdb.Key("foo")
+	key2 := fsdb.Key("bar")
+	key3 := fsdb.Key("foobar")
+	for _, key := range []fsdb.Key{key1, key2} {
+		if err := db.WriteWithOptions(
+			ctx,
+			key,
+			strings.NewReader(string(key)),
+			fsdb.WriteOptions{TTL: ttl},
+		); err != nil {
+			t.Fatalf("WriteWithOptions failed: %v", err)
+		}
+	}
+	testWrite(t, db, key3, "foobar")
+
+	testRead(t, db, key1, "foo")
+	info, err := db.Stat(ctx, key1)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Expires.IsZero() || info.Expires.After(time.Now().Add(ttl)) {
+		t.Errorf("Unexpected Expires: %v", info.Expires)
+	}
+
+	time.Sleep(ttl)
+	_, err = db.Read(ctx, key1)
+	if !fsdb.IsNoSuchKeyError(err) {
+		t.Fatalf("Read on expired key should return NoSuchKeyError, got %v", err)
+	}
+	if err.(*fsdb.NoSuchKeyError).Expired.IsZero() {
+		t.Errorf("Expired should be set, got %#v", err)
+	}
+	if _, err := db.Stat(ctx, key1); !fsdb.IsNoSuchKeyError(err) {
+		t.Errorf("Stat on expired key should return NoSuchKeyError, got %v", err)
+	}
+	// Overwrite an expired key.
+	if err := db.WriteIf(
+		ctx,
+		key2,
+		strings.NewReader("new"),
+		fsdb.IfNotExist,
+	); err != nil {
+		t.Errorf("WriteIf IfNotExist on expired key failed: %v", err)
+	}
+	testRead(t, db, key2, "new")
+
+	var deleted []fsdb.Key
+	if err := db.DeleteExpired(ctx, func(key fsdb.Key) error {
+		deleted = append(deleted, key)
+		return nil
+	}); err != nil {
+		t.Fatalf("DeleteExpired failed: %v", err)
+	}
+	if !reflect.DeepEqual(deleted, []fsdb.Key{key1}) {
+		t.Errorf("DeleteExpired expected to delete %v, got %v", key1, deleted)
+	}
+	testDeleteEmpty(t, db, key1)
+	testRead(t, db, key3, "foobar")
+	keys, _, err := db.ListKeys(ctx, fsdb.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListKeys failed: %v", err)
+	}
+	if expect := []fsdb.Key{key2, key3}; !reflect.DeepEqual(keys, expect) {
+		t.Errorf("ListKeys expected %v, got %v", expect, keys)
+	}
+
+	t.Run(
+		"Reaper",
+		func(t *testing.T) {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			if err := db.WriteWithOptions(
+				ctx,
+				key1,
+				strings.NewReader("foo"),
+				fsdb.WriteOptions{TTL: ttl},
+			); err != nil {
+				t.Fatalf("WriteWithOptions failed: %v", err)
+			}
+			db.StartReaper(ctx, ttl)
+			time.Sleep(ttl * 3)
+			testDeleteEmpty(t, db, key1)
+			testRead(t, db, key3, "foobar")
+		},
+	)
+}
+
+func TestMetadata(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	db := local.Open(local.NewDefaultOptions(root))
+
+	key := fsdb.Key("foo")
+	metadata := map[string]string{
+		"content-type":   "text/plain",
+		"schema-version": "2",
+	}
+	if err := db.WriteWithOptions(
+		ctx,
+		key,
+		strings.NewReader("bar"),
+		fsdb.WriteOptions{Metadata: metadata},
+	); err != nil {
+		t.Fatalf("WriteWithOptions failed: %v", err)
+	}
+	info, err := db.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if !reflect.DeepEqual(info.Metadata, metadata) {
+		t.Errorf("Stat metadata expected %v, got %v", metadata, info.Metadata)
+	}
+	reader, actual, err := db.ReadWithMetadata(ctx, key)
+	if err != nil {
+		t.Fatalf("ReadWithMetadata failed: %v", err)
+	}
+	content, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("Read content failed: %v", err)
+	}
+	if string(content) != "bar" {
+		t.Errorf("Read content expected %q, got %q", "bar", content)
+	}
+	if !reflect.DeepEqual(actual, metadata) {
+		t.Errorf("ReadWithMetadata expected %v, got %v", metadata, actual)
+	}
+
+	// Overwriting without metadata should remove the old metadata.
+	testWrite(t, db, key, "foobar")
+	reader, actual, err = db.ReadWithMetadata(ctx, key)
+	if err != nil {
+		t.Fatalf("ReadWithMetadata failed: %v", err)
+	}
+	reader.Close()
+	if actual != nil {
+		t.Errorf("ReadWithMetadata expected nil metadata, got %v", actual)
+	}
+	if _, _, err := db.ReadWithMetadata(ctx, fsdb.Key("bar")); !fsdb.IsNoSuchKeyError(err) {
+		t.Errorf("ReadWithMetadata expected NoSuchKeyError, got %v", err)
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	opts := local.NewDefaultOptions(root).SetKeepVersions(2)
+	db := local.Open(opts)
+
+	key := fsdb.Key("foo")
+	for _, content := range []string{"v1", "v2", "v3", "v4"} {
+		testWrite(t, db, key, content)
+	}
+	versions, err := db.ListVersions(ctx, key)
+	if err != nil {
+		t.Fatalf("ListVersions failed: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("Expected 2 versions, got %+v", versions)
+	}
+	for i, expect := range []string{"v3", "v2"} {
+		reader, err := db.ReadVersion(ctx, key, versions[i].ID)
+		if err != nil {
+			t.Fatalf("ReadVersion failed: %v", err)
+		}
+		actual, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("Read content failed: %v", err)
+		}
+		if string(actual) != expect {
+			t.Errorf("ReadVersion expected %q, got %q", expect, actual)
+		}
+		if versions[i].Size != int64(len(expect)) {
+			t.Errorf("Version size expected %d, got %d", len(expect), versions[i].Size)
+		}
+	}
+	if !versions[0].Overwritten.After(versions[1].Overwritten) {
+		t.Errorf("Versions should be newest first, got %+v", versions)
+	}
+
+	if err := db.RestoreVersion(ctx, key, versions[1].ID); err != nil {
+		t.Fatalf("RestoreVersion failed: %v", err)
+	}
+	testRead(t, db, key, "v2")
+	versions, err = db.ListVersions(ctx, key)
+	if err != nil {
+		t.Fatalf("ListVersions failed: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("Expected 2 versions, got %+v", versions)
+	}
+	reader, err := db.ReadVersion(ctx, key, versions[0].ID)
+	if err != nil {
+		t.Fatalf("ReadVersion failed: %v", err)
+	}
+	actual, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(actual) != "v4" {
+		t.Errorf("ReadVersion expected %q, got %q", "v4", actual)
+	}
+
+	for _, id := range []string{"0000000000000000", "../../foo", ""} {
+		_, err := db.ReadVersion(ctx, key, id)
+		if _, ok := err.(*local.NoSuchVersionError); !ok {
+			t.Errorf("ReadVersion(%q) expected NoSuchVersionError, got %v", id, err)
+		}
+	}
+
+	// Version partially archived by a crash.
+	partial := opts.GetDirForKey(key) + local.VersionsDirname + local.PathSeparator + "tmp-crash"
+	if err := os.Mkdir(partial, 0700); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := ioutil.WriteFile(partial+local.PathSeparator+local.DataFilename, []byte("v5"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	versions, err = db.ListVersions(ctx, key)
+	if err != nil {
+		t.Fatalf("ListVersions failed: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Errorf("Expected 2 versions with a partial one, got %+v", versions)
+	}
+	opts.SetStaleTempDirAge(0)
+	testWrite(t, db, key, "v5")
+	if _, err := os.Lstat(partial); !os.IsNotExist(err) {
+		t.Errorf("Partial version should be removed, got %v", err)
+	}
+
+	testDelete(t, db, key)
+	if _, err := db.ListVersions(ctx, key); !fsdb.IsNoSuchKeyError(err) {
+		t.Errorf("ListVersions after Delete expected NoSuchKeyError, got %v", err)
+	}
+}
+
+func TestVersioningGC(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	keepFor := time.Millisecond * 50
+	db := local.Open(local.NewDefaultOptions(root).SetKeepVersionsFor(keepFor))
+
+	key := fsdb.Key("foo")
+	for _, content := range []string{"v1", "v2", "v3"} {
+		testWrite(t, db, key, content)
+	}
+	versions, err := db.ListVersions(ctx, key)
+	if err != nil {
+		t.Fatalf("ListVersions failed: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("Expected 2 versions, got %+v", versions)
+	}
+
+	time.Sleep(keepFor)
+	if err := db.ScanKeys(
+		ctx,
+		func(fsdb.Key) bool {
+			return true
+		},
+		fsdb.StopAll,
+	); err != nil {
+		t.Fatalf("ScanKeys failed: %v", err)
+	}
+	versions, err = db.ListVersions(ctx, key)
+	if err != nil {
+		t.Fatalf("ListVersions failed: %v", err)
+	}
+	if len(versions) != 0 {
+		t.Errorf("Expected versions garbage collected by ScanKeys, got %+v", versions)
+	}
+	testRead(t, db, key, "v3")
+}
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	opts := local.NewDefaultOptions(root).SetUseGzip(false)
+	db := local.Open(opts)
+
+	key := fsdb.Key("foo")
+	if _, err := db.Stat(ctx, key); !fsdb.IsNoSuchKeyError(err) {
+		t.Errorf("Expected NoSuchKeyError, got: %v", err)
+	}
+	exists, err := fsdb.Exists(ctx, db, key)
+	if err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	if exists {
+		t.Errorf("Exists expected false, got true")
+	}
+
+	testWrite(t, db, key, lorem)
+	info, err := db.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	expect := &fsdb.EntryInfo{
+		Size:        int64(len(lorem)),
+		LogicalSize: int64(len(lorem)),
+		ModTime:     info.ModTime,
+		Compressed:  false,
+		Location:    fsdb.LocationLocal,
+		ETag:        info.ETag,
+	}
+	if !reflect.DeepEqual(info, expect) {
+		t.Errorf("Stat expected %+v, got %+v", expect, info)
+	}
+	if info.ETag == "" {
+		t.Errorf("Stat returned empty ETag")
+	}
+	if time.Now().Sub(info.ModTime) > time.Minute {
+		t.Errorf("Stat returned unexpected ModTime: %v", info.ModTime)
+	}
+	exists, err = fsdb.Exists(ctx, db, key)
+	if err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	if !exists {
+		t.Errorf("Exists expected true, got false")
+	}
+
+	gzipDb := local.Open(local.NewDefaultOptions(root).SetUseGzip(true))
+	testWrite(t, gzipDb, key, lorem)
+	info, err = db.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if !info.Compressed {
+		t.Errorf("Stat on gzip entry expected Compressed, got %+v", info)
+	}
+	if info.LogicalSize != -1 {
+		t.Errorf("Stat on gzip entry expected LogicalSize -1, got %+v", info)
+	}
+	if info.Size <= 0 || info.Size >= int64(len(lorem)) {
+		t.Errorf("Stat on gzip entry got unexpected Size: %+v", info)
+	}
+
+	// Empty meta file left by a power loss.
+	testWrite(t, db, key, lorem)
+	if err := ioutil.WriteFile(opts.GetDirForKey(key)+local.MetaFilename, nil, 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	info, err = db.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("Stat with empty meta file failed: %v", err)
+	}
+	if info.ETag != "" {
+		t.Errorf("Stat with empty meta file expected empty ETag, got %+v", info)
+	}
+	testRead(t, db, key, lorem)
+
+	testDelete(t, db, key)
+	if _, err := db.Stat(ctx, key); !fsdb.IsNoSuchKeyError(err) {
+		t.Errorf("Expected NoSuchKeyError, got: %v", err)
+	}
+}
+
+func TestWriteIf(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	db := local.Open(local.NewDefaultOptions(root))
+
+	key := fsdb.Key("foo")
+	writeIf := func(content string, precondition fsdb.Precondition) error {
+		t.Helper()
+		return db.WriteIf(ctx, key, strings.NewReader(content), precondition)
+	}
+	stat := func() *fsdb.EntryInfo {
+		t.Helper()
+		info, err := db.Stat(ctx, key)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		return info
+	}
+
+	if err := writeIf("foo", fsdb.IfExist); !fsdb.IsPreconditionFailedError(err) {
+		t.Errorf("Expected PreconditionFailedError, got: %v", err)
+	}
+	testReadEmpty(t, db, key)
+	if err := writeIf("foo", fsdb.IfMatch("")); !fsdb.IsPreconditionFailedError(err) {
+		t.Errorf("Expected PreconditionFailedError, got: %v", err)
+	}
+	if err := writeIf("foo", fsdb.IfNotExist); err != nil {
+		t.Fatalf("WriteIf failed: %v", err)
+	}
+	testRead(t, db, key, "foo")
+	if err := writeIf("bar", fsdb.IfNotExist); !fsdb.IsPreconditionFailedError(err) {
+		t.Errorf("Expected PreconditionFailedError, got: %v", err)
+	}
+	testRead(t, db, key, "foo")
+
+	etag := stat().ETag
+	if err := writeIf("bar", fsdb.IfMatch(etag)); err != nil {
+		t.Fatalf("WriteIf failed: %v", err)
+	}
+	testRead(t, db, key, "bar")
+	if newETag := stat().ETag; newETag == etag {
+		t.Errorf("ETag should change after overwrite, got %q", newETag)
+	}
+	if err := writeIf("foobar", fsdb.IfMatch(etag)); !fsdb.IsPreconditionFailedError(err) {
+		t.Errorf("Expected PreconditionFailedError, got: %v", err)
+	}
+	testRead(t, db, key, "bar")
+	if err := writeIf("foobar", fsdb.IfExist); err != nil {
+		t.Fatalf("WriteIf failed: %v", err)
+	}
+	testRead(t, db, key, "foobar")
+
+	// Same content should have the same ETag
+	etag = stat().ETag
+	testWrite(t, db, key, "foobar")
+	if newETag := stat().ETag; newETag != etag {
+		t.Errorf("ETag expected %q, got %q", etag, newETag)
+	}
+}
+
+func TestWriteIfConcurrent(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	db := local.Open(local.NewDefaultOptions(root))
+
+	key := fsdb.Key("foo")
+	n := 10
+	var wg sync.WaitGroup
+	wg.Add(n)
+	succeeded := new(int64)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			err := db.WriteIf(ctx, key, strings.NewReader(lorem), fsdb.IfNotExist)
+			if err == nil {
+				atomic.AddInt64(succeeded, 1)
+			} else if !fsdb.IsPreconditionFailedError(err) {
+				t.Errorf("WriteIf failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if *succeeded != 1 {
+		t.Errorf("Expected exactly 1 WriteIf to succeed, got %d", *succeeded)
+	}
+}
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	opts := local.NewDefaultOptions(root)
+	db := local.Open(opts)
+
+	keys := make(map[string]bool)
+	keyFunc := func(ret bool) func(key fsdb.Key) bool {
+		return func(key fsdb.Key) bool {
+			keys[string(key)] = true
+			return ret
+		}
+	}
+	err = db.ScanKeys(ctx, keyFunc(true), fsdb.IgnoreAll)
+	if err != nil {
+		t.Fatalf("ScanKeys failed: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("Scan empty db got keys: %+v", keys)
+	}
+
+	expectKeys := map[string]bool{
+		"foo":    true,
+		"bar":    true,
+		"foobar": true,
+	}
+	for key := range expectKeys {
+		testWrite(t, db, fsdb.Key(key), "")
+	}
+	if err := db.ScanKeys(ctx, keyFunc(true), fsdb.StopAll); err != nil {
+		t.Fatalf("ScanKeys failed: %v", err)
+	}
+	if !reflect.DeepEqual(keys, expectKeys) {
+		t.Errorf("ScanKeys expected %+v, got %+v", expectKeys, keys)
+	}
+
+	keys = make(map[string]bool)
+	if err := db.ScanKeys(ctx, keyFunc(false), fsdb.StopAll); err != nil {
+		t.Fatalf("ScanKeys failed: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("Scan should stop after the first key, got: %+v", keys)
+	}
+}
+
+func TestResumeScan(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	db := local.Open(local.NewDefaultOptions(root))
+
+	n := 20
+	for i := 0; i < n; i++ {
+		testWrite(t, db, fsdb.Key(fmt.Sprintf("key%d", i)), "")
+	}
+
+	keys := make(map[string]int)
+	var cursor string
+	stopAfter := 3
+	for i := 0; ; i++ {
+		if i > n {
+			t.Fatalf("ResumeScanKeys did not finish after %d calls", i)
+		}
+		scanned := 0
+		if err := db.ResumeScanKeys(
+			ctx,
+			cursor,
+			func(key fsdb.Key, keyCursor string) bool {
+				if scanned >= stopAfter {
+					return false
+				}
+				scanned++
+				keys[string(key)]++
+				cursor = keyCursor
+				return true
+			},
+			fsdb.StopAll,
+		); err != nil {
+			t.Fatalf("ResumeScanKeys failed: %v", err)
+		}
+		if scanned < stopAfter {
+			break
+		}
+	}
+	if len(keys) != n {
+		t.Errorf("Expected %d keys, got %d: %v", n, len(keys), keys)
+	}
+	for key, count := range keys {
+		if count != 1 {
+			t.Errorf("Key %q visited %d times", key, count)
+		}
+	}
+}
+
+func TestScanParallel(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	db := local.Open(local.NewDefaultOptions(root))
+
+	var lock sync.Mutex
+	keys := make(map[string]int)
+	keyFunc := func(ret bool) func(key fsdb.Key) bool {
+		return func(key fsdb.Key) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			keys[string(key)]++
+			return ret
+		}
+	}
+
+	if err := db.ScanKeysParallel(ctx, 4, keyFunc(true), fsdb.StopAll); err != nil {
+		t.Fatalf("ScanKeysParallel failed: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("Scan empty db got keys: %+v", keys)
+	}
+
+	n := 50
+	for i := 0; i < n; i++ {
+		testWrite(t, db, fsdb.Key(fmt.Sprintf("key%d", i)), "")
+	}
+	if err := db.ScanKeysParallel(ctx, 4, keyFunc(true), fsdb.StopAll); err != nil {
+		t.Fatalf("ScanKeysParallel failed: %v", err)
+	}
+	if len(keys) != n {
+		t.Errorf("Expected %d keys, got %d: %v", n, len(keys), keys)
+	}
+	for key, count := range keys {
+		if count != 1 {
+			t.Errorf("Key %q visited %d times", key, count)
+		}
+	}
+
+	keys = make(map[string]int)
+	if err := db.ScanKeysParallel(ctx, 4, keyFunc(false), fsdb.StopAll); err != nil {
+		t.Fatalf("ScanKeysParallel failed: %v", err)
+	}
+	// Other workers could visit one more key each before stopping.
+	if len(keys) == 0 || len(keys) > 4 {
+		t.Errorf("Scan should stop after the first key, got: %+v", keys)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	keys := []string{
+		"",
+		"user/1",
+		"user/12",
+		"user/123/a",
+		"user/123/b",
+		"user/123456789/a-very-long-key-that-spans-multiple-index-levels",
+		"user/124",
+		"user/2",
+		"users",
+		"\xff\x00",
+	}
+
+	for _, useIndex := range []bool{true, false} {
+		t.Run(
+			fmt.Sprintf("index-%v", useIndex),
+			func(t *testing.T) {
+				os.RemoveAll(root)
+				db := local.Open(local.NewDefaultOptions(root).SetUseKeyIndex(useIndex))
+				for i := len(keys) - 1; i >= 0; i-- {
+					testWrite(t, db, fsdb.Key(keys[i]), "")
+				}
+				testWrite(t, db, fsdb.Key("deleted"), "")
+				testDelete(t, db, fsdb.Key("deleted"))
+
+				list := func(opts fsdb.ListOptions) ([]string, fsdb.Key) {
+					t.Helper()
+					listed, next, err := db.ListKeys(ctx, opts)
+					if err != nil {
+						t.Fatalf("ListKeys failed: %v", err)
+					}
+					actual := make([]string, len(listed))
+					for i, key := range listed {
+						actual[i] = string(key)
+					}
+					return actual, next
+				}
+
+				actual, next := list(fsdb.ListOptions{})
+				if !reflect.DeepEqual(actual, keys) {
+					t.Errorf("ListKeys expected %q, got %q", keys, actual)
+				}
+				if next != nil {
+					t.Errorf("next expected nil, got %q", next)
+				}
+
+				expect := []string{
+					"user/123/a",
+					"user/123/b",
+					"user/123456789/a-very-long-key-that-spans-multiple-index-levels",
+				}
+				actual, next = list(fsdb.ListOptions{Prefix: fsdb.Key("user/123")})
+				if !reflect.DeepEqual(actual, expect) {
+					t.Errorf("ListKeys expected %q, got %q", expect, actual)
+				}
+
+				// Pagination
+				var all []string
+				opts := fsdb.ListOptions{
+					Prefix: fsdb.Key("user/"),
+					Limit:  3,
+				}
+				for {
+					actual, next = list(opts)
+					if len(actual) > opts.Limit {
+						t.Fatalf("ListKeys returned more than %d keys: %q", opts.Limit, actual)
+					}
+					all = append(all, actual...)
+					if next == nil {
+						break
+					}
+					opts.StartAfter = next
+				}
+				expect = keys[1:8]
+				if !reflect.DeepEqual(all, expect) {
+					t.Errorf("ListKeys with pagination expected %q, got %q", expect, all)
+				}
+
+				actual, _ = list(fsdb.ListOptions{StartAfter: fsdb.Key("user/2")})
+				expect = keys[8:]
+				if !reflect.DeepEqual(actual, expect) {
+					t.Errorf("ListKeys expected %q, got %q", expect, actual)
+				}
+			},
+		)
+	}
+}
+
+func TestRebuildKeyIndex(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	indexed := local.NewDefaultOptions(root).SetUseKeyIndex(true)
+	db := local.Open(indexed)
+	testWrite(t, db, fsdb.Key("foo"), "")
+	testWrite(t, db, fsdb.Key("stale"), "")
+	noIndexDb := local.Open(local.NewDefaultOptions(root))
+	testWrite(t, noIndexDb, fsdb.Key("bar"), "")
+	testDelete(t, noIndexDb, fsdb.Key("stale"))
+
+	if err := local.RebuildKeyIndex(ctx, indexed); err != nil {
+		t.Fatalf("RebuildKeyIndex failed: %v", err)
+	}
+	keys, _, err := db.ListKeys(ctx, fsdb.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListKeys failed: %v", err)
+	}
+	expect := []fsdb.Key{fsdb.Key("bar"), fsdb.Key("foo")}
+	if !reflect.DeepEqual(keys, expect) {
+		t.Errorf("ListKeys expected %q, got %q", expect, keys)
+	}
+}
+
+func TestKeyTooLong(t *testing.T) {
+	ctx := context.Background()
+	root, err := ioutil.TempDir("", "fsdb_")
+	if err != nil {
+		t.Fatalf("failed to get tmp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	key := fsdb.Key(strings.Repeat("k", 2000))
+	db := local.Open(local.NewDefaultOptions(root).SetUseKeyIndex(true))
+	if err := db.Write(ctx, key, strings.NewReader("foo")); err != local.ErrKeyTooLong {
+		t.Errorf("Write expected ErrKeyTooLong, got %v", err)
+	}
+	if _, err := db.Read(ctx, key); !fsdb.IsNoSuchKeyError(err) {
+		t.Errorf("Read expected NoSuchKeyError, got %v", err)
+	}
+
+	txn, err := db.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	defer txn.Rollback()
+	if err := txn.Write(ctx, key, strings.NewReader("foo")); err != local.ErrKeyTooLong {
+		t.Errorf("Txn.Write expected ErrKeyTooLong, got %v", err)
+	}
+
+	// Without the key index it's fine.
+	testWrite(t, local.Open(local.NewDefaultOptions(root)), key, "foo")
 }
 
 func TestScanCancel(t *testing.T) {
@@ -222,6 +2439,10 @@ func BenchmarkReadWrite(b *testing.B) {
 		"gzip-min":      local.NewDefaultOptions(root).SetUseGzip(false).SetGzipLevel(gzip.BestSpeed),
 		"gzip-default":  local.NewDefaultOptions(root).SetUseGzip(false).SetGzipLevel(gzip.DefaultCompression),
 		"gzip-max":      local.NewDefaultOptions(root).SetUseGzip(false).SetGzipLevel(gzip.BestCompression),
+		"zstd-default":  local.NewDefaultOptions(root).SetCodec(codec.Zstd(0)),
+		"snappy":        local.NewDefaultOptions(root).SetCodec(codec.Snappy),
+		"sync-data":     local.NewDefaultOptions(root).SetUseGzip(false).SetSyncMode(local.SyncData),
+		"sync-full":     local.NewDefaultOptions(root).SetUseGzip(false).SetSyncMode(local.SyncFull),
 	}
 
 	for label, size := range benchmarkSizes {
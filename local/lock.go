@@ -0,0 +1,83 @@
+package local
+
+import (
+	"sync"
+
+	"github.com/fishy/rowlock"
+)
+
+// rowLock is a set of read-write locks by rows,
+// like rowlock.RowLock with rowlock.RWMutexNewLocker.
+//
+// Unlike rowlock.RowLock,
+// the lock of a row is freed once it's no longer held or waited on,
+// so the memory used doesn't grow with all the rows ever locked.
+type rowLock struct {
+	lock sync.Mutex
+	rows map[rowlock.Row]*rowLocker
+}
+
+type rowLocker struct {
+	sync.RWMutex
+
+	// refs is the number of the holders and waiters of the lock.
+	refs int
+}
+
+func newRowLock() *rowLock {
+	return &rowLock{
+		rows: make(map[rowlock.Row]*rowLocker),
+	}
+}
+
+// Lock locks a row.
+func (rl *rowLock) Lock(row rowlock.Row) {
+	rl.acquire(row).Lock()
+}
+
+// Unlock unlocks a row.
+func (rl *rowLock) Unlock(row rowlock.Row) {
+	rl.release(row).Unlock()
+}
+
+// RLock locks a row for read.
+func (rl *rowLock) RLock(row rowlock.Row) {
+	rl.acquire(row).RLock()
+}
+
+// RUnlock unlocks a row for read.
+func (rl *rowLock) RUnlock(row rowlock.Row) {
+	rl.release(row).RUnlock()
+}
+
+// acquire returns the lock of the row, creating it if needed,
+// and counts the caller as a holder.
+func (rl *rowLock) acquire(row rowlock.Row) *rowLocker {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	locker, ok := rl.rows[row]
+	if !ok {
+		locker = new(rowLocker)
+		rl.rows[row] = locker
+	}
+	locker.refs++
+	return locker
+}
+
+// release returns the lock of the row held by the caller,
+// and frees it if there are no other holders or waiters.
+//
+// It's safe to unlock the returned lock after it's freed,
+// as a new lock is created for the row by the next acquire.
+func (rl *rowLock) release(row rowlock.Row) *rowLocker {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	locker := rl.rows[row]
+	locker.refs--
+	if locker.refs == 0 {
+		delete(rl.rows, row)
+	}
+	return locker
+}
@@ -0,0 +1,106 @@
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// entryMeta is the metadata of an entry, stored in MetaFilename.
+//
+// Entries written by older versions don't have MetaFilename,
+// in which case all fields are zero values.
+type entryMeta struct {
+	ETag    string     `json:"etag,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// Checksum is the checksum of the uncompressed data,
+	// in "<algorithm>:<hex>" format.
+	Checksum string `json:"checksum,omitempty"`
+
+	// KeyID is the ID of the key encrypting the data file,
+	// or empty if the data file is not encrypted.
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// expired returns the expiration time if the entry is already expired,
+// or zero time otherwise.
+func (meta *entryMeta) expired() time.Time {
+	if meta.Expires != nil && !meta.Expires.After(time.Now()) {
+		return *meta.Expires
+	}
+	return time.Time{}
+}
+
+// readMeta reads the entry metadata under the entry directory.
+//
+// Empty or invalid meta files (e.g. left by power losses without fsync) are
+// treated the same as missing ones,
+// so the entry is still readable, only without ETag and checksum.
+func readMeta(dir string) (*entryMeta, error) {
+	content, err := ioutil.ReadFile(dir + MetaFilename)
+	if os.IsNotExist(err) {
+		return new(entryMeta), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := new(entryMeta)
+	if err := json.Unmarshal(content, meta); err != nil {
+		return new(entryMeta), nil
+	}
+	return meta, nil
+}
+
+// writeMeta writes the entry metadata into the given path.
+func writeMeta(path string, meta *entryMeta, sync bool) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, content, sync)
+}
+
+// readMetadata reads the user-defined metadata under the entry directory.
+//
+// It returns nil map if the entry has no metadata.
+func readMetadata(dir string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(dir + MetadataFilename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// writeMetadata writes the user-defined metadata into the given path.
+func writeMetadata(path string, metadata map[string]string, sync bool) error {
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, content, sync)
+}
+
+// newETagHash returns the hash used to calculate ETags,
+// which is crc32c.
+func newETagHash() hash.Hash32 {
+	return crc32.New(crc32cTable)
+}
+
+// formatETag formats an ETag from the crc32c and size of the data.
+func formatETag(h hash.Hash32, size int64) string {
+	return fmt.Sprintf("%08x-%x", h.Sum32(), size)
+}
@@ -7,8 +7,11 @@ import (
 	"hash"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/fishy/fsdb"
+	"github.com/fishy/fsdb/codec"
+	"github.com/fishy/fsdb/crypt"
 )
 
 const charsPerLevel = 2
@@ -18,15 +21,96 @@ const PathSeparator = string(os.PathSeparator)
 
 // Default options values.
 const (
-	DefaultDataDir = "data" + PathSeparator
-	DefaultTempDir = "_tmp" + PathSeparator
+	DefaultDataDir  = "data" + PathSeparator
+	DefaultTempDir  = "_tmp" + PathSeparator
+	DefaultIndexDir = "_index" + PathSeparator
 
 	DefaultDirLevel = 3
 
+	DefaultUseCollisionSlots = false
+
 	DefaultUseGzip   = false
 	DefaultGzipLevel = gzip.DefaultCompression
+
+	DefaultUseKeyIndex = false
+
+	DefaultBatchThreadNum = 10
+
+	DefaultKeepVersions                  = 0
+	DefaultKeepVersionsFor time.Duration = 0
+
+	DefaultSyncMode = SyncNone
+
+	DefaultStaleTempDirAge = time.Hour
+
+	DefaultChecksumAlgorithm = ChecksumCRC32C
 )
 
+// SyncMode defines how writes are flushed to the disk.
+type SyncMode int
+
+// SyncMode values.
+const (
+	// SyncNone never calls fsync,
+	// and relies on the filesystem to flush the writes eventually.
+	//
+	// A power loss could leave an empty or missing data file even though the
+	// write operation returned nil error.
+	SyncNone SyncMode = iota
+
+	// SyncData fsyncs all the temporary files (data, key and meta files) before
+	// moving them into the entry directory.
+	//
+	// A power loss could still leave the files missing.
+	SyncData
+
+	// SyncFull fsyncs all the temporary files before moving them into the entry
+	// directory, and fsyncs the entry directory (and parent directories created)
+	// after that.
+	SyncFull
+)
+
+func (mode SyncMode) String() string {
+	switch mode {
+	default:
+		return "unknown"
+	case SyncNone:
+		return "none"
+	case SyncData:
+		return "data"
+	case SyncFull:
+		return "full"
+	}
+}
+
+// ChecksumAlgorithm defines the algorithm used by the checksums of entries.
+type ChecksumAlgorithm int
+
+// ChecksumAlgorithm values.
+const (
+	// ChecksumCRC32C uses crc32c (Castagnoli),
+	// which is fast and good enough to detect random bit rots.
+	ChecksumCRC32C ChecksumAlgorithm = iota
+
+	// ChecksumSHA256 uses SHA-256.
+	ChecksumSHA256
+)
+
+func (algo ChecksumAlgorithm) String() string {
+	switch algo {
+	default:
+		return "unknown"
+	case ChecksumCRC32C:
+		return "crc32c"
+	case ChecksumSHA256:
+		return "sha256"
+	}
+}
+
+// DefaultCompressionPolicy is the default compression policy,
+// which always compresses data when a codec is used.
+var DefaultCompressionPolicy = codec.AlwaysCompress
+
 // DefaultHashFunc is the default hash function, which is SHA-512/224.
 //
 // It's chosen because it gives us relatively shorter hash results,
@@ -49,15 +133,89 @@ type Options interface {
 	// GetDirForKey returns the directory to put entry in,
 	// guaranteed to end with PathSeparator and guaranteed to be under root data
 	// directory.
+	//
+	// With collision slots, entries are put in the slot directories under it.
 	GetDirForKey(key fsdb.Key) string
 
+	// GetUseCollisionSlots returns whether to store keys with the same hash in
+	// numbered slot directories under the directory returned by GetDirForKey,
+	// instead of returning KeyCollisionError.
+	GetUseCollisionSlots() bool
+
 	GetUseGzip() bool
 	GetGzipLevel() int
+
+	// GetCodec returns the codec used to compress new entries.
+	//
+	// It's the codec set by SetCodec if any,
+	// otherwise it's gzip or none based on the gzip options.
+	GetCodec() codec.Codec
+
+	// GetCodecs returns all the codecs data files could be written in,
+	// in the order Read looks for them.
+	//
+	// They are the codec returned by GetCodec,
+	// the codecs registered by RegisterCodecs,
+	// and the built-in codecs,
+	// with duplicated suffixes removed.
+	GetCodecs() []codec.Codec
+
+	// GetCompressionPolicy returns the policy deciding whether to compress each
+	// new entry.
+	GetCompressionPolicy() codec.Policy
+
+	// GetEncryptor returns the encryptor used to encrypt new entries,
+	// or nil if encryption is disabled.
+	GetEncryptor() *crypt.Encryptor
+
+	// GetEncryptKeys returns whether to also encrypt the key files of new
+	// entries.
+	//
+	// It's only used when GetEncryptor returns non-nil.
+	GetEncryptKeys() bool
+
+	// GetRootIndexDir returns the full path of the root key index directory,
+	// guaranteed to end with PathSeparator.
+	GetRootIndexDir() string
+
+	// GetUseKeyIndex returns whether to maintain the key index used by ListKeys.
+	GetUseKeyIndex() bool
+
+	// GetBatchThreadNum returns the number of threads used by each batch
+	// operation.
+	GetBatchThreadNum() int
+
+	// GetKeepVersions returns the number of noncurrent versions to keep for
+	// each entry.
+	GetKeepVersions() int
+
+	// GetKeepVersionsFor returns the duration to keep noncurrent versions after
+	// they are overwritten.
+	GetKeepVersionsFor() time.Duration
+
+	// GetSyncMode returns how writes are flushed to the disk.
+	GetSyncMode() SyncMode
+
+	// GetStaleTempDirAge returns the duration after which an unmodified temp
+	// directory is considered left by a crash.
+	GetStaleTempDirAge() time.Duration
+
+	// GetChecksumAlgorithm returns the algorithm used by the checksums of new
+	// entries.
+	GetChecksumAlgorithm() ChecksumAlgorithm
 }
 
 // OptionsBuilder defines a read-write view of options used by local fsdb.
 //
-// Gzip related options are safe to change on an existing FSDB system.
+// Gzip, codec and compression policy options are safe to change on an
+// existing FSDB system, as long as the codecs previously used are still
+// registered.
+// Encryption options are safe to change on an existing FSDB system,
+// as long as the encryptor can still provide the keys previously used.
+// Key index related options are safe to change on an existing FSDB system,
+// but you need to call RebuildKeyIndex after turning it on.
+// Versioning, sync mode, stale temp dir age and checksum options are safe to
+// change on an existing FSDB system.
 // Changing other options will break the existing FSDB system.
 type OptionsBuilder interface {
 	Options
@@ -83,21 +241,136 @@ type OptionsBuilder interface {
 	// convert to directory name "de/ad/beef/".
 	SetDirLevel(level int) OptionsBuilder
 
+	// SetUseCollisionSlots sets whether to store keys with the same hash in
+	// numbered slot directories under the hashed directory
+	// (e.g. "de/ad/beef/0/", "de/ad/beef/1/"),
+	// instead of returning KeyCollisionError on the second key.
+	//
+	// It's useful with a weak hash function set by SetHashFunc,
+	// at the cost of an extra directory level and listing the slots on every
+	// operation.
+	SetUseCollisionSlots(slots bool) OptionsBuilder
+
 	// SetUseGzip sets whether to use gzip for storage.
 	SetUseGzip(gzip bool) OptionsBuilder
 
 	// SetGzipLevel sets the level used in gzip compression.
 	SetGzipLevel(level int) OptionsBuilder
+
+	// SetCodec sets the codec used to compress new entries.
+	//
+	// It overrides SetUseGzip and SetGzipLevel.
+	// Setting it to nil makes the gzip options take effect again.
+	SetCodec(c codec.Codec) OptionsBuilder
+
+	// RegisterCodecs registers custom codecs,
+	// so that entries written with them can be read.
+	//
+	// The built-in codecs are always registered.
+	RegisterCodecs(codecs ...codec.Codec) OptionsBuilder
+
+	// SetCompressionPolicy sets the policy deciding whether to compress each new
+	// entry.
+	//
+	// With an adaptive policy (e.g. codec.DefaultAdaptivePolicy),
+	// writes buffer the sample in memory before deciding,
+	// and store the entry uncompressed if compressing the sample doesn't save
+	// enough.
+	SetCompressionPolicy(p codec.Policy) OptionsBuilder
+
+	// SetEncryptor sets the encryptor used to encrypt new entries.
+	//
+	// Setting it to nil disables encryption of new entries,
+	// but an encryptor is still needed to read the encrypted ones.
+	// Call RotateKeys to re-encrypt existing entries after changing it or its
+	// current key.
+	SetEncryptor(e *crypt.Encryptor) OptionsBuilder
+
+	// SetEncryptKeys sets whether to also encrypt the key files of new entries.
+	//
+	// The intent files of transactions, which contain the keys,
+	// are also encrypted.
+	//
+	// Please note that the entry directories are still named by the hash of the
+	// keys,
+	// and the key index (if used) stores the keys unencrypted.
+	SetEncryptKeys(encrypt bool) OptionsBuilder
+
+	// SetIndexDir sets the relative key index directory within the root
+	// directory.
+	SetIndexDir(dir string) OptionsBuilder
+
+	// SetUseKeyIndex sets whether to maintain a key index.
+	//
+	// The key index makes ListKeys fast,
+	// at the cost of an extra file per key and extra IO on writes and deletes.
+	SetUseKeyIndex(index bool) OptionsBuilder
+
+	// SetBatchThreadNum sets the number of threads used by each batch operation
+	// (ReadMany, WriteMany and DeleteMany).
+	SetBatchThreadNum(threads int) OptionsBuilder
+
+	// SetKeepVersions sets the number of noncurrent versions to keep for each
+	// entry.
+	//
+	// Versioning is enabled when either this or SetKeepVersionsFor is set to a
+	// positive value.
+	// A noncurrent version is kept if it's within the newest n ones,
+	// or it's overwritten within the duration set by SetKeepVersionsFor.
+	SetKeepVersions(n int) OptionsBuilder
+
+	// SetKeepVersionsFor sets the duration to keep noncurrent versions after
+	// they are overwritten.
+	//
+	// See SetKeepVersions for more details.
+	SetKeepVersionsFor(d time.Duration) OptionsBuilder
+
+	// SetSyncMode sets how writes are flushed to the disk.
+	//
+	// The more durable the mode, the slower the writes.
+	SetSyncMode(mode SyncMode) OptionsBuilder
+
+	// SetStaleTempDirAge sets the duration after which an unmodified temp
+	// directory is considered left by a crash,
+	// thus will be recovered and removed by Open and Recover.
+	//
+	// It should be longer than any write or transaction could stay idle.
+	// Setting it to 0 makes all temp directories stale,
+	// which is only safe when no one else is using the same FSDB.
+	SetStaleTempDirAge(d time.Duration) OptionsBuilder
+
+	// SetChecksumAlgorithm sets the algorithm used by the checksums of new
+	// entries.
+	//
+	// The algorithm is stored along with the checksum,
+	// so existing entries are still verified with their own algorithms.
+	// crc32c checksums are not stored separately,
+	// as the ETags already have them.
+	SetChecksumAlgorithm(algo ChecksumAlgorithm) OptionsBuilder
 }
 
 type options struct {
 	root      string
 	data      string
 	tmp       string
+	index     string
 	hashFunc  func() hash.Hash
 	dirLevel  int
+	slots     bool
 	useGzip   bool
 	gzipLevel int
+	useIndex  bool
+	threads   int
+	keep      int
+	keepFor   time.Duration
+	syncMode  SyncMode
+	staleAge  time.Duration
+	checksum  ChecksumAlgorithm
+	codec     codec.Codec
+	codecs    []codec.Codec
+	policy    codec.Policy
+	encryptor *crypt.Encryptor
+	encKeys   bool
 }
 
 // NewDefaultOptions creates an OptionsBuilder with default options.
@@ -109,10 +382,20 @@ func NewDefaultOptions(root string) OptionsBuilder {
 		root:      root,
 		data:      DefaultDataDir,
 		tmp:       DefaultTempDir,
+		index:     DefaultIndexDir,
 		hashFunc:  DefaultHashFunc,
 		dirLevel:  DefaultDirLevel,
+		slots:     DefaultUseCollisionSlots,
 		useGzip:   DefaultUseGzip,
 		gzipLevel: DefaultGzipLevel,
+		useIndex:  DefaultUseKeyIndex,
+		threads:   DefaultBatchThreadNum,
+		keep:      DefaultKeepVersions,
+		keepFor:   DefaultKeepVersionsFor,
+		syncMode:  DefaultSyncMode,
+		staleAge:  DefaultStaleTempDirAge,
+		checksum:  DefaultChecksumAlgorithm,
+		policy:    DefaultCompressionPolicy,
 	}
 }
 
@@ -148,6 +431,10 @@ func (opts *options) GetDirForKey(key fsdb.Key) string {
 	return path
 }
 
+func (opts *options) GetUseCollisionSlots() bool {
+	return opts.slots
+}
+
 func (opts *options) GetUseGzip() bool {
 	return opts.useGzip
 }
@@ -156,6 +443,75 @@ func (opts *options) GetGzipLevel() int {
 	return opts.gzipLevel
 }
 
+func (opts *options) GetCodec() codec.Codec {
+	if opts.codec != nil {
+		return opts.codec
+	}
+	if opts.useGzip {
+		return codec.Gzip(opts.gzipLevel)
+	}
+	return codec.None
+}
+
+func (opts *options) GetCodecs() []codec.Codec {
+	all := append([]codec.Codec{opts.GetCodec()}, opts.codecs...)
+	all = append(all, codec.Builtins()...)
+	codecs := make([]codec.Codec, 0, len(all))
+	suffixes := make(map[string]bool)
+	for _, c := range all {
+		if suffixes[c.Suffix()] {
+			continue
+		}
+		suffixes[c.Suffix()] = true
+		codecs = append(codecs, c)
+	}
+	return codecs
+}
+
+func (opts *options) GetCompressionPolicy() codec.Policy {
+	return opts.policy
+}
+
+func (opts *options) GetEncryptor() *crypt.Encryptor {
+	return opts.encryptor
+}
+
+func (opts *options) GetEncryptKeys() bool {
+	return opts.encKeys
+}
+
+func (opts *options) GetRootIndexDir() string {
+	return opts.root + opts.index
+}
+
+func (opts *options) GetUseKeyIndex() bool {
+	return opts.useIndex
+}
+
+func (opts *options) GetBatchThreadNum() int {
+	return opts.threads
+}
+
+func (opts *options) GetKeepVersions() int {
+	return opts.keep
+}
+
+func (opts *options) GetKeepVersionsFor() time.Duration {
+	return opts.keepFor
+}
+
+func (opts *options) GetSyncMode() SyncMode {
+	return opts.syncMode
+}
+
+func (opts *options) GetStaleTempDirAge() time.Duration {
+	return opts.staleAge
+}
+
+func (opts *options) GetChecksumAlgorithm() ChecksumAlgorithm {
+	return opts.checksum
+}
+
 func (opts *options) Build() Options {
 	return opts
 }
@@ -186,6 +542,11 @@ func (opts *options) SetDirLevel(level int) OptionsBuilder {
 	return opts
 }
 
+func (opts *options) SetUseCollisionSlots(slots bool) OptionsBuilder {
+	opts.slots = slots
+	return opts
+}
+
 func (opts *options) SetUseGzip(gzip bool) OptionsBuilder {
 	opts.useGzip = gzip
 	return opts
@@ -195,3 +556,71 @@ func (opts *options) SetGzipLevel(level int) OptionsBuilder {
 	opts.gzipLevel = level
 	return opts
 }
+
+func (opts *options) SetCodec(c codec.Codec) OptionsBuilder {
+	opts.codec = c
+	return opts
+}
+
+func (opts *options) RegisterCodecs(codecs ...codec.Codec) OptionsBuilder {
+	opts.codecs = append(opts.codecs, codecs...)
+	return opts
+}
+
+func (opts *options) SetCompressionPolicy(p codec.Policy) OptionsBuilder {
+	opts.policy = p
+	return opts
+}
+
+func (opts *options) SetEncryptor(e *crypt.Encryptor) OptionsBuilder {
+	opts.encryptor = e
+	return opts
+}
+
+func (opts *options) SetEncryptKeys(encrypt bool) OptionsBuilder {
+	opts.encKeys = encrypt
+	return opts
+}
+
+func (opts *options) SetIndexDir(dir string) OptionsBuilder {
+	if !strings.HasSuffix(dir, PathSeparator) {
+		dir += PathSeparator
+	}
+	opts.index = dir
+	return opts
+}
+
+func (opts *options) SetUseKeyIndex(index bool) OptionsBuilder {
+	opts.useIndex = index
+	return opts
+}
+
+func (opts *options) SetBatchThreadNum(threads int) OptionsBuilder {
+	opts.threads = threads
+	return opts
+}
+
+func (opts *options) SetKeepVersions(n int) OptionsBuilder {
+	opts.keep = n
+	return opts
+}
+
+func (opts *options) SetKeepVersionsFor(d time.Duration) OptionsBuilder {
+	opts.keepFor = d
+	return opts
+}
+
+func (opts *options) SetSyncMode(mode SyncMode) OptionsBuilder {
+	opts.syncMode = mode
+	return opts
+}
+
+func (opts *options) SetStaleTempDirAge(d time.Duration) OptionsBuilder {
+	opts.staleAge = d
+	return opts
+}
+
+func (opts *options) SetChecksumAlgorithm(algo ChecksumAlgorithm) OptionsBuilder {
+	opts.checksum = algo
+	return opts
+}
@@ -49,6 +49,13 @@ func TestOptions(t *testing.T) {
 			if expect != actual {
 				t.Errorf("data dir expected %q, got %q", expect, actual)
 			}
+
+			opts.SetIndexDir("index")
+			expect = "/foobar" + local.PathSeparator + "index" + local.PathSeparator
+			actual = opts.GetRootIndexDir()
+			if expect != actual {
+				t.Errorf("index dir expected %q, got %q", expect, actual)
+			}
 		},
 	)
 
@@ -0,0 +1,338 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fishy/errbatch"
+
+	"github.com/fishy/fsdb"
+	"github.com/fishy/fsdb/codec"
+	"github.com/fishy/fsdb/crypt"
+)
+
+func (db *impl) Recover(ctx context.Context) error {
+	var errs errbatch.ErrBatch
+	errs.Add(db.recoverPendingTxns(ctx))
+	errs.Add(db.recoverTempDirs(ctx))
+	errs.Add(db.removeUncommittedEntries(ctx))
+	return errs.Compile()
+}
+
+// removeUncommittedEntries walks the root data directory and removes the files
+// of half committed entries, using removeUncommitted.
+//
+// Errors are combined and returned after the walk.
+func (db *impl) removeUncommittedEntries(ctx context.Context) error {
+	dataFiles := make(map[string]bool)
+	for _, filename := range db.dataFilenames() {
+		dataFiles[filename] = true
+	}
+	var errs errbatch.ErrBatch
+	errs.Add(filepath.Walk(
+		db.opts.GetRootDataDir(),
+		func(path string, info os.FileInfo, err error) error {
+			select {
+			default:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			if err != nil {
+				if !os.IsNotExist(err) {
+					errs.Add(err)
+				}
+				return nil
+			}
+			if info.IsDir() && info.Name() == VersionsDirname {
+				return filepath.SkipDir
+			}
+			if !info.IsDir() && dataFiles[info.Name()] {
+				errs.Add(db.removeUncommitted(filepath.Dir(path) + PathSeparator))
+			}
+			return nil
+		},
+	))
+	return errs.Compile()
+}
+
+// recoverTempDirs recovers the stale temp directories under the root temp
+// directory, then removes them.
+func (db *impl) recoverTempDirs(ctx context.Context) error {
+	dirs, err := db.staleTempDirs(ctx)
+	var errs errbatch.ErrBatch
+	errs.Add(err)
+	for _, dir := range dirs {
+		select {
+		default:
+		case <-ctx.Done():
+			errs.Add(ctx.Err())
+			return errs.Compile()
+		}
+
+		errs.Add(db.recoverTempDir(dir))
+	}
+	return errs.Compile()
+}
+
+// staleTempDirs returns the stale temp directories under the root temp
+// directory.
+//
+// Errors are combined and returned along with the directories successfully
+// checked.
+func (db *impl) staleTempDirs(ctx context.Context) ([]string, error) {
+	root := db.opts.GetRootTempDir()
+	infos, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	var errs errbatch.ErrBatch
+	for _, info := range infos {
+		select {
+		default:
+		case <-ctx.Done():
+			errs.Add(ctx.Err())
+			return dirs, errs.Compile()
+		}
+
+		if !info.IsDir() || !strings.HasPrefix(info.Name(), tempDirPrefix) {
+			continue
+		}
+		dir := root + info.Name() + PathSeparator
+		modified, err := lastModified(dir)
+		if err != nil {
+			// Not exist errors are caused by the owner finishing its work.
+			if !os.IsNotExist(err) {
+				errs.Add(err)
+			}
+			continue
+		}
+		// Pending transactions have their rows locked,
+		// and are recovered by recoverPendingTxns instead.
+		if db.isStale(modified) && !db.isPendingTxn(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, errs.Compile()
+}
+
+// recoverTempDir recovers the temp directory,
+// then removes it.
+//
+// Transactions with intent files are rolled forward,
+// and the others are rolled back.
+// Writes interrupted after the data file is moved are finished,
+// and the others are discarded.
+//
+// If the recovery failed, the temp directory is kept to be retried later.
+func (db *impl) recoverTempDir(dir string) error {
+	var err error
+	if strings.HasPrefix(filepath.Base(dir), txnDirPrefix) {
+		err = db.recoverTxn(dir)
+	} else {
+		err = db.recoverWrite(dir)
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// isStale returns true if the modification time is older than the stale temp
+// dir age.
+func (db *impl) isStale(modified time.Time) bool {
+	return time.Since(modified) >= db.opts.GetStaleTempDirAge()
+}
+
+// recoverTxn rolls the transaction under dir forward if it's committed.
+func (db *impl) recoverTxn(dir string) error {
+	content, err := ioutil.ReadFile(dir + intentFilename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if crypt.IsEncrypted(content) {
+		e := db.opts.GetEncryptor()
+		if e == nil {
+			return errNoEncryptor
+		}
+		if content, err = e.Decrypt(content); err != nil {
+			return err
+		}
+	}
+	var ops []*txnOp
+	if err := json.Unmarshal(content, &ops); err != nil {
+		return err
+	}
+
+	rows := make([]string, len(ops))
+	for i, op := range ops {
+		rows[i] = string(op.Key)
+	}
+	sort.Strings(rows)
+	for _, row := range rows {
+		db.locks.Lock(row)
+		defer db.locks.Unlock(row)
+	}
+	return db.applyTxn(dir, ops)
+}
+
+// recoverWrite finishes the write interrupted after its data file is moved
+// from tmpdir into the entry directory.
+//
+// If the entry is already overwritten by another write since,
+// it's left untouched.
+func (db *impl) recoverWrite(tmpdir string) error {
+	// The key file is the last one moved,
+	// so if it's missing there's nothing to recover.
+	key, err := db.readKey(tmpdir + KeyFilename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// If the data file is still here, the commit never started.
+	for _, filename := range db.dataFilenames() {
+		if _, err := os.Lstat(tmpdir + filename); err == nil {
+			return nil
+		}
+	}
+
+	db.locks.Lock(string(key))
+	defer db.locks.Unlock(string(key))
+	unlock := db.lockSlots(key)
+	defer unlock()
+
+	dirs, err := db.candidateDirs(key)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if recovered, err := db.recoverWriteInto(tmpdir, dir, key); recovered || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverWriteInto finishes the write interrupted after its data file is moved
+// from tmpdir into dir,
+// and returns true if the data file is found in dir.
+func (db *impl) recoverWriteInto(tmpdir, dir string, key fsdb.Key) (bool, error) {
+	metaDir := tmpdir
+	if _, err := os.Lstat(tmpdir + MetaFilename); os.IsNotExist(err) {
+		// The meta file is also moved.
+		metaDir = dir
+	}
+	meta, err := readMeta(metaDir)
+	if err != nil {
+		return false, err
+	}
+	if meta.ETag == "" {
+		return false, nil
+	}
+	for _, c := range db.opts.GetCodecs() {
+		etag, err := db.dataETag(dir, c, meta)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if etag != meta.ETag {
+			continue
+		}
+		if err := db.checkIndexKey(key); err != nil {
+			return true, err
+		}
+		if err := db.commitEntry(tmpdir, dir, dataFilename(c), true); err != nil {
+			return true, err
+		}
+		if db.opts.GetUseKeyIndex() {
+			return true, db.addIndex(key)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// removeUncommitted removes the files under the entry directory left by a
+// write interrupted before the key file is moved,
+// which makes the entry invisible to reads and scans.
+//
+// It's a no-op if the entry has the key file,
+// or the entry directory is modified recently,
+// as the write could be still in progress.
+func (db *impl) removeUncommitted(dir string) error {
+	if _, err := os.Lstat(dir + KeyFilename); !os.IsNotExist(err) {
+		return err
+	}
+	// Moving files into the directory updates its modification time.
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !db.isStale(info.ModTime()) {
+		return nil
+	}
+	var errs errbatch.ErrBatch
+	for _, filename := range append(
+		db.dataFilenames(),
+		MetadataFilename,
+		MetaFilename,
+	) {
+		if err := os.Remove(dir + filename); err != nil && !os.IsNotExist(err) {
+			errs.Add(err)
+		}
+	}
+	return errs.Compile()
+}
+
+// dataETag calculates the ETag of the data file compressed by the codec under
+// dir, with the meta it's written with.
+func (db *impl) dataETag(dir string, c codec.Codec, meta *entryMeta) (string, error) {
+	reader, err := db.openDataFile(dir, c, meta)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	h := newETagHash()
+	size, err := io.Copy(h, reader)
+	if err != nil {
+		return "", err
+	}
+	return formatETag(h, size), nil
+}
+
+// lastModified returns the latest modification time of dir and everything
+// under it.
+func lastModified(dir string) (time.Time, error) {
+	var latest time.Time
+	err := filepath.Walk(
+		dir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+			return nil
+		},
+	)
+	return latest, err
+}
@@ -0,0 +1,174 @@
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/fishy/fsdb"
+)
+
+// With collision slots,
+// the entries of all the keys sharing the same hash are stored in numbered
+// slot directories under the hashed directory:
+//     <hashed-dir>/0/
+//     <hashed-dir>/1/
+// Slots are resolved by comparing the key files under them.
+
+// slotsRow is the row locked while allocating collision slots under the
+// hashed directory.
+//
+// It's a different type from the rows of keys so that they never conflict.
+// When both are needed, the row of the key is always locked first.
+type slotsRow string
+
+// isSlotName returns true if name is a valid slot directory name.
+func isSlotName(name string) bool {
+	n, err := strconv.Atoi(name)
+	return err == nil && n >= 0 && strconv.Itoa(n) == name
+}
+
+// slotDir returns the nth slot directory under the hashed directory.
+func slotDir(dir string, n int) string {
+	return dir + strconv.Itoa(n) + PathSeparator
+}
+
+// isEntryDirOf returns true if dir is a valid entry directory of the key,
+// without checking the key file under it.
+func (db *impl) isEntryDirOf(key fsdb.Key, dir string) bool {
+	expected := db.opts.GetDirForKey(key)
+	if !db.opts.GetUseCollisionSlots() {
+		return dir == expected
+	}
+	clean := filepath.Clean(dir)
+	return filepath.Dir(clean)+PathSeparator == expected &&
+		isSlotName(filepath.Base(clean))
+}
+
+// checkKey checks that the key exists without collision,
+// and returns its entry directory.
+//
+// It returns NoSuchKeyError if the key doesn't exist.
+// Without collision slots,
+// it returns KeyCollisionError if another key is stored in its directory.
+func (db *impl) checkKey(key fsdb.Key) (dir string, err error) {
+	dir = db.opts.GetDirForKey(key)
+	if !db.opts.GetUseCollisionSlots() {
+		keyFile := dir + KeyFilename
+		if _, err := os.Lstat(keyFile); os.IsNotExist(err) {
+			return "", &fsdb.NoSuchKeyError{Key: key}
+		}
+		if err := db.checkKeyCollision(key, keyFile); err != nil {
+			return "", err
+		}
+		return dir, nil
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return "", &fsdb.NoSuchKeyError{Key: key}
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, info := range infos {
+		if !info.IsDir() || !isSlotName(info.Name()) {
+			continue
+		}
+		slot := dir + info.Name() + PathSeparator
+		old, err := db.readKey(slot + KeyFilename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if key.Equals(old) {
+			return slot, nil
+		}
+	}
+	return "", &fsdb.NoSuchKeyError{Key: key}
+}
+
+// allocEntry returns the entry directory to write the key into.
+//
+// It's the entry directory of the key if it already exists.
+// Otherwise with collision slots,
+// it's the first slot without a key file,
+// so replaying an interrupted commit always gets the same slot.
+//
+// With collision slots,
+// the caller must hold the lock returned by lockSlots until the entry is
+// committed.
+func (db *impl) allocEntry(key fsdb.Key) (string, error) {
+	dir, err := db.checkKey(key)
+	if !fsdb.IsNoSuchKeyError(err) {
+		return dir, err
+	}
+	dir = db.opts.GetDirForKey(key)
+	if !db.opts.GetUseCollisionSlots() {
+		return dir, nil
+	}
+	for n := 0; ; n++ {
+		slot := slotDir(dir, n)
+		_, err := os.Lstat(slot + KeyFilename)
+		if os.IsNotExist(err) {
+			return slot, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// lockSlots locks the collision slots of the key if they are used,
+// and returns the function to unlock them.
+func (db *impl) lockSlots(key fsdb.Key) (unlock func()) {
+	if !db.opts.GetUseCollisionSlots() {
+		return func() {}
+	}
+	row := slotsRow(db.opts.GetDirForKey(key))
+	db.locks.Lock(row)
+	return func() {
+		db.locks.Unlock(row)
+	}
+}
+
+// candidateDirs returns the entry directories an interrupted commit of the key
+// could have moved its files into.
+//
+// With collision slots,
+// it's the slot of the key if it exists,
+// otherwise all the slots without key files.
+func (db *impl) candidateDirs(key fsdb.Key) ([]string, error) {
+	dir := db.opts.GetDirForKey(key)
+	if !db.opts.GetUseCollisionSlots() {
+		return []string{dir}, nil
+	}
+	slot, err := db.checkKey(key)
+	if err == nil {
+		return []string{slot}, nil
+	}
+	if !fsdb.IsNoSuchKeyError(err) {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, info := range infos {
+		if !info.IsDir() || !isSlotName(info.Name()) {
+			continue
+		}
+		slot := dir + info.Name() + PathSeparator
+		if _, err := os.Lstat(slot + KeyFilename); os.IsNotExist(err) {
+			dirs = append(dirs, slot)
+		}
+	}
+	return dirs, nil
+}
@@ -0,0 +1,439 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/fishy/errbatch"
+
+	"github.com/fishy/fsdb"
+)
+
+// Make sure *txn satisfies Txn interface.
+var _ Txn = (*txn)(nil)
+
+// Make sure *TxnIncompleteError satisfies error interface.
+var _ error = (*TxnIncompleteError)(nil)
+
+const (
+	txnDirPrefix = "fsdb_txn_"
+
+	// intentFilename is the write-ahead intent file under the transaction
+	// directory.
+	// Its existence means the transaction is committed.
+	intentFilename = "intent"
+	// tmpIntentFilename is the intent file being written.
+	tmpIntentFilename = "intent.tmp"
+)
+
+var errTxnClosed = errors.New("fsdb/local: transaction already closed")
+
+// TxnIncompleteError is an error returned by Txn.Commit when the transaction
+// is committed,
+// but failed to be fully applied.
+//
+// The rows of the transaction are kept locked,
+// so that the partially applied transaction is never visible,
+// until Recover of the same DB finishes applying it.
+type TxnIncompleteError struct {
+	Err error
+}
+
+func (err *TxnIncompleteError) Error() string {
+	return fmt.Sprintf(
+		"fsdb/local: transaction committed but not fully applied, call Recover to finish it: %v",
+		err.Err,
+	)
+}
+
+// pendingTxn is a committed transaction failed to be fully applied,
+// with its rows still locked.
+type pendingTxn struct {
+	dir  string
+	ops  []*txnOp
+	rows []string
+}
+
+// Txn is a transaction of multiple keys on the local FSDB.
+//
+// All changes are staged in a temporary directory,
+// and are not visible to others until Commit.
+// Commit either applies all the changes or none of them.
+// Readers are blocked while the changes are being applied,
+// so they will never see some of the changes without the others.
+//
+// When multiple changes to the same key are made in a transaction,
+// only the last one is kept.
+//
+// A Txn is not safe for concurrent use.
+// It can't be used after Commit or Rollback.
+type Txn interface {
+	// Write stages writing data to the key.
+	//
+	// data is read fully before Write returns.
+	Write(ctx context.Context, key fsdb.Key, data io.Reader) error
+
+	// Delete stages deleting the key.
+	//
+	// If the key doesn't exist at Commit time,
+	// Commit will return NoSuchKeyError.
+	Delete(ctx context.Context, key fsdb.Key) error
+
+	// Commit applies all staged changes atomically.
+	//
+	// The transaction is closed after Commit regardless of the result.
+	//
+	// If the transaction is committed but failed to be fully applied,
+	// it returns *TxnIncompleteError,
+	// and the keys stay locked until Recover of the same DB finishes applying
+	// it.
+	Commit(ctx context.Context) error
+
+	// Rollback discards all staged changes.
+	//
+	// Calling Rollback after Commit or Rollback is a no-op.
+	Rollback() error
+}
+
+// txnOp is an operation of a transaction, stored in the intent file.
+type txnOp struct {
+	Key fsdb.Key `json:"key"`
+	// Staged is the directory name under the transaction directory containing
+	// the staged entry, empty for deletes.
+	Staged string `json:"staged,omitempty"`
+	// Data is the filename of the staged data file, empty for deletes.
+	Data string `json:"data,omitempty"`
+}
+
+type txn struct {
+	db     *impl
+	dir    string
+	ops    map[string]*txnOp
+	seq    int
+	closed bool
+}
+
+func (db *impl) Begin(ctx context.Context) (Txn, error) {
+	select {
+	default:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	dir, err := db.getTempDir(txnDirPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &txn{
+		db:  db,
+		dir: dir,
+		ops: make(map[string]*txnOp),
+	}, nil
+}
+
+func (t *txn) Write(ctx context.Context, key fsdb.Key, data io.Reader) error {
+	if t.closed {
+		return errTxnClosed
+	}
+
+	select {
+	default:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := t.db.checkIndexKey(key); err != nil {
+		return err
+	}
+	staged := strconv.Itoa(t.seq)
+	t.seq++
+	tmpdir := t.dir + staged + PathSeparator
+	if err := os.Mkdir(tmpdir, tempDirMode); err != nil {
+		return err
+	}
+	w, err := t.db.newWriter(ctx, key, tmpdir)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, data); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.finish(); err != nil {
+		os.RemoveAll(tmpdir)
+		return err
+	}
+	t.setOp(&txnOp{
+		Key:    key,
+		Staged: staged,
+		Data:   w.dataFilename(),
+	})
+	return nil
+}
+
+func (t *txn) Delete(ctx context.Context, key fsdb.Key) error {
+	if t.closed {
+		return errTxnClosed
+	}
+
+	select {
+	default:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	t.setOp(&txnOp{Key: key})
+	return nil
+}
+
+// setOp sets the op of the key,
+// and removes the staged entry of the previous op of the same key.
+func (t *txn) setOp(op *txnOp) {
+	if old := t.ops[string(op.Key)]; old != nil && old.Staged != "" {
+		os.RemoveAll(t.dir + old.Staged)
+	}
+	t.ops[string(op.Key)] = op
+}
+
+func (t *txn) Commit(ctx context.Context) error {
+	if t.closed {
+		return errTxnClosed
+	}
+	t.closed = true
+	if err := t.commit(ctx); err != nil {
+		return err
+	}
+	return os.RemoveAll(t.dir)
+}
+
+// commit does the actual commit.
+//
+// If it fails after the intent file is written,
+// the transaction directory is kept and the rows are kept locked,
+// so that it will be rolled forward by Recover.
+// Otherwise the transaction directory is removed on failures.
+func (t *txn) commit(ctx context.Context) (err error) {
+	intentWritten := false
+	defer func() {
+		if err != nil && !intentWritten {
+			os.RemoveAll(t.dir)
+		}
+	}()
+
+	select {
+	default:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Always lock in the same order to avoid deadlocks.
+	rows := make([]string, 0, len(t.ops))
+	for row := range t.ops {
+		rows = append(rows, row)
+	}
+	sort.Strings(rows)
+	for _, row := range rows {
+		t.db.locks.Lock(row)
+	}
+	keepLocked := false
+	defer func() {
+		if !keepLocked {
+			t.db.unlockRows(rows)
+		}
+	}()
+
+	ops := make([]*txnOp, len(rows))
+	for i, row := range rows {
+		op := t.ops[row]
+		ops[i] = op
+		_, err := t.db.checkKey(op.Key)
+		if fsdb.IsNoSuchKeyError(err) && op.Staged != "" {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	default:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := t.db.writeIntent(t.dir, ops); err != nil {
+		return err
+	}
+	intentWritten = true
+	// Don't check ctx after this point, as the transaction is already committed
+	// and would be rolled forward anyway.
+	if err := t.db.applyTxn(t.dir, ops); err != nil {
+		keepLocked = true
+		t.db.addPendingTxn(&pendingTxn{
+			dir:  t.dir,
+			ops:  ops,
+			rows: rows,
+		})
+		return &TxnIncompleteError{Err: err}
+	}
+	return nil
+}
+
+// unlockRows unlocks the rows locked by a transaction.
+func (db *impl) unlockRows(rows []string) {
+	for _, row := range rows {
+		db.locks.Unlock(row)
+	}
+}
+
+// addPendingTxn adds a transaction failed to be fully applied,
+// to be finished by Recover.
+func (db *impl) addPendingTxn(p *pendingTxn) {
+	db.pendingLock.Lock()
+	defer db.pendingLock.Unlock()
+	if db.pending == nil {
+		db.pending = make(map[string]*pendingTxn)
+	}
+	db.pending[p.dir] = p
+}
+
+// isPendingTxn returns true if the directory is of a pending transaction.
+func (db *impl) isPendingTxn(dir string) bool {
+	db.pendingLock.Lock()
+	defer db.pendingLock.Unlock()
+	return db.pending[dir] != nil
+}
+
+// recoverPendingTxns finishes applying the pending transactions,
+// then unlocks their rows and removes their directories.
+//
+// The failed ones are kept pending to be retried by the next Recover.
+func (db *impl) recoverPendingTxns(ctx context.Context) error {
+	db.pendingLock.Lock()
+	defer db.pendingLock.Unlock()
+
+	var errs errbatch.ErrBatch
+	for dir, p := range db.pending {
+		select {
+		default:
+		case <-ctx.Done():
+			errs.Add(ctx.Err())
+			return errs.Compile()
+		}
+
+		if err := db.applyTxn(p.dir, p.ops); err != nil {
+			errs.Add(err)
+			continue
+		}
+		delete(db.pending, dir)
+		db.unlockRows(p.rows)
+		errs.Add(os.RemoveAll(p.dir))
+	}
+	return errs.Compile()
+}
+
+func (t *txn) Rollback() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	return os.RemoveAll(t.dir)
+}
+
+// writeIntent writes the intent file under dir atomically.
+//
+// As the intent file contains the keys,
+// it's encrypted if key encryption is on.
+//
+// The intent file is always fsynced regardless of the sync mode.
+// With SyncFull, dir is also fsynced after the intent file is in place.
+func (db *impl) writeIntent(dir string, ops []*txnOp) error {
+	content, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	if e := db.opts.GetEncryptor(); e != nil && db.opts.GetEncryptKeys() {
+		if content, err = e.Encrypt(content); err != nil {
+			return err
+		}
+	}
+	tmpPath := dir + tmpIntentFilename
+	if err := writeFile(tmpPath, content, true); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, dir+intentFilename); err != nil {
+		return err
+	}
+	if db.opts.GetSyncMode() >= SyncFull {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+// applyTxn applies the ops of a committed transaction,
+// then removes its intent file.
+//
+// It's safe to be called again on a partially applied transaction.
+func (db *impl) applyTxn(dir string, ops []*txnOp) error {
+	for _, op := range ops {
+		if err := db.applyTxnOp(dir, op); err != nil {
+			return err
+		}
+	}
+	// The intent file must be removed before the rest of the directory,
+	// otherwise an interrupted removal could cause the deletes in this
+	// transaction to be replayed on newer data.
+	return os.Remove(dir + intentFilename)
+}
+
+// applyTxnOp applies an op of a committed transaction under dir.
+func (db *impl) applyTxnOp(dir string, op *txnOp) error {
+	if op.Staged == "" {
+		entryDir, err := db.checkKey(op.Key)
+		if err == nil {
+			err = os.RemoveAll(entryDir)
+		}
+		if err != nil && !fsdb.IsNoSuchKeyError(err) {
+			return err
+		}
+		if db.opts.GetUseKeyIndex() {
+			return db.removeIndex(op.Key)
+		}
+		return nil
+	}
+
+	unlock := db.lockSlots(op.Key)
+	defer unlock()
+	entryDir, err := db.allocEntry(op.Key)
+	if err != nil {
+		return err
+	}
+	tmpdir := dir + op.Staged + PathSeparator
+	versioning := useVersioning(db.opts)
+	if versioning {
+		// If the staged data file is already moved,
+		// the current version is the one from this transaction.
+		if _, err := os.Lstat(tmpdir + op.Data); err == nil {
+			if err := db.archiveVersion(entryDir); err != nil {
+				return err
+			}
+		}
+	}
+	if err := db.commitEntry(tmpdir, entryDir, op.Data, true); err != nil {
+		return err
+	}
+	if versioning {
+		// Failures will be retried by the next write or scan, safe to ignore.
+		db.pruneVersions(entryDir)
+	}
+	if db.opts.GetUseKeyIndex() {
+		return db.addIndex(op.Key)
+	}
+	return nil
+}
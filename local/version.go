@@ -0,0 +1,367 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fishy/errbatch"
+
+	"github.com/fishy/fsdb"
+)
+
+// Make sure *NoSuchVersionError satisfies error interface.
+var _ error = (*NoSuchVersionError)(nil)
+
+// VersionsDirname is the directory name under the entry directory to store
+// noncurrent versions.
+const VersionsDirname = "versions"
+
+// versionIDLength is the length of version IDs,
+// which are hex encoded UnixNano of the time the version was overwritten.
+const versionIDLength = 16
+
+// versionTempDirPrefix is the prefix of the temporary directories under the
+// versions directory to build new versions in.
+const versionTempDirPrefix = "tmp-"
+
+// Version is a noncurrent version of an entry.
+type Version struct {
+	fsdb.EntryInfo
+
+	// ID is the opaque version ID used by ReadVersion and RestoreVersion.
+	ID string
+
+	// Overwritten is the time the version was overwritten,
+	// thus became noncurrent.
+	Overwritten time.Time
+}
+
+// NoSuchVersionError is an error returned by ReadVersion and RestoreVersion
+// when the version requested does not exist.
+type NoSuchVersionError struct {
+	Key fsdb.Key
+	ID  string
+}
+
+func (err *NoSuchVersionError) Error() string {
+	return fmt.Sprintf(
+		"fsdb/local: no such version %q for key %q",
+		err.ID,
+		err.Key,
+	)
+}
+
+// useVersioning returns whether versioning is enabled by the options.
+func useVersioning(opts Options) bool {
+	return opts.GetKeepVersions() > 0 || opts.GetKeepVersionsFor() > 0
+}
+
+// parseVersionID parses the version ID into the overwritten time.
+func parseVersionID(id string) (time.Time, error) {
+	if len(id) != versionIDLength {
+		return time.Time{}, fmt.Errorf("fsdb/local: invalid version id %q", id)
+	}
+	nanos, err := strconv.ParseInt(id, 16, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// archiveVersion copies the current version under dir into the versions
+// directory.
+//
+// The files are hard linked (or copied if hard links are not supported),
+// so the entry directory always holds a complete version until the new one is
+// moved in by commitEntry.
+// They are linked into a temporary directory under the versions directory
+// first, which is then renamed to the version ID,
+// so versions partially copied by a crash are invisible to ListVersions,
+// and removed by pruneVersions once they are stale.
+//
+// It's a no-op if there's no current data file,
+// or the current version is already archived (e.g. by a transaction replayed
+// after a crash).
+// It must be called with the row lock held.
+func (db *impl) archiveVersion(dir string) error {
+	sync := db.opts.GetSyncMode() >= SyncFull
+	var dataFilename string
+	for _, filename := range db.dataFilenames() {
+		if _, err := os.Lstat(dir + filename); err == nil {
+			dataFilename = filename
+			break
+		}
+	}
+	if dataFilename == "" {
+		return nil
+	}
+
+	root := dir + VersionsDirname + PathSeparator
+	if ids, err := listVersionIDs(dir); err == nil && len(ids) > 0 {
+		current, err := os.Lstat(dir + dataFilename)
+		if err != nil {
+			return err
+		}
+		latest, err := os.Lstat(root + ids[0] + PathSeparator + dataFilename)
+		if err == nil && os.SameFile(current, latest) {
+			return nil
+		}
+	}
+	if err := mkdirAll(root, sync); err != nil {
+		return err
+	}
+	tmpdir, err := ioutil.TempDir(root, versionTempDirPrefix)
+	if err != nil {
+		return err
+	}
+	if err := db.buildVersion(dir, tmpdir+PathSeparator, dataFilename); err != nil {
+		os.RemoveAll(tmpdir)
+		return err
+	}
+	for nanos := time.Now().UnixNano(); ; nanos++ {
+		versionDir := root + fmt.Sprintf("%016x", nanos)
+		if _, err := os.Lstat(versionDir); err == nil {
+			continue
+		}
+		err := os.Rename(tmpdir, versionDir)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			os.RemoveAll(tmpdir)
+			return err
+		}
+	}
+	if sync {
+		return syncDir(root)
+	}
+	return nil
+}
+
+// buildVersion links the files of the current version under dir into tmpdir.
+func (db *impl) buildVersion(dir, tmpdir, dataFilename string) error {
+	sync := db.opts.GetSyncMode() >= SyncFull
+	for _, filename := range []string{dataFilename, MetadataFilename, MetaFilename} {
+		err := linkFile(dir+filename, tmpdir+filename, sync)
+		if err != nil && (filename == dataFilename || !os.IsNotExist(err)) {
+			return err
+		}
+	}
+	if sync {
+		return syncDir(tmpdir)
+	}
+	return nil
+}
+
+// linkFile hard links src to dst,
+// or copies it if hard links are not supported.
+func linkFile(src, dst string, sync bool) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := createFile(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if sync {
+		if err := out.Sync(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// listVersionIDs returns the version IDs under dir, newest first.
+func listVersionIDs(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir + VersionsDirname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		if _, err := parseVersionID(info.Name()); err != nil {
+			continue
+		}
+		ids = append(ids, info.Name())
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	return ids, nil
+}
+
+// pruneVersions removes the noncurrent versions under dir that are no longer
+// needed to be kept per options,
+// and the stale temporary directories left by archiveVersion.
+func (db *impl) pruneVersions(dir string) error {
+	ids, err := listVersionIDs(dir)
+	if err != nil {
+		return err
+	}
+	keep := db.opts.GetKeepVersions()
+	keepFor := db.opts.GetKeepVersionsFor()
+	now := time.Now()
+	var errs errbatch.ErrBatch
+	errs.Add(db.pruneVersionTempDirs(dir))
+	for i, id := range ids {
+		if i < keep {
+			continue
+		}
+		overwritten, _ := parseVersionID(id)
+		if keepFor > 0 && now.Sub(overwritten) < keepFor {
+			continue
+		}
+		errs.Add(os.RemoveAll(dir + VersionsDirname + PathSeparator + id))
+	}
+	// Only works when it's empty.
+	os.Remove(dir + VersionsDirname)
+	return errs.Compile()
+}
+
+// pruneVersionTempDirs removes the stale temporary directories left by
+// archiveVersion interrupted by crashes under dir.
+func (db *impl) pruneVersionTempDirs(dir string) error {
+	root := dir + VersionsDirname + PathSeparator
+	infos, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var errs errbatch.ErrBatch
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), versionTempDirPrefix) &&
+			db.isStale(info.ModTime()) {
+			errs.Add(os.RemoveAll(root + info.Name()))
+		}
+	}
+	return errs.Compile()
+}
+
+// ListVersions lists the noncurrent versions of the key, newest first.
+//
+// If the key does not exist, it returns NoSuchKeyError.
+func (db *impl) ListVersions(ctx context.Context, key fsdb.Key) ([]Version, error) {
+	select {
+	default:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	dir, err := db.checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := listVersionIDs(dir)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, 0, len(ids))
+	for _, id := range ids {
+		info, _, err := db.statEntry(dir + VersionsDirname + PathSeparator + id + PathSeparator)
+		if os.IsNotExist(err) {
+			// Pruned during listing.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		overwritten, _ := parseVersionID(id)
+		versions = append(versions, Version{
+			EntryInfo:   *info,
+			ID:          id,
+			Overwritten: overwritten,
+		})
+	}
+	return versions, nil
+}
+
+// ReadVersion opens a noncurrent version of the key for read.
+//
+// If the key does not exist, it returns NoSuchKeyError.
+// If the version does not exist, it returns NoSuchVersionError.
+func (db *impl) ReadVersion(
+	ctx context.Context,
+	key fsdb.Key,
+	id string,
+) (io.ReadCloser, error) {
+	reader, _, err := db.readVersion(ctx, key, id)
+	return reader, err
+}
+
+// readVersion opens a noncurrent version of the key for read,
+// and also returns its user-defined metadata.
+func (db *impl) readVersion(
+	ctx context.Context,
+	key fsdb.Key,
+	id string,
+) (io.ReadCloser, map[string]string, error) {
+	select {
+	default:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	dir, err := db.checkKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := parseVersionID(id); err != nil {
+		return nil, nil, &NoSuchVersionError{Key: key, ID: id}
+	}
+	versionDir := dir + VersionsDirname + PathSeparator + id + PathSeparator
+	meta, err := readMeta(versionDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata, err := readMetadata(versionDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := db.openData(versionDir, meta)
+	if os.IsNotExist(err) {
+		return nil, nil, &NoSuchVersionError{Key: key, ID: id}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return verifyChecksum(reader, key, meta), metadata, nil
+}
+
+// RestoreVersion makes a noncurrent version of the key the current version.
+//
+// The current version will become a noncurrent version,
+// and the restored version is still kept as a noncurrent version.
+// The restored version never expires.
+func (db *impl) RestoreVersion(ctx context.Context, key fsdb.Key, id string) error {
+	reader, metadata, err := db.readVersion(ctx, key, id)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return db.WriteWithOptions(ctx, key, reader, fsdb.WriteOptions{
+		Metadata: metadata,
+	})
+}
@@ -0,0 +1,498 @@
+package local
+
+import (
+	"context"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fishy/errbatch"
+
+	"github.com/fishy/fsdb"
+	"github.com/fishy/fsdb/codec"
+	"github.com/fishy/fsdb/crypt"
+)
+
+// Make sure *writer satisfies fsdb.WriteCloser interface.
+var _ fsdb.WriteCloser = (*writer)(nil)
+
+// writer writes an entry into the temporary directory,
+// and moves it into the actual directory on Close.
+type writer struct {
+	ctx          context.Context
+	db           *impl
+	key          fsdb.Key
+	precondition *fsdb.Precondition
+	expires      time.Time
+	metadata     map[string]string
+
+	// dir is the entry directory,
+	// only resolved on Close as collision slots could change before that.
+	dir         string
+	tmpdir      string
+	tmpKeyFile  string
+	tmpMetaFile string
+	tmpDataFile string
+
+	file       *os.File
+	encryptor  *crypt.Writer
+	compressor io.WriteCloser
+	writer     io.Writer
+	hash       hash.Hash32
+	size       int64
+	keyID      string
+
+	checksumName string
+	checksum     hash.Hash
+	closed       bool
+
+	// When the compression policy is enabled,
+	// data written is buffered in sample until the codec is decided.
+	codec    codec.Codec
+	policy   codec.Policy
+	sample   []byte
+	sampling bool
+
+	// rewrite is true when the writer rewrites the current version of an
+	// existing entry in place (e.g. by RotateKeys),
+	// so no noncurrent version is archived.
+	rewrite bool
+}
+
+func (db *impl) Create(
+	ctx context.Context,
+	key fsdb.Key,
+) (fsdb.WriteCloser, error) {
+	return db.create(ctx, key, nil)
+}
+
+func (db *impl) CreateWithOptions(
+	ctx context.Context,
+	key fsdb.Key,
+	opts fsdb.WriteOptions,
+	precondition *fsdb.Precondition,
+) (fsdb.WriteCloser, error) {
+	return db.createWithOptions(ctx, key, opts, precondition)
+}
+
+// createWithOptions creates a writer with the write options.
+func (db *impl) createWithOptions(
+	ctx context.Context,
+	key fsdb.Key,
+	opts fsdb.WriteOptions,
+	precondition *fsdb.Precondition,
+) (*writer, error) {
+	w, err := db.create(ctx, key, precondition)
+	if err != nil {
+		return nil, err
+	}
+	w.expires = opts.Expires()
+	w.metadata = opts.Metadata
+	return w, nil
+}
+
+// create creates a writer.
+//
+// If precondition is non-nil,
+// it will be checked both here and again when committing.
+func (db *impl) create(
+	ctx context.Context,
+	key fsdb.Key,
+	precondition *fsdb.Precondition,
+) (*writer, error) {
+	select {
+	default:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if err := db.checkIndexKey(key); err != nil {
+		return nil, err
+	}
+	if _, err := db.checkKey(key); err != nil && !fsdb.IsNoSuchKeyError(err) {
+		return nil, err
+	}
+	if precondition != nil {
+		if err := db.checkPrecondition(ctx, key, *precondition); err != nil {
+			return nil, err
+		}
+	}
+	tmpdir, err := db.getTempDir(tempDirPrefix)
+	if err != nil {
+		return nil, err
+	}
+	w, err := db.newWriter(ctx, key, tmpdir)
+	if err != nil {
+		return nil, err
+	}
+	w.precondition = precondition
+	return w, nil
+}
+
+// newWriter creates a writer writing into tmpdir.
+//
+// tmpdir is removed if it fails.
+func (db *impl) newWriter(
+	ctx context.Context,
+	key fsdb.Key,
+	tmpdir string,
+) (*writer, error) {
+	w := &writer{
+		ctx:         ctx,
+		db:          db,
+		key:         key,
+		tmpdir:      tmpdir,
+		tmpKeyFile:  tmpdir + KeyFilename,
+		tmpMetaFile: tmpdir + MetaFilename,
+		hash:        newETagHash(),
+	}
+	// crc32c checksums are the same as the crc32c already in ETags,
+	// so they are not calculated or stored separately.
+	if name, h := newChecksum(db.opts.GetChecksumAlgorithm()); name != ChecksumCRC32C.String() {
+		w.checksumName, w.checksum = name, h
+	}
+	if err := w.init(db.opts); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// init writes the temp key file and opens the temp data file.
+func (w *writer) init(opts Options) error {
+	// Write temp key file
+	key, err := w.db.encodeKey(w.key)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(w.tmpKeyFile, key, opts.GetSyncMode() >= SyncData); err != nil {
+		return err
+	}
+
+	select {
+	default:
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+
+	// Open temp data file
+	//
+	// When sampling, it's opened as uncompressed data file first,
+	// and renamed after the codec is decided,
+	// so that the temp directory always has a data file before committing.
+	c := opts.GetCodec()
+	policy := opts.GetCompressionPolicy()
+	if c.Suffix() != "" && policy.Enabled() {
+		w.codec = c
+		w.policy = policy
+		w.sampling = true
+		c = codec.None
+	}
+	w.tmpDataFile = w.tmpdir + dataFilename(c)
+	if w.file, err = createFile(w.tmpDataFile); err != nil {
+		return err
+	}
+	if e := opts.GetEncryptor(); e != nil {
+		if w.encryptor, err = e.NewWriter(w.file); err != nil {
+			return err
+		}
+		w.keyID = w.encryptor.KeyID()
+	}
+	return w.useCodec(c)
+}
+
+// useCodec sets up the writer to write data compressed by the codec,
+// then encrypted if encryption is enabled.
+func (w *writer) useCodec(c codec.Codec) error {
+	var base io.Writer = w.file
+	if w.encryptor != nil {
+		base = w.encryptor
+	}
+	w.writer = base
+	if c.Suffix() != "" {
+		var err error
+		if w.compressor, err = c.NewWriter(base); err != nil {
+			return err
+		}
+		w.writer = w.compressor
+	}
+	return nil
+}
+
+// decide decides the codec by the sample per compression policy,
+// then writes the sample.
+func (w *writer) decide() error {
+	w.sampling = false
+	sample := w.sample
+	w.sample = nil
+	worth, err := w.policy.Worth(w.codec, sample)
+	if err != nil {
+		return err
+	}
+	c := codec.None
+	if worth {
+		c = w.codec
+		path := w.tmpdir + dataFilename(c)
+		if err := os.Rename(w.tmpDataFile, path); err != nil {
+			return err
+		}
+		w.tmpDataFile = path
+	}
+	if err := w.useCodec(c); err != nil {
+		return err
+	}
+	_, err = w.writer.Write(sample)
+	return err
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errWriterClosed
+	}
+
+	select {
+	default:
+	case <-w.ctx.Done():
+		return 0, w.ctx.Err()
+	}
+
+	var n int
+	var err error
+	if w.sampling {
+		w.sample = append(w.sample, p...)
+		n = len(p)
+		if len(w.sample) >= w.policy.SampleSize {
+			err = w.decide()
+		}
+	} else {
+		n, err = w.writer.Write(p)
+	}
+	w.hash.Write(p[:n])
+	if w.checksum != nil {
+		w.checksum.Write(p[:n])
+	}
+	w.size += int64(n)
+	return n, err
+}
+
+// Close commits the entry.
+//
+// The temp directory is removed regardless of the result.
+func (w *writer) Close() (err error) {
+	if w.closed {
+		return errWriterClosed
+	}
+	w.closed = true
+	defer os.RemoveAll(w.tmpdir)
+
+	if err = w.finish(); err != nil {
+		return err
+	}
+
+	select {
+	default:
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+
+	w.db.locks.Lock(string(w.key))
+	defer w.db.locks.Unlock(string(w.key))
+
+	if w.precondition != nil {
+		if err = w.db.checkPrecondition(w.ctx, w.key, *w.precondition); err != nil {
+			return err
+		}
+	}
+
+	unlock := w.db.lockSlots(w.key)
+	defer unlock()
+	if w.dir, err = w.db.allocEntry(w.key); err != nil {
+		return err
+	}
+
+	// Don't check ctx after this point, as canceling after the data file is
+	// moved would leave the entry with a stale meta file.
+	versioning := useVersioning(w.db.opts) && !w.rewrite
+	if versioning {
+		if err = w.db.archiveVersion(w.dir); err != nil {
+			return err
+		}
+	}
+	if err = w.db.commitEntry(w.tmpdir, w.dir, w.dataFilename(), false); err != nil {
+		return err
+	}
+	if versioning {
+		// Failures will be retried by the next write or scan, safe to ignore.
+		w.db.pruneVersions(w.dir)
+	}
+	if w.db.opts.GetUseKeyIndex() {
+		return w.db.addIndex(w.key)
+	}
+	return nil
+}
+
+// finish closes the temp data file and writes the temp meta file,
+// so that the temp directory is ready to be committed.
+func (w *writer) finish() error {
+	if w.sampling {
+		// Data is shorter than the sample size.
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	mode := w.db.opts.GetSyncMode()
+	if err := w.closeFiles(mode >= SyncData); err != nil {
+		return err
+	}
+	meta := &entryMeta{
+		ETag:  formatETag(w.hash, w.size),
+		KeyID: w.keyID,
+	}
+	if w.checksum != nil {
+		meta.Checksum = formatChecksum(w.checksumName, w.checksum)
+	}
+	if !w.expires.IsZero() {
+		meta.Expires = &w.expires
+	}
+	if len(w.metadata) > 0 {
+		if err := writeMetadata(
+			w.tmpdir+MetadataFilename,
+			w.metadata,
+			mode >= SyncData,
+		); err != nil {
+			return err
+		}
+	}
+	return writeMeta(w.tmpMetaFile, meta, mode >= SyncData)
+}
+
+// dataFilename returns the filename of the data file,
+// which depends on the codec used.
+func (w *writer) dataFilename() string {
+	return filepath.Base(w.tmpDataFile)
+}
+
+// commitMkdirRetries is the number of times commitEntry retries creating dir
+// and moving the data file into it,
+// when dir is removed in between by a scan as an empty directory.
+const commitMkdirRetries = 10
+
+// commitEntry moves the key, meta and data files under tmpdir into dir.
+//
+// When replay is true, files missing from tmpdir are assumed to be already
+// moved by a previous interrupted attempt.
+//
+// With SyncFull, dir is fsynced after all the files are moved.
+func (db *impl) commitEntry(tmpdir, dir, dataFilename string, replay bool) error {
+	sync := db.opts.GetSyncMode() >= SyncFull
+	rename := func(filename string) error {
+		err := os.Rename(tmpdir+filename, dir+filename)
+		if replay && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// Move data file
+	//
+	// dir is not empty after that,
+	// so it's no longer removed by the scans.
+	for retries := 0; ; retries++ {
+		err := mkdirAll(dir, sync)
+		if err == nil {
+			err = rename(dataFilename)
+		}
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) || retries >= commitMkdirRetries {
+			return err
+		}
+	}
+	for _, file := range db.dataFilenames() {
+		if file == dataFilename {
+			continue
+		}
+		if err := os.Remove(dir + file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Move or remove metadata file.
+	//
+	// Entries written by transactions never have metadata files,
+	// so it's safe to remove the metadata file when replaying them.
+	if _, err := os.Lstat(tmpdir + MetadataFilename); err == nil {
+		if err := rename(MetadataFilename); err != nil {
+			return err
+		}
+	} else if err := os.Remove(dir + MetadataFilename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Move meta and key files.
+	if err := rename(MetaFilename); err != nil {
+		return err
+	}
+	if err := rename(KeyFilename); err != nil {
+		return err
+	}
+	if sync {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+func (w *writer) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	w.closeFiles(false)
+	return os.RemoveAll(w.tmpdir)
+}
+
+// closeFiles flushes and closes the opened temp data file.
+//
+// If sync is true, the temp data file is also fsynced before closing.
+func (w *writer) closeFiles(sync bool) error {
+	var ret errbatch.ErrBatch
+	if w.compressor != nil {
+		ret.Add(w.compressor.Close())
+	}
+	if w.encryptor != nil {
+		ret.Add(w.encryptor.Close())
+	}
+	if w.file != nil {
+		if sync {
+			ret.Add(w.file.Sync())
+		}
+		ret.Add(w.file.Close())
+	}
+	return ret.Compile()
+}
+
+// checkPrecondition checks precondition against the current entry.
+func (db *impl) checkPrecondition(
+	ctx context.Context,
+	key fsdb.Key,
+	precondition fsdb.Precondition,
+) error {
+	info, err := db.Stat(ctx, key)
+	if fsdb.IsNoSuchKeyError(err) {
+		info, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	if !precondition.Check(info) {
+		return &fsdb.PreconditionFailedError{
+			Key:          key,
+			Precondition: precondition,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package fsdb
+
+import (
+	"fmt"
+)
+
+type preconditionKind int
+
+const (
+	ifNotExist preconditionKind = iota
+	ifExist
+	ifMatch
+)
+
+// Precondition defines the condition checked by WriteIf before committing the
+// write.
+type Precondition struct {
+	kind preconditionKind
+	etag string
+}
+
+// Preconditions that can be used in WriteIf.
+var (
+	// IfNotExist requires the key to not exist.
+	IfNotExist = Precondition{kind: ifNotExist}
+
+	// IfExist requires the key to exist.
+	IfExist = Precondition{kind: ifExist}
+)
+
+// IfMatch creates a Precondition that requires the key to exist with the given
+// ETag.
+//
+// An empty ETag never matches.
+func IfMatch(etag string) Precondition {
+	return Precondition{
+		kind: ifMatch,
+		etag: etag,
+	}
+}
+
+// Check checks the precondition against the current EntryInfo of the key.
+//
+// info should be nil if the key does not exist.
+func (p Precondition) Check(info *EntryInfo) bool {
+	switch p.kind {
+	default:
+		return false
+	case ifNotExist:
+		return info == nil
+	case ifExist:
+		return info != nil
+	case ifMatch:
+		return info != nil && info.ETag != "" && info.ETag == p.etag
+	}
+}
+
+func (p Precondition) String() string {
+	switch p.kind {
+	default:
+		return "unknown"
+	case ifNotExist:
+		return "if-not-exist"
+	case ifExist:
+		return "if-exist"
+	case ifMatch:
+		return fmt.Sprintf("if-match(%q)", p.etag)
+	}
+}
@@ -0,0 +1,38 @@
+package fsdb_test
+
+import (
+	"testing"
+
+	"github.com/fishy/fsdb"
+)
+
+func TestPrecondition(t *testing.T) {
+	info := &fsdb.EntryInfo{ETag: "foo"}
+	emptyETag := &fsdb.EntryInfo{}
+
+	for _, c := range []struct {
+		precondition fsdb.Precondition
+		info         *fsdb.EntryInfo
+		expect       bool
+	}{
+		{fsdb.IfNotExist, nil, true},
+		{fsdb.IfNotExist, info, false},
+		{fsdb.IfExist, nil, false},
+		{fsdb.IfExist, info, true},
+		{fsdb.IfMatch("foo"), nil, false},
+		{fsdb.IfMatch("foo"), info, true},
+		{fsdb.IfMatch("bar"), info, false},
+		{fsdb.IfMatch(""), emptyETag, false},
+	} {
+		actual := c.precondition.Check(c.info)
+		if actual != c.expect {
+			t.Errorf(
+				"%v.Check(%+v) expected %v, got %v",
+				c.precondition,
+				c.info,
+				c.expect,
+				actual,
+			)
+		}
+	}
+}
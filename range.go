@@ -0,0 +1,49 @@
+package fsdb
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/fishy/wrapreader"
+)
+
+var errNegativeOffset = errors.New("fsdb: negative offset")
+
+// ReadRange wraps a ReadCloser to only read length bytes starting at offset.
+//
+// If length is negative, it reads till the end.
+//
+// If reader also implements io.Seeker,
+// it will be used to skip to offset.
+// Otherwise the first offset bytes will be read and discarded.
+//
+// It can be used by FSDB implementations to implement ReadRange.
+// If it returns an error, reader will be closed.
+func ReadRange(
+	reader io.ReadCloser,
+	offset int64,
+	length int64,
+) (io.ReadCloser, error) {
+	if offset < 0 {
+		reader.Close()
+		return nil, errNegativeOffset
+	}
+	if offset > 0 {
+		if seeker, ok := reader.(io.Seeker); ok {
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				reader.Close()
+				return nil, err
+			}
+		} else {
+			if _, err := io.CopyN(ioutil.Discard, reader, offset); err != nil && err != io.EOF {
+				reader.Close()
+				return nil, err
+			}
+		}
+	}
+	if length < 0 {
+		return reader, nil
+	}
+	return wrapreader.Wrap(io.LimitReader(reader, length), reader), nil
+}